@@ -0,0 +1,38 @@
+package bus
+
+import (
+	"sync"
+	"time"
+)
+
+// broadcastCache builds the message broadcast to WebSocket clients at most once per maxAge and shares it
+// between every connection, so ETAs and the operational status are not computed once per client
+type broadcastCache struct {
+	maxAge time.Duration
+	build  func(now time.Time) ([]byte, error)
+
+	mu      sync.Mutex
+	message []byte
+	builtAt time.Time
+}
+
+func NewBroadcastCache(maxAge time.Duration, build func(now time.Time) ([]byte, error)) *broadcastCache {
+	return &broadcastCache{maxAge: maxAge, build: build}
+}
+
+// Message returns the latest message, rebuilding it when it is older than maxAge.
+// Connections asking while it is rebuilt wait for the new message.
+func (b *broadcastCache) Message(now time.Time) ([]byte, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.message != nil && now.Sub(b.builtAt) < b.maxAge {
+		return b.message, nil
+	}
+	message, err := b.build(now)
+	if err != nil {
+		return nil, err
+	}
+	b.message = message
+	b.builtAt = now
+	return message, nil
+}
@@ -3,7 +3,10 @@ package bus
 import (
 	"context"
 	"log"
+	"sync"
+	"time"
 
+	"github.com/FreeJ1nG/bikuntracker-backend/app/dto"
 	"github.com/FreeJ1nG/bikuntracker-backend/app/interfaces"
 	"github.com/FreeJ1nG/bikuntracker-backend/app/models"
 	"github.com/gammazero/deque"
@@ -19,15 +22,28 @@ type dqStore struct {
 }
 
 type container struct {
-	config         *models.Config
-	rmService      interfaces.RMService
-	damriService   interfaces.DamriService
-	busService     interfaces.BusService
-	busCoordinates map[string]*models.BusCoordinate
-	storedBuses    map[string]*dqStore
-	previousHalte  map[string]string // imei -> previous halte name
-	activeLaps     map[string]bool   // imei -> whether bus has active lap
-	currentPlates  map[string]string // imei -> current plate number
+	config       *models.Config
+	rmService    interfaces.RMService
+	damriService interfaces.DamriService
+	busService   interfaces.BusService
+	halteCatalog interfaces.HalteCatalog
+	routeCatalog interfaces.RouteCatalog
+	// telemetryWriter may be nil, fixes are then kept in memory only
+	telemetryWriter interfaces.TelemetryWriter
+	state           *stateStore
+	filter          *fixFilter
+	ingestStats     ingestStats
+	// metadataLoadedAt is guarded by ingestMu
+	metadataLoadedAt time.Time
+	sourcesMu        sync.RWMutex
+	sources          []interfaces.LocationSource
+	clock            func() time.Time
+	listenersMu      sync.RWMutex
+	listeners        []func(event dto.BusEvent)
+	// ingestMu serializes the ingestion pipeline so halte and lap transitions are evaluated one update at a time
+	ingestMu sync.Mutex
+	// persistQueue holds the database writes of the pipeline, run in order by RunPersister
+	persistQueue chan persistJob
 }
 
 func NewContainer(
@@ -35,38 +51,52 @@ func NewContainer(
 	rmService interfaces.RMService,
 	damriService interfaces.DamriService,
 	busService interfaces.BusService,
+	halteCatalog interfaces.HalteCatalog,
+	routeCatalog interfaces.RouteCatalog,
+	telemetryWriter interfaces.TelemetryWriter,
 ) *container {
+	filter, err := newFixFilter(config)
+	if err != nil {
+		log.Printf("Invalid CAMPUS_POLYGON, using the default campus area: %v", err)
+	}
 	return &container{
-		config:         config,
-		rmService:      rmService,
-		damriService:   damriService,
-		busService:     busService,
-		busCoordinates: make(map[string]*models.BusCoordinate),
-		storedBuses:    make(map[string]*dqStore),
-		previousHalte:  make(map[string]string),
-		activeLaps:     make(map[string]bool),
-		currentPlates:  make(map[string]string),
+		config:          config,
+		rmService:       rmService,
+		damriService:    damriService,
+		busService:      busService,
+		halteCatalog:    halteCatalog,
+		routeCatalog:    routeCatalog,
+		telemetryWriter: telemetryWriter,
+		state:           newStateStore(),
+		filter:          filter,
+		persistQueue:    make(chan persistJob, persistQueueSize),
 	}
 }
 
-func (c *container) GetBusCoordinates() (res []models.BusCoordinate) {
-	res = make([]models.BusCoordinate, 0)
-	for _, busCoordinate := range c.busCoordinates {
-		res = append(res, *busCoordinate)
-	}
-	return
+func (c *container) GetBusCoordinates() []models.BusCoordinate {
+	return c.state.Coordinates()
 }
 
 func (c *container) GetBusCoordinatesMap() map[string]*models.BusCoordinate {
-	return c.busCoordinates
+	return c.state.CoordinatesMap()
 }
 
-func (c *container) UpdateRuntimeBusColor(imei string, color string) error {
-	if coord, exists := c.busCoordinates[imei]; exists {
-		coord.Color = color
-		return nil
+func (c *container) GetIngestStats() dto.IngestStats {
+	stats := c.ingestStats.snapshot()
+	if c.telemetryWriter != nil {
+		telemetry := c.telemetryWriter.Stats()
+		stats.Telemetry = &telemetry
 	}
-	// Return error if bus not found in runtime coordinates, but don't fail the request
+	return stats
+}
+
+func (c *container) GetPreviousHalte(imei string) string {
+	return c.state.PreviousHalte(imei)
+}
+
+func (c *container) UpdateRuntimeBusColor(imei string, color string) error {
+	c.state.SetBusColor(imei, color)
+	// Bus not being in the runtime coordinates yet is not an error, it will pick the color up on its next update
 	return nil
 }
 
@@ -75,7 +105,7 @@ func (c *container) RunCron() (err error) {
 	return nil
 }
 
-// InitRuntimeState initializes runtime caches from database (colors, active laps, plates)
+// InitRuntimeState initializes runtime caches from database (colors, active laps, plates, drivers)
 func (c *container) InitRuntimeState() {
 	ctx := context.Background()
 	buses, err := c.busService.GetAllBuses(ctx)
@@ -86,26 +116,36 @@ func (c *container) InitRuntimeState() {
 	for _, b := range buses {
 		_, _ = c.busService.UpdateBusColorByImei(ctx, b.Imei, "grey")
 		activeLap, _ := c.busService.GetActiveLap(ctx, b.Imei)
-		c.activeLaps[b.Imei] = activeLap != nil
-		c.currentPlates[b.Imei] = b.PlateNumber
+		c.state.SetActiveLap(b.Imei, activeLap != nil)
+		if activeLap != nil {
+			c.state.SetLapStops(b.Imei, len(activeLap.HalteVisits))
+		}
+		c.state.SetCurrentPlate(b.Imei, b.PlateNumber)
+	}
+	drivers, err := c.busService.GetCurrentDrivers(ctx)
+	if err != nil {
+		log.Printf("Failed to load current drivers: %v", err)
+	}
+	for imei, driver := range drivers {
+		c.state.SetCurrentDriver(imei, driver)
 	}
+	c.state.SetBusMetadata(buses)
+	c.metadataLoadedAt = time.Now()
 }
 
-// ApplyExternalCoordinates allows feeding new coordinates from an external source (webhook)
-// without modifying business logic. It reuses the same pipeline as WS ingestion.
-func (c *container) ApplyExternalCoordinates(coords map[string]*models.BusCoordinate) {
+// runPipeline evaluates colors, lane detection, halte visits and lap transitions for the given coordinates.
+// Callers must hold ingestMu, database writes are queued for RunPersister.
+func (c *container) runPipeline(coords map[string]*models.BusCoordinate) {
 	// Update colors based on halte transitions
 	c.updateBusColors(coords)
 	// Store into rolling windows for lane detection
 	c.insertFetchedData(coords)
 	// Update halte visits and lap start/end
-	c.updateHalteVisits(context.Background(), coords)
+	c.updateHalteVisits(coords)
 	// Possibly change bus lane via RM service
 	if err := c.possiblyChangeBusLane(); err != nil {
 		log.Printf("Unable to change bus lane: %s", err.Error())
 	}
 	// Optional logs
 	c.logCsvIfNeeded(coords)
-	// Replace runtime map
-	c.busCoordinates = coords
 }
@@ -0,0 +1,296 @@
+package bus
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/FreeJ1nG/bikuntracker-backend/app/dto"
+	"github.com/FreeJ1nG/bikuntracker-backend/app/models"
+)
+
+var (
+	ErrLapNotFound          = errors.New("lap not found")
+	ErrInvalidLapCorrection = errors.New("invalid lap correction")
+)
+
+var lapCorrectionActions = []string{models.LAP_CORRECTION_VOID, models.LAP_CORRECTION_ROUTE_COLOR, models.LAP_CORRECTION_TIMES, models.LAP_CORRECTION_SPLIT, models.LAP_CORRECTION_MERGE}
+
+// Longest corrected_by the lap_correction table stores
+const maxCorrectedByLength = 255
+
+// CorrectLap applies an admin correction to a closed lap. The anomalies of the laps that are not voided afterwards
+// are recomputed with anomalies. Lap numbers never change, the lap split off a lap gets the next number of its bus.
+// CorrectedBy is only recorded, it is not tied to the admin API key that authorized the request.
+func (s *service) CorrectLap(ctx context.Context, lapId int, req dto.LapCorrectionRequest, anomalies func(lap models.BusLapHistory) []string) (*models.LapCorrection, error) {
+	req.CorrectedBy = strings.TrimSpace(req.CorrectedBy)
+	req.Reason = strings.TrimSpace(req.Reason)
+	if err := validateLapCorrection(req); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidLapCorrection, err)
+	}
+
+	lapIds := []int{lapId}
+	if req.Action == models.LAP_CORRECTION_MERGE {
+		if *req.MergeWithLapID == lapId {
+			return nil, fmt.Errorf("%w: a lap cannot be merged with itself", ErrInvalidLapCorrection)
+		}
+		lapIds = append(lapIds, *req.MergeWithLapID)
+	}
+
+	correction := models.LapCorrection{
+		LapID:       lapId,
+		Action:      req.Action,
+		CorrectedBy: req.CorrectedBy,
+		Reason:      req.Reason,
+	}
+	res, err := s.repo.CorrectLaps(ctx, correction, lapIds, func(laps []models.BusLapHistory, lapsBetween dto.LapsBetweenFunc) (dto.LapCorrectionChange, error) {
+		for _, lap := range laps {
+			if err := correctableLap(lap); err != nil {
+				return dto.LapCorrectionChange{}, err
+			}
+		}
+		change, err := correctLaps(laps, req, time.Now(), lapsBetween)
+		if err != nil {
+			return change, err
+		}
+		for i, lap := range change.After {
+			if lap.VoidedAt == nil {
+				change.After[i].Anomalies = anomalies(lap)
+			}
+		}
+		return change, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range res.Before {
+		s.convertLapHistoryToUTC(&res.Before[i])
+	}
+	for i := range res.After {
+		s.convertLapHistoryToUTC(&res.After[i])
+	}
+	return res, nil
+}
+
+// GetLapCorrections returns the corrections involving a lap, oldest first
+func (s *service) GetLapCorrections(ctx context.Context, lapId int) ([]models.LapCorrection, error) {
+	return s.repo.GetLapCorrections(ctx, lapId)
+}
+
+// validateLapCorrection checks that a correction names who made it, why, and the fields its action needs
+func validateLapCorrection(req dto.LapCorrectionRequest) error {
+	if !slices.Contains(lapCorrectionActions, req.Action) {
+		return fmt.Errorf("invalid action (expected one of %s)", strings.Join(lapCorrectionActions, ", "))
+	}
+	if req.CorrectedBy == "" {
+		return fmt.Errorf("corrected_by is required")
+	}
+	if utf8.RuneCountInString(req.CorrectedBy) > maxCorrectedByLength {
+		return fmt.Errorf("corrected_by must be at most %d characters", maxCorrectedByLength)
+	}
+	if strings.IndexFunc(req.CorrectedBy, unicode.IsControl) >= 0 {
+		return fmt.Errorf("corrected_by must not contain control characters")
+	}
+	if req.Reason == "" {
+		return fmt.Errorf("reason is required")
+	}
+	switch req.Action {
+	case models.LAP_CORRECTION_ROUTE_COLOR:
+		if req.RouteColor == nil || *req.RouteColor == "" {
+			return fmt.Errorf("route_color is required to change the route color")
+		}
+	case models.LAP_CORRECTION_TIMES:
+		if req.StartTime == nil && req.EndTime == nil {
+			return fmt.Errorf("start_time or end_time is required to adjust times")
+		}
+	case models.LAP_CORRECTION_SPLIT:
+		if req.SplitAtSequence == nil {
+			return fmt.Errorf("split_at_sequence is required to split a lap")
+		}
+	case models.LAP_CORRECTION_MERGE:
+		if req.MergeWithLapID == nil {
+			return fmt.Errorf("merge_with_lap_id is required to merge laps")
+		}
+	}
+	return nil
+}
+
+// correctableLap checks that an admin may correct lap
+func correctableLap(lap models.BusLapHistory) error {
+	if lap.EndTime == nil {
+		return fmt.Errorf("%w: lap %d is still open", ErrInvalidLapCorrection, lap.ID)
+	}
+	if lap.VoidedAt != nil {
+		return fmt.Errorf("%w: lap %d is voided", ErrInvalidLapCorrection, lap.ID)
+	}
+	return nil
+}
+
+// correctLaps works out the laps after a correction, laps are the laps involved in the order CorrectLap lists them
+func correctLaps(laps []models.BusLapHistory, req dto.LapCorrectionRequest, now time.Time, lapsBetween dto.LapsBetweenFunc) (dto.LapCorrectionChange, error) {
+	lap := laps[0]
+	switch req.Action {
+	case models.LAP_CORRECTION_VOID:
+		lap.VoidedAt = &now
+		return dto.LapCorrectionChange{After: []models.BusLapHistory{lap}}, nil
+
+	case models.LAP_CORRECTION_ROUTE_COLOR:
+		if *req.RouteColor == lap.RouteColor {
+			return dto.LapCorrectionChange{}, fmt.Errorf("%w: lap %d already has route color %s", ErrInvalidLapCorrection, lap.ID, lap.RouteColor)
+		}
+		lap.RouteColor = *req.RouteColor
+		return dto.LapCorrectionChange{After: []models.BusLapHistory{lap}}, nil
+
+	case models.LAP_CORRECTION_TIMES:
+		corrected, err := correctLapTimes(lap, req, now)
+		return dto.LapCorrectionChange{After: []models.BusLapHistory{corrected}}, err
+
+	case models.LAP_CORRECTION_SPLIT:
+		first, second, err := splitLap(lap, *req.SplitAtSequence)
+		return dto.LapCorrectionChange{After: []models.BusLapHistory{first, second}}, err
+
+	case models.LAP_CORRECTION_MERGE:
+		other := laps[1]
+		merged, voided, err := mergeLaps(lap, other, now)
+		if err != nil {
+			return dto.LapCorrectionChange{}, err
+		}
+		earlier, later := startOrder(lap, other)
+		between, err := lapsBetween(earlier, later)
+		if err != nil {
+			return dto.LapCorrectionChange{}, err
+		}
+		if between > 0 {
+			return dto.LapCorrectionChange{}, fmt.Errorf("%w: laps %d and %d are not adjacent", ErrInvalidLapCorrection, earlier.ID, later.ID)
+		}
+		return dto.LapCorrectionChange{After: []models.BusLapHistory{merged, voided}, RelatedLapID: &other.ID}, nil
+	}
+	return dto.LapCorrectionChange{}, fmt.Errorf("%w: unknown action %s", ErrInvalidLapCorrection, req.Action)
+}
+
+// correctLapTimes moves the start and/or end of a lap, the lap has to stay on its service date
+func correctLapTimes(lap models.BusLapHistory, req dto.LapCorrectionRequest, now time.Time) (models.BusLapHistory, error) {
+	startTime, endTime := lap.StartTime, *lap.EndTime
+	if req.StartTime != nil {
+		startTime = *req.StartTime
+	}
+	if req.EndTime != nil {
+		endTime = *req.EndTime
+	}
+	if !startTime.Before(endTime) {
+		return lap, fmt.Errorf("%w: start time must be before end time", ErrInvalidLapCorrection)
+	}
+	if endTime.After(now) {
+		return lap, fmt.Errorf("%w: end time is in the future", ErrInvalidLapCorrection)
+	}
+	if startTime.In(Jakarta).Format("2006-01-02") != lap.ServiceDate {
+		return lap, fmt.Errorf("%w: start time must stay on service date %s", ErrInvalidLapCorrection, lap.ServiceDate)
+	}
+	lap.StartTime = startTime
+	lap.EndTime = &endTime
+	return lap, nil
+}
+
+// splitLap ends lap when it reached the visit with sequence atSequence and moves that visit and every later one
+// to a new lap of the same bus. The new lap starts when the bus left that stop and inherits how lap was closed,
+// the first part is closed as completed.
+func splitLap(lap models.BusLapHistory, atSequence int) (first models.BusLapHistory, second models.BusLapHistory, err error) {
+	at := slices.IndexFunc(lap.HalteVisits, func(visit models.LapHalteVisit) bool {
+		return visit.Sequence == atSequence
+	})
+	if at <= 0 {
+		return lap, lap, fmt.Errorf("%w: lap %d has no halte visit with sequence %d after its first stop", ErrInvalidLapCorrection, lap.ID, atSequence)
+	}
+	splitVisit := lap.HalteVisits[at]
+	newStart := splitVisit.ArrivedAt
+	if splitVisit.DepartedAt != nil && splitVisit.DepartedAt.Before(*lap.EndTime) {
+		newStart = *splitVisit.DepartedAt
+	}
+
+	moved := make([]models.LapHalteVisit, 0, len(lap.HalteVisits)-at)
+	for i, visit := range lap.HalteVisits[at:] {
+		visit.Sequence = i + 1
+		moved = append(moved, visit)
+	}
+	second = models.BusLapHistory{
+		BusID:             lap.BusID,
+		IMEI:              lap.IMEI,
+		StartTime:         newStart,
+		EndTime:           lap.EndTime,
+		RouteColor:        lap.RouteColor,
+		Driver:            lap.Driver,
+		ClosureReason:     lap.ClosureReason,
+		HalteVisitHistory: formatHalteVisitHistory(moved),
+		HalteVisits:       moved,
+	}
+
+	first = lap
+	endTime := splitVisit.ArrivedAt
+	first.EndTime = &endTime
+	first.ClosureReason = models.LAP_CLOSURE_COMPLETED
+	first.HalteVisits = lap.HalteVisits[:at]
+	first.HalteVisitHistory = formatHalteVisitHistory(first.HalteVisits)
+	return first, second, nil
+}
+
+// startOrder returns two laps in the order they started, the lap created first goes first on a tie
+func startOrder(a models.BusLapHistory, b models.BusLapHistory) (earlier models.BusLapHistory, later models.BusLapHistory) {
+	if b.StartTime.Before(a.StartTime) || (b.StartTime.Equal(a.StartTime) && b.ID < a.ID) {
+		return b, a
+	}
+	return a, b
+}
+
+// mergeLaps joins lap with another lap of the same bus, correctLaps checks that no lap started between them.
+// The earlier lap is kept and runs until the later one ended, the later one is voided at now and its visits are
+// appended. A stop shared by the end of the earlier lap and the start of the later one is kept once.
+// Both laps are returned in the order they were given.
+func mergeLaps(lap models.BusLapHistory, other models.BusLapHistory, now time.Time) (models.BusLapHistory, models.BusLapHistory, error) {
+	if other.BusID != lap.BusID {
+		return lap, other, fmt.Errorf("%w: lap %d belongs to another bus", ErrInvalidLapCorrection, other.ID)
+	}
+
+	earlier, later := startOrder(lap, other)
+	visits := slices.Clone(earlier.HalteVisits)
+	appended := later.HalteVisits
+	lastSequence := 0
+	if n := len(visits); n > 0 {
+		lastSequence = visits[n-1].Sequence
+		if len(appended) > 0 && appended[0].Halte == visits[n-1].Halte {
+			// The later lap started where the earlier one ended, keep the stop once with the later departure
+			visits[n-1].DepartedAt = appended[0].DepartedAt
+			appended = appended[1:]
+		}
+	}
+	for i, visit := range appended {
+		visit.Sequence = lastSequence + i + 1
+		visits = append(visits, visit)
+	}
+
+	earlier.EndTime = later.EndTime
+	earlier.ClosureReason = later.ClosureReason
+	earlier.HalteVisits = visits
+	earlier.HalteVisitHistory = formatHalteVisitHistory(visits)
+	later.VoidedAt = &now
+	later.HalteVisits = make([]models.LapHalteVisit, 0)
+
+	if earlier.ID == lap.ID {
+		return earlier, later, nil
+	}
+	return later, earlier, nil
+}
+
+// formatHalteVisitHistory rebuilds the legacy halte_visit_history string of a list of visits
+func formatHalteVisitHistory(visits []models.LapHalteVisit) string {
+	parts := make([]string, 0, len(visits))
+	for _, visit := range visits {
+		parts = append(parts, FormatHalteVisit(visit))
+	}
+	return strings.Join(parts, " -> ")
+}
@@ -0,0 +1,161 @@
+package bus
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/FreeJ1nG/bikuntracker-backend/app/dto"
+	"github.com/FreeJ1nG/bikuntracker-backend/app/models"
+)
+
+func TestValidateLapCorrection(t *testing.T) {
+	color, sequence := "red", 3
+	tests := []struct {
+		name    string
+		req     dto.LapCorrectionRequest
+		wantErr bool
+	}{
+		{"void", dto.LapCorrectionRequest{Action: "void", CorrectedBy: "ops", Reason: "test lap"}, false},
+		{"unknown action", dto.LapCorrectionRequest{Action: "delete", CorrectedBy: "ops", Reason: "test lap"}, true},
+		{"missing corrected_by", dto.LapCorrectionRequest{Action: "void", Reason: "test lap"}, true},
+		{"corrected_by too long", dto.LapCorrectionRequest{Action: "void", CorrectedBy: strings.Repeat("a", maxCorrectedByLength+1), Reason: "test lap"}, true},
+		{"corrected_by at the limit", dto.LapCorrectionRequest{Action: "void", CorrectedBy: strings.Repeat("é", maxCorrectedByLength), Reason: "test lap"}, false},
+		{"corrected_by with a newline", dto.LapCorrectionRequest{Action: "void", CorrectedBy: "ops\nadmin", Reason: "test lap"}, true},
+		{"missing reason", dto.LapCorrectionRequest{Action: "void", CorrectedBy: "ops"}, true},
+		{"route color", dto.LapCorrectionRequest{Action: "route_color", CorrectedBy: "ops", Reason: "wrong color", RouteColor: &color}, false},
+		{"route color without color", dto.LapCorrectionRequest{Action: "route_color", CorrectedBy: "ops", Reason: "wrong color"}, true},
+		{"times without times", dto.LapCorrectionRequest{Action: "times", CorrectedBy: "ops", Reason: "late start"}, true},
+		{"split", dto.LapCorrectionRequest{Action: "split", CorrectedBy: "ops", Reason: "missed end", SplitAtSequence: &sequence}, false},
+		{"split without sequence", dto.LapCorrectionRequest{Action: "split", CorrectedBy: "ops", Reason: "missed end"}, true},
+		{"merge without lap", dto.LapCorrectionRequest{Action: "merge", CorrectedBy: "ops", Reason: "false end"}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := validateLapCorrection(tt.req); (err != nil) != tt.wantErr {
+				t.Errorf("got error %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+// testLap is a closed lap of bus 1 visiting stops one minute apart from start
+func testLap(id int, lapNumber int, start time.Time, stops ...string) models.BusLapHistory {
+	visits := make([]models.LapHalteVisit, len(stops))
+	for i, stop := range stops {
+		arrived := start.Add(time.Duration(i) * time.Minute)
+		departed := arrived.Add(30 * time.Second)
+		visits[i] = models.LapHalteVisit{Sequence: i + 1, Halte: stop, ArrivedAt: arrived, DepartedAt: &departed}
+	}
+	end := start.Add(time.Duration(len(stops)-1) * time.Minute)
+	return models.BusLapHistory{
+		ID:            id,
+		BusID:         1,
+		LapNumber:     lapNumber,
+		StartTime:     start,
+		EndTime:       &end,
+		RouteColor:    "blue",
+		ClosureReason: models.LAP_CLOSURE_INACTIVITY,
+		HalteVisits:   visits,
+	}
+}
+
+func TestSplitLap(t *testing.T) {
+	start := time.Date(2024, 1, 1, 7, 0, 0, 0, Jakarta)
+	lap := testLap(10, 4, start, "Asrama UI", "Menwa", "Stasiun UI", "Menwa", "Asrama UI")
+
+	first, second, err := splitLap(lap, 3)
+	if err != nil {
+		t.Fatalf("splitLap: %v", err)
+	}
+	if len(first.HalteVisits) != 2 || !first.EndTime.Equal(lap.HalteVisits[2].ArrivedAt) || first.ClosureReason != models.LAP_CLOSURE_COMPLETED {
+		t.Errorf("first part %+v, want two visits ending completed at Stasiun UI", first)
+	}
+	if second.ID != 0 || len(second.HalteVisits) != 3 || second.HalteVisits[0].Sequence != 1 || second.HalteVisits[0].Halte != "Stasiun UI" {
+		t.Errorf("new lap %+v, want a new lap from Stasiun UI with three visits", second)
+	}
+	if !second.StartTime.Equal(*lap.HalteVisits[2].DepartedAt) || second.ClosureReason != lap.ClosureReason {
+		t.Errorf("new lap starts at %s closed as %s, want %s closed as %s", second.StartTime, second.ClosureReason, *lap.HalteVisits[2].DepartedAt, lap.ClosureReason)
+	}
+	if lap.HalteVisits[2].Sequence != 3 {
+		t.Error("splitLap modified the visits of the lap it was given")
+	}
+
+	for _, sequence := range []int{1, 9} {
+		if _, _, err := splitLap(lap, sequence); !errors.Is(err, ErrInvalidLapCorrection) {
+			t.Errorf("split at %d got %v, want %v", sequence, err, ErrInvalidLapCorrection)
+		}
+	}
+}
+
+func TestMergeLaps(t *testing.T) {
+	start := time.Date(2024, 1, 1, 7, 0, 0, 0, Jakarta)
+	now := start.Add(time.Hour)
+	earlier := testLap(10, 4, start, "Asrama UI", "Menwa", "Stasiun UI")
+	later := testLap(11, 5, start.Add(2*time.Minute), "Stasiun UI", "Menwa", "Asrama UI")
+
+	// Merging the later lap into the earlier one keeps the earlier lap whichever of them is corrected
+	for _, order := range [][2]models.BusLapHistory{{earlier, later}, {later, earlier}} {
+		a, b, err := mergeLaps(order[0], order[1], now)
+		if err != nil {
+			t.Fatalf("mergeLaps: %v", err)
+		}
+		merged, voided := a, b
+		if a.ID != earlier.ID {
+			merged, voided = b, a
+		}
+		if a.ID != order[0].ID {
+			t.Errorf("got lap %d first, want the corrected lap %d", a.ID, order[0].ID)
+		}
+		if merged.VoidedAt != nil || voided.VoidedAt == nil || !voided.VoidedAt.Equal(now) {
+			t.Errorf("want lap %d kept and lap %d voided", earlier.ID, later.ID)
+		}
+		// Stasiun UI ends the earlier lap and starts the later one, it is kept once
+		if got := formatHalteVisitHistory(merged.HalteVisits); len(merged.HalteVisits) != 5 || merged.HalteVisits[4].Sequence != 5 {
+			t.Errorf("merged visits %s, want five visits", got)
+		}
+		if !merged.EndTime.Equal(*later.EndTime) || !merged.HalteVisits[2].DepartedAt.Equal(*later.HalteVisits[0].DepartedAt) {
+			t.Errorf("merged lap ends at %s, want %s with the later departure from Stasiun UI", merged.EndTime, later.EndTime)
+		}
+	}
+
+	otherBus := later
+	otherBus.BusID = 2
+	if _, _, err := mergeLaps(earlier, otherBus, now); !errors.Is(err, ErrInvalidLapCorrection) {
+		t.Errorf("merging laps of two buses got %v, want %v", err, ErrInvalidLapCorrection)
+	}
+}
+
+func TestCorrectLapsMergeAdjacency(t *testing.T) {
+	start := time.Date(2024, 1, 1, 7, 0, 0, 0, Jakarta)
+	// Lap numbers are left alone by corrections, adjacent laps may have numbers far apart
+	earlier := testLap(10, 4, start, "Asrama UI", "Menwa", "Stasiun UI")
+	later := testLap(11, 7, start.Add(2*time.Minute), "Stasiun UI", "Menwa", "Asrama UI")
+	other := later.ID
+	req := dto.LapCorrectionRequest{Action: "merge", CorrectedBy: "ops", Reason: "false end", MergeWithLapID: &other}
+
+	for _, between := range []int{0, 1} {
+		var got [2]int
+		lapsBetween := func(a models.BusLapHistory, b models.BusLapHistory) (int, error) {
+			got = [2]int{a.ID, b.ID}
+			return between, nil
+		}
+		change, err := correctLaps([]models.BusLapHistory{later, earlier}, req, start.Add(time.Hour), lapsBetween)
+		if got != [2]int{earlier.ID, later.ID} {
+			t.Errorf("counted the laps between %v, want between %d and %d in start order", got, earlier.ID, later.ID)
+		}
+		if between > 0 {
+			if !errors.Is(err, ErrInvalidLapCorrection) {
+				t.Errorf("merging laps with %d lap between got %v, want %v", between, err, ErrInvalidLapCorrection)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("correctLaps: %v", err)
+		}
+		if len(change.After) != 2 || change.After[0].VoidedAt == nil || change.After[1].LapNumber != earlier.LapNumber {
+			t.Errorf("got %+v, want lap %d voided and lap %d kept with its number", change.After, later.ID, earlier.ID)
+		}
+	}
+}
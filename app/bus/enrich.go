@@ -0,0 +1,162 @@
+package bus
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/FreeJ1nG/bikuntracker-backend/app/models"
+	"github.com/FreeJ1nG/bikuntracker-backend/app/route"
+)
+
+// Unknown imeis trigger a metadata reload, but not more often than this
+const busMetadataReloadInterval = 30 * time.Second
+
+// loadBusMetadata refreshes the cached bus rows used to enrich incoming fixes
+func (c *container) loadBusMetadata(ctx context.Context) error {
+	buses, err := c.busService.GetAllBuses(ctx)
+	if err != nil {
+		return err
+	}
+	c.state.SetBusMetadata(buses)
+	c.metadataLoadedAt = time.Now()
+	return nil
+}
+
+// RefreshBusMetadata reloads the cached bus rows, call it whenever a bus is created, updated or deleted
+func (c *container) RefreshBusMetadata(ctx context.Context) {
+	c.ingestMu.Lock()
+	defer c.ingestMu.Unlock()
+	if err := c.loadBusMetadata(ctx); err != nil {
+		log.Printf("Failed to refresh bus metadata: %v", err)
+	}
+}
+
+// enrichCoordinates derives halte, next halte and bus metadata for normalized fixes.
+// Callers must hold ingestMu.
+func (c *container) enrichCoordinates(ctx context.Context, coords map[string]*models.BusCoordinate) {
+	for imei, coord := range coords {
+		// A fresh fix always brings the bus back online, the status monitor degrades it again when it goes silent
+		coord.Status = models.BUS_STATUS_ONLINE
+
+		meta, ok := c.state.BusMetadata(imei)
+		if !ok && time.Since(c.metadataLoadedAt) > busMetadataReloadInterval {
+			if err := c.loadBusMetadata(ctx); err != nil {
+				log.Printf("Failed to reload bus metadata: %v", err)
+			}
+			meta, ok = c.state.BusMetadata(imei)
+		}
+		if ok {
+			coord.Color = meta.Color
+			coord.Id = meta.Id
+			coord.BusNumber = meta.BusNumber
+		}
+
+		// Fixes carry the hull number reported by the vendor, persist it whenever it changes
+		if coord.PlateNumber != "" && coord.PlateNumber != c.state.CurrentPlate(imei) {
+			c.state.SetCurrentPlate(imei, coord.PlateNumber)
+			plateNumber := coord.PlateNumber
+			c.persist(func(ctx context.Context) {
+				if _, err := c.busService.UpdateBusPlateNumberByImei(ctx, imei, plateNumber); err != nil {
+					log.Printf("Failed to update plate number for bus %s: %v", imei, err)
+					return
+				}
+				log.Printf("Updated plate number for bus %s: %s", imei, plateNumber)
+			})
+		}
+		if coord.PlateNumber == "" {
+			coord.PlateNumber = c.state.CurrentPlate(imei)
+		}
+
+		// Fixes without a driver keep the last reported one, another driver is recorded as a driver change
+		if previousDriver := c.state.CurrentDriver(imei); coord.Driver != "" && coord.Driver != previousDriver {
+			c.state.SetCurrentDriver(imei, coord.Driver)
+			log.Printf("Driver of bus %s changed from %q to %q", imei, previousDriver, coord.Driver)
+			driver, changedAt := coord.Driver, coord.GpsTime
+			c.persist(func(ctx context.Context) {
+				if err := c.busService.RecordDriverChange(ctx, imei, previousDriver, driver, changedAt); err != nil {
+					log.Printf("Failed to record driver change for bus %s: %v", imei, err)
+				}
+			})
+		}
+		if coord.Driver == "" {
+			coord.Driver = c.state.CurrentDriver(imei)
+		}
+
+		// Route detection falls back to the route of the known bus color, so metadata comes first
+		c.enrichHalte(coord)
+	}
+}
+
+func (c *container) enrichHalte(coord *models.BusCoordinate) {
+	name := c.updateStopVisit(coord)
+	previousHalte := c.state.PreviousHalte(coord.Imei)
+	sequence := c.state.StopSequence(coord.Imei)
+
+	coord.AtHalte = name
+	coord.CurrentHalte = ""
+	coord.NextHalte = ""
+	coord.RouteVariant = ""
+	coord.RouteConfidence = 0
+	coord.RouteProgress = nil
+	if name != "" {
+		coord.CurrentHalte = name
+		coord.StatusMessage = "Arriving at " + name
+	} else if previousHalte != "" {
+		coord.CurrentHalte = previousHalte
+		coord.StatusMessage = "Depart from " + previousHalte
+	}
+
+	detection := c.detectRoute(sequence)
+	r, hasRoute := detection.route, detection.color != "grey"
+	if !hasRoute {
+		// Keep following the last detected variant of the bus color while the recent stops are ambiguous
+		if stored, ok := c.state.Coordinate(coord.Imei); ok {
+			coord.RouteVariant = stored.RouteVariant
+		}
+		r, hasRoute = c.routeCatalog.Route(route.CoordinateRoute(*coord))
+	}
+	if !hasRoute {
+		coord.RouteVariant = ""
+		return
+	}
+	coord.RouteVariant = r.Variant
+	coord.RouteConfidence = detection.confidence
+	if coord.CurrentHalte == "" {
+		return
+	}
+	if i := stopIndex(r, sequence, coord.CurrentHalte); i >= 0 {
+		coord.NextHalte = r.Stops[(i+1)%len(r.Stops)]
+		if progress, ok := c.routeCatalog.Progress(r.Name, i, coord.Latitude, coord.Longitude); ok {
+			coord.RouteProgress = &progress
+		}
+	}
+}
+
+// stopIndex locates the current stop on a route. Routes pass some stops twice, such as Stasiun UI on the way out
+// and back, so the occurrence preceded by the stop the bus came from wins over the first one.
+func stopIndex(route models.Route, sequence []string, current string) int {
+	previous := ""
+	for j := len(sequence) - 1; j >= 0; j-- {
+		if sequence[j] != current {
+			previous = sequence[j]
+			break
+		}
+	}
+	n := len(route.Stops)
+	first := -1
+	for i, stop := range route.Stops {
+		if stop != current {
+			continue
+		}
+		if first < 0 {
+			first = i
+		}
+		for steps := 1; steps <= 2; steps++ {
+			if previous != "" && route.Stops[(i-steps+n)%n] == previous {
+				return i
+			}
+		}
+	}
+	return first
+}
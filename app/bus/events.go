@@ -0,0 +1,35 @@
+package bus
+
+import (
+	"time"
+
+	"github.com/FreeJ1nG/bikuntracker-backend/app/dto"
+)
+
+// SetClock replaces the clock used by the pipeline, replays use it to run on the recorded time
+func (c *container) SetClock(now func() time.Time) {
+	c.clock = now
+}
+
+func (c *container) now() time.Time {
+	if c.clock != nil {
+		return c.clock()
+	}
+	return time.Now()
+}
+
+// OnEvent registers a listener notified of stop arrivals and departures, halte switches, color changes and lap transitions.
+// Listeners run synchronously inside the ingestion pipeline and must not block.
+func (c *container) OnEvent(listener func(event dto.BusEvent)) {
+	c.listenersMu.Lock()
+	defer c.listenersMu.Unlock()
+	c.listeners = append(c.listeners, listener)
+}
+
+func (c *container) emitEvent(event dto.BusEvent) {
+	c.listenersMu.RLock()
+	defer c.listenersMu.RUnlock()
+	for _, listener := range c.listeners {
+		listener(event)
+	}
+}
@@ -0,0 +1,371 @@
+package bus
+
+import (
+	"archive/zip"
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/FreeJ1nG/bikuntracker-backend/app/interfaces"
+	"github.com/FreeJ1nG/bikuntracker-backend/app/models"
+)
+
+// Lap history export formats and row granularities
+const (
+	LAP_EXPORT_FORMAT_CSV     = "csv"
+	LAP_EXPORT_FORMAT_XLSX    = "xlsx"
+	LAP_EXPORT_FORMAT_GEOJSON = "geojson"
+
+	LAP_EXPORT_ROWS_LAP   = "lap"
+	LAP_EXPORT_ROWS_VISIT = "visit"
+)
+
+var (
+	lapExportFormats = []string{LAP_EXPORT_FORMAT_CSV, LAP_EXPORT_FORMAT_XLSX, LAP_EXPORT_FORMAT_GEOJSON}
+	lapExportRows    = []string{LAP_EXPORT_ROWS_LAP, LAP_EXPORT_ROWS_VISIT}
+
+	lapExportContentTypes = map[string]string{
+		LAP_EXPORT_FORMAT_CSV:     "text/csv; charset=utf-8",
+		LAP_EXPORT_FORMAT_XLSX:    "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet",
+		LAP_EXPORT_FORMAT_GEOJSON: "application/geo+json",
+	}
+)
+
+var (
+	lapExportLapColumns = []string{
+		"lap_id", "bus_id", "imei", "bus_number", "plate_number", "vehicle_no", "route_color", "driver",
+		"service_date", "lap_number", "daily_lap_number", "start_time", "end_time", "duration_seconds",
+		"closure_reason", "anomalies", "stop_count", "stops",
+	}
+	lapExportVisitColumns = []string{
+		"lap_id", "bus_id", "imei", "bus_number", "plate_number", "route_color",
+		"service_date", "lap_number", "daily_lap_number", "sequence", "halte", "arrived_at", "departed_at", "dwell_seconds",
+	}
+)
+
+// exportTime renders a time in Jakarta, the zone the operations team invoices in
+func exportTime(t *time.Time) any {
+	if t == nil {
+		return nil
+	}
+	return t.In(Jakarta).Format("2006-01-02 15:04:05")
+}
+
+// exportSeconds is the whole number of seconds between from and to, nil when to is unknown
+func exportSeconds(from time.Time, to *time.Time) any {
+	if to == nil {
+		return nil
+	}
+	return int(to.Sub(from).Seconds())
+}
+
+// lapExportRow is the per lap row matching lapExportLapColumns
+func lapExportRow(lap models.BusLapHistory) []any {
+	stops := make([]string, 0, len(lap.HalteVisits))
+	for _, visit := range lap.HalteVisits {
+		stops = append(stops, visit.Halte)
+	}
+	return []any{
+		lap.ID, lap.BusID, lap.IMEI, lap.BusNumber, lap.PlateNumber, lap.VehicleNo, lap.RouteColor, lap.Driver,
+		lap.ServiceDate, lap.LapNumber, lap.DailyLapNumber, exportTime(&lap.StartTime), exportTime(lap.EndTime),
+		exportSeconds(lap.StartTime, lap.EndTime), lap.ClosureReason, strings.Join(lap.Anomalies, ","),
+		len(lap.HalteVisits), strings.Join(stops, " -> "),
+	}
+}
+
+// visitExportRows are the per visit rows of a lap matching lapExportVisitColumns
+func visitExportRows(lap models.BusLapHistory) [][]any {
+	rows := make([][]any, 0, len(lap.HalteVisits))
+	for _, visit := range lap.HalteVisits {
+		rows = append(rows, []any{
+			lap.ID, lap.BusID, lap.IMEI, lap.BusNumber, lap.PlateNumber, lap.RouteColor,
+			lap.ServiceDate, lap.LapNumber, lap.DailyLapNumber, visit.Sequence, visit.Halte,
+			exportTime(&visit.ArrivedAt), exportTime(visit.DepartedAt), exportSeconds(visit.ArrivedAt, visit.DepartedAt),
+		})
+	}
+	return rows
+}
+
+// lapExportWriter writes the laps of an export one at a time, Close completes the document
+type lapExportWriter interface {
+	WriteLap(lap models.BusLapHistory) error
+	Close() error
+}
+
+// newLapExportWriter writes the header of an export to w, format and rows must already be validated
+func newLapExportWriter(w io.Writer, format string, rows string, catalog interfaces.HalteCatalog) (lapExportWriter, error) {
+	if format == LAP_EXPORT_FORMAT_GEOJSON {
+		return newGeoJSONLapWriter(w, catalog)
+	}
+
+	columns := lapExportLapColumns
+	if rows == LAP_EXPORT_ROWS_VISIT {
+		columns = lapExportVisitColumns
+	}
+	var table tableWriter
+	var err error
+	if format == LAP_EXPORT_FORMAT_XLSX {
+		table, err = newXLSXTableWriter(w, "Laps")
+	} else {
+		table = newCSVTableWriter(w)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	header := make([]any, len(columns))
+	for i, column := range columns {
+		header[i] = column
+	}
+	if err := table.WriteRow(header); err != nil {
+		return nil, err
+	}
+	return &tableLapWriter{table: table, perVisit: rows == LAP_EXPORT_ROWS_VISIT}, nil
+}
+
+// tableLapWriter writes one row per lap, or one row per halte visit when perVisit is set
+type tableLapWriter struct {
+	table    tableWriter
+	perVisit bool
+}
+
+func (t *tableLapWriter) WriteLap(lap models.BusLapHistory) error {
+	if !t.perVisit {
+		return t.table.WriteRow(lapExportRow(lap))
+	}
+	for _, row := range visitExportRows(lap) {
+		if err := t.table.WriteRow(row); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (t *tableLapWriter) Close() error {
+	return t.table.Close()
+}
+
+// tableWriter writes rows of string, int, float64 or nil (empty) cells
+type tableWriter interface {
+	WriteRow(cells []any) error
+	Close() error
+}
+
+type csvTableWriter struct {
+	w *csv.Writer
+}
+
+func newCSVTableWriter(w io.Writer) *csvTableWriter {
+	return &csvTableWriter{w: csv.NewWriter(w)}
+}
+
+func (c *csvTableWriter) WriteRow(cells []any) error {
+	record := make([]string, len(cells))
+	for i, cell := range cells {
+		if cell != nil {
+			record[i] = fmt.Sprint(cell)
+		}
+	}
+	return c.w.Write(record)
+}
+
+func (c *csvTableWriter) Close() error {
+	c.w.Flush()
+	return c.w.Error()
+}
+
+const (
+	xlsxContentTypes = `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Types xmlns="http://schemas.openxmlformats.org/package/2006/content-types"><Default Extension="rels" ContentType="application/vnd.openxmlformats-package.relationships+xml"/><Default Extension="xml" ContentType="application/xml"/><Override PartName="/xl/workbook.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.sheet.main+xml"/><Override PartName="/xl/worksheets/sheet1.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.worksheet+xml"/></Types>`
+	xlsxRootRels = `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships"><Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/officeDocument" Target="xl/workbook.xml"/></Relationships>`
+	xlsxWorkbook = `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<workbook xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main" xmlns:r="http://schemas.openxmlformats.org/officeDocument/2006/relationships"><sheets><sheet name="%s" sheetId="1" r:id="rId1"/></sheets></workbook>`
+	xlsxWorkbookRels = `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships"><Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/worksheet" Target="worksheets/sheet1.xml"/></Relationships>`
+	xlsxSheetStart = `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<worksheet xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main"><sheetData>`
+	xlsxSheetEnd = `</sheetData></worksheet>`
+)
+
+// xlsxTableWriter streams a single sheet workbook, the zip entries are written as they are produced so
+// rows never have to be buffered. Strings are stored inline so no shared string table is needed.
+type xlsxTableWriter struct {
+	zip   *zip.Writer
+	sheet *bufio.Writer
+	rows  int
+}
+
+func newXLSXTableWriter(w io.Writer, sheetName string) (*xlsxTableWriter, error) {
+	zw := zip.NewWriter(w)
+	var escapedName strings.Builder
+	if err := xml.EscapeText(&escapedName, []byte(sheetName)); err != nil {
+		return nil, err
+	}
+	parts := []struct{ name, content string }{
+		{"[Content_Types].xml", xlsxContentTypes},
+		{"_rels/.rels", xlsxRootRels},
+		{"xl/workbook.xml", fmt.Sprintf(xlsxWorkbook, escapedName.String())},
+		{"xl/_rels/workbook.xml.rels", xlsxWorkbookRels},
+	}
+	for _, part := range parts {
+		f, err := zw.Create(part.name)
+		if err != nil {
+			return nil, fmt.Errorf("unable to create %s: %w", part.name, err)
+		}
+		if _, err := io.WriteString(f, part.content); err != nil {
+			return nil, fmt.Errorf("unable to write %s: %w", part.name, err)
+		}
+	}
+
+	// The sheet must be the last entry, it stays open until Close
+	f, err := zw.Create("xl/worksheets/sheet1.xml")
+	if err != nil {
+		return nil, fmt.Errorf("unable to create sheet: %w", err)
+	}
+	sheet := bufio.NewWriter(f)
+	if _, err := sheet.WriteString(xlsxSheetStart); err != nil {
+		return nil, err
+	}
+	return &xlsxTableWriter{zip: zw, sheet: sheet}, nil
+}
+
+func (x *xlsxTableWriter) WriteRow(cells []any) error {
+	x.rows++
+	fmt.Fprintf(x.sheet, `<row r="%d">`, x.rows)
+	for _, cell := range cells {
+		switch v := cell.(type) {
+		case nil:
+			x.sheet.WriteString(`<c/>`)
+		case int:
+			fmt.Fprintf(x.sheet, `<c><v>%d</v></c>`, v)
+		case float64:
+			fmt.Fprintf(x.sheet, `<c><v>%s</v></c>`, strconv.FormatFloat(v, 'f', -1, 64))
+		default:
+			x.sheet.WriteString(`<c t="inlineStr"><is><t xml:space="preserve">`)
+			if err := xml.EscapeText(x.sheet, []byte(fmt.Sprint(v))); err != nil {
+				return err
+			}
+			x.sheet.WriteString(`</t></is></c>`)
+		}
+	}
+	_, err := x.sheet.WriteString(`</row>`)
+	return err
+}
+
+func (x *xlsxTableWriter) Close() error {
+	if _, err := x.sheet.WriteString(xlsxSheetEnd); err != nil {
+		return err
+	}
+	if err := x.sheet.Flush(); err != nil {
+		return err
+	}
+	return x.zip.Close()
+}
+
+// geoJSONLapWriter streams a FeatureCollection with one feature per lap. The geometry follows the visited stops
+// in order and the properties carry the lap with its full stop sequence.
+type geoJSONLapWriter struct {
+	w       io.Writer
+	enc     *json.Encoder
+	catalog interfaces.HalteCatalog
+	written int
+}
+
+type geoJSONGeometry struct {
+	Type        string `json:"type"`
+	Coordinates any    `json:"coordinates"`
+}
+
+type geoJSONLapProperties struct {
+	ID              int                    `json:"id"`
+	BusID           int                    `json:"bus_id"`
+	IMEI            string                 `json:"imei"`
+	BusNumber       string                 `json:"bus_number"`
+	RouteColor      string                 `json:"route_color"`
+	Driver          string                 `json:"driver,omitempty"`
+	ServiceDate     string                 `json:"service_date"`
+	LapNumber       int                    `json:"lap_number"`
+	DailyLapNumber  int                    `json:"daily_lap_number"`
+	StartTime       time.Time              `json:"start_time"`
+	EndTime         *time.Time             `json:"end_time"`
+	DurationSeconds any                    `json:"duration_seconds"`
+	ClosureReason   string                 `json:"closure_reason"`
+	Anomalies       []string               `json:"anomalies"`
+	Stops           []models.LapHalteVisit `json:"stops"`
+}
+
+type geoJSONLapFeature struct {
+	Type       string               `json:"type"`
+	Geometry   *geoJSONGeometry     `json:"geometry"`
+	Properties geoJSONLapProperties `json:"properties"`
+}
+
+func newGeoJSONLapWriter(w io.Writer, catalog interfaces.HalteCatalog) (*geoJSONLapWriter, error) {
+	if _, err := io.WriteString(w, `{"type":"FeatureCollection","features":[`); err != nil {
+		return nil, err
+	}
+	return &geoJSONLapWriter{w: w, enc: json.NewEncoder(w), catalog: catalog}, nil
+}
+
+// lapGeometry is a LineString through the known stops of a lap, a Point when only one is known
+// and nil when none are
+func (g *geoJSONLapWriter) lapGeometry(lap models.BusLapHistory) *geoJSONGeometry {
+	coordinates := make([][2]float64, 0, len(lap.HalteVisits))
+	for _, visit := range lap.HalteVisits {
+		halte, ok := g.catalog.Halte(visit.Halte)
+		if !ok {
+			continue
+		}
+		coordinates = append(coordinates, [2]float64{halte.Longitude, halte.Latitude})
+	}
+	switch len(coordinates) {
+	case 0:
+		return nil
+	case 1:
+		return &geoJSONGeometry{Type: "Point", Coordinates: coordinates[0]}
+	default:
+		return &geoJSONGeometry{Type: "LineString", Coordinates: coordinates}
+	}
+}
+
+func (g *geoJSONLapWriter) WriteLap(lap models.BusLapHistory) error {
+	if g.written > 0 {
+		if _, err := io.WriteString(g.w, ","); err != nil {
+			return err
+		}
+	}
+	g.written++
+	return g.enc.Encode(geoJSONLapFeature{
+		Type:     "Feature",
+		Geometry: g.lapGeometry(lap),
+		Properties: geoJSONLapProperties{
+			ID:              lap.ID,
+			BusID:           lap.BusID,
+			IMEI:            lap.IMEI,
+			BusNumber:       lap.BusNumber,
+			RouteColor:      lap.RouteColor,
+			Driver:          lap.Driver,
+			ServiceDate:     lap.ServiceDate,
+			LapNumber:       lap.LapNumber,
+			DailyLapNumber:  lap.DailyLapNumber,
+			StartTime:       lap.StartTime,
+			EndTime:         lap.EndTime,
+			DurationSeconds: exportSeconds(lap.StartTime, lap.EndTime),
+			ClosureReason:   lap.ClosureReason,
+			Anomalies:       lap.Anomalies,
+			Stops:           lap.HalteVisits,
+		},
+	})
+}
+
+func (g *geoJSONLapWriter) Close() error {
+	_, err := io.WriteString(g.w, "]}\n")
+	return err
+}
@@ -0,0 +1,120 @@
+package bus
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/FreeJ1nG/bikuntracker-backend/app/models"
+	"github.com/FreeJ1nG/bikuntracker-backend/utils"
+)
+
+const (
+	// Fixes closer than this to the previous one are GPS jitter and never fail the speed check
+	minSpeedCheckDistanceMeters = 50
+	defaultMaxFixSpeedKmh       = 100
+)
+
+var (
+	ErrZeroFix         = errors.New("fix has no position (0,0)")
+	ErrOutsideArea     = errors.New("fix is outside the campus area")
+	ErrImpossibleSpeed = errors.New("fix implies an impossible speed since the previous fix")
+)
+
+// defaultCampusPolygon surrounds every halte and the parking lot of the UI Depok campus with some margin
+var defaultCampusPolygon = []geoPoint{
+	{-6.3440, 106.8180},
+	{-6.3440, 106.8370},
+	{-6.3770, 106.8370},
+	{-6.3770, 106.8180},
+}
+
+type geoPoint struct {
+	Lat, Lng float64
+}
+
+// fixFilter drops fixes that cannot be real before they reach halte and lap detection
+type fixFilter struct {
+	polygon     []geoPoint
+	maxSpeedKmh float64
+}
+
+func newFixFilter(config *models.Config) (*fixFilter, error) {
+	f := &fixFilter{
+		polygon:     defaultCampusPolygon,
+		maxSpeedKmh: config.MaxFixSpeedKmh,
+	}
+	if f.maxSpeedKmh <= 0 {
+		f.maxSpeedKmh = defaultMaxFixSpeedKmh
+	}
+	if strings.TrimSpace(config.CampusPolygon) != "" {
+		polygon, err := parsePolygon(config.CampusPolygon)
+		if err != nil {
+			return f, err
+		}
+		f.polygon = polygon
+	}
+	return f, nil
+}
+
+// parsePolygon parses "lat,lng;lat,lng;..." into a polygon of at least three points
+func parsePolygon(value string) ([]geoPoint, error) {
+	var polygon []geoPoint
+	for _, pair := range strings.Split(value, ";") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		parts := strings.Split(pair, ",")
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid polygon point %q, expected lat,lng", pair)
+		}
+		lat, err := strconv.ParseFloat(strings.TrimSpace(parts[0]), 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid polygon latitude %q: %w", parts[0], err)
+		}
+		lng, err := strconv.ParseFloat(strings.TrimSpace(parts[1]), 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid polygon longitude %q: %w", parts[1], err)
+		}
+		polygon = append(polygon, geoPoint{lat, lng})
+	}
+	if len(polygon) < 3 {
+		return nil, fmt.Errorf("polygon needs at least 3 points, got %d", len(polygon))
+	}
+	return polygon, nil
+}
+
+// check validates a fix against the previously accepted fix of the same bus, previous may be nil
+func (f *fixFilter) check(fix *models.BusCoordinate, previous *models.BusCoordinate) error {
+	if fix.Latitude == 0 && fix.Longitude == 0 {
+		return ErrZeroFix
+	}
+	if !pointInPolygon(geoPoint{fix.Latitude, fix.Longitude}, f.polygon) {
+		return ErrOutsideArea
+	}
+	if previous != nil && fix.GpsTime.After(previous.GpsTime) {
+		dist := utils.DistanceMeters(previous.Latitude, previous.Longitude, fix.Latitude, fix.Longitude)
+		if dist >= minSpeedCheckDistanceMeters {
+			speedKmh := dist / fix.GpsTime.Sub(previous.GpsTime).Seconds() * 3.6
+			if speedKmh > f.maxSpeedKmh {
+				return fmt.Errorf("%w: %.0f km/h over %.0fm", ErrImpossibleSpeed, speedKmh, dist)
+			}
+		}
+	}
+	return nil
+}
+
+// pointInPolygon uses ray casting, the campus is small enough to treat lat/lng as planar
+func pointInPolygon(p geoPoint, polygon []geoPoint) bool {
+	inside := false
+	for i, j := 0, len(polygon)-1; i < len(polygon); j, i = i, i+1 {
+		a, b := polygon[i], polygon[j]
+		if (a.Lat > p.Lat) != (b.Lat > p.Lat) &&
+			p.Lng < (b.Lng-a.Lng)*(p.Lat-a.Lat)/(b.Lat-a.Lat)+a.Lng {
+			inside = !inside
+		}
+	}
+	return inside
+}
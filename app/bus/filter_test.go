@@ -0,0 +1,124 @@
+package bus
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/FreeJ1nG/bikuntracker-backend/app/models"
+)
+
+func TestFixFilterCheck(t *testing.T) {
+	base := time.Date(2024, 1, 1, 8, 0, 0, 0, Jakarta)
+	// Menwa, inside the default campus polygon
+	lat, lng := -6.353471269466313, 106.83177955448627
+	previous := &models.BusCoordinate{Latitude: lat, Longitude: lng, GpsTime: base}
+
+	tests := []struct {
+		name     string
+		fix      models.BusCoordinate
+		previous *models.BusCoordinate
+		want     error
+	}{
+		{"zero position", models.BusCoordinate{GpsTime: base.Add(time.Minute)}, previous, ErrZeroFix},
+		{"zero position without previous fix", models.BusCoordinate{GpsTime: base}, nil, ErrZeroFix},
+		{"outside campus", models.BusCoordinate{Latitude: -6.2, Longitude: 106.8, GpsTime: base.Add(time.Minute)}, previous, ErrOutsideArea},
+		{"first fix of a bus", models.BusCoordinate{Latitude: lat, Longitude: lng, GpsTime: base}, nil, nil},
+		{
+			// About 30m in one second is 108 km/h, but that close to the previous fix it is GPS jitter
+			"jitter under 50m",
+			models.BusCoordinate{Latitude: lat + 0.00027, Longitude: lng, GpsTime: base.Add(time.Second)},
+			previous,
+			nil,
+		},
+		{
+			// About 1.1km in 10 seconds
+			"impossible speed",
+			models.BusCoordinate{Latitude: lat - 0.01, Longitude: lng, GpsTime: base.Add(10 * time.Second)},
+			previous,
+			ErrImpossibleSpeed,
+		},
+		{
+			// The same 1.1km in two minutes is 33 km/h
+			"plausible speed",
+			models.BusCoordinate{Latitude: lat - 0.01, Longitude: lng, GpsTime: base.Add(2 * time.Minute)},
+			previous,
+			nil,
+		},
+	}
+
+	f, err := newFixFilter(&models.Config{})
+	if err != nil {
+		t.Fatalf("newFixFilter: %v", err)
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fix := tt.fix
+			if err := f.check(&fix, tt.previous); !errors.Is(err, tt.want) {
+				t.Errorf("got %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestPointInPolygon(t *testing.T) {
+	tests := []struct {
+		name  string
+		point geoPoint
+		want  bool
+	}{
+		{"Menwa", geoPoint{-6.353471, 106.831779}, true},
+		{"Parking", geoPoint{-6.348922, 106.826476}, true},
+		{"north of campus", geoPoint{-6.3400, 106.8300}, false},
+		{"east of campus", geoPoint{-6.3600, 106.8400}, false},
+		{"Jakarta", geoPoint{-6.2, 106.8}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := pointInPolygon(tt.point, defaultCampusPolygon); got != tt.want {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParsePolygon(t *testing.T) {
+	tests := []struct {
+		name    string
+		value   string
+		points  int
+		wantErr bool
+	}{
+		{"three points", "-6.34,106.81;-6.34,106.84;-6.38,106.84", 3, false},
+		{"spaces and trailing separator", " -6.34, 106.81 ; -6.34,106.84; -6.38,106.84;-6.38,106.81; ", 4, false},
+		{"too few points", "-6.34,106.81;-6.34,106.84", 0, true},
+		{"missing longitude", "-6.34;-6.34,106.84;-6.38,106.84", 0, true},
+		{"invalid latitude", "south,106.81;-6.34,106.84;-6.38,106.84", 0, true},
+		{"invalid longitude", "-6.34,east;-6.34,106.84;-6.38,106.84", 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			polygon, err := parsePolygon(tt.value)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v, want error %v", err, tt.wantErr)
+			}
+			if len(polygon) != tt.points {
+				t.Errorf("got %d points, want %d", len(polygon), tt.points)
+			}
+		})
+	}
+}
+
+func TestNewFixFilterMalformedPolygon(t *testing.T) {
+	// A malformed CAMPUS_POLYGON is reported and the default campus area stays in use
+	f, err := newFixFilter(&models.Config{CampusPolygon: "not a polygon"})
+	if err == nil {
+		t.Fatal("expected an error for a malformed polygon")
+	}
+	if len(f.polygon) != len(defaultCampusPolygon) {
+		t.Errorf("got %d polygon points, want the %d of the default campus area", len(f.polygon), len(defaultCampusPolygon))
+	}
+	if f.maxSpeedKmh != defaultMaxFixSpeedKmh {
+		t.Errorf("got max speed %v, want %v", f.maxSpeedKmh, float64(defaultMaxFixSpeedKmh))
+	}
+}
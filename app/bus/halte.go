@@ -1,60 +1,94 @@
 package bus
 
-import "math"
+import (
+	"context"
+	"log"
+	"time"
 
-type Halte struct {
-	Name     string
-	Lat, Lng float64
-}
+	"github.com/FreeJ1nG/bikuntracker-backend/app/dto"
+	"github.com/FreeJ1nG/bikuntracker-backend/app/models"
+	"github.com/FreeJ1nG/bikuntracker-backend/utils"
+)
 
-var halteList = []Halte{
-	{"Asrama UI", -6.348351370044594, 106.82976588606834},
-	{"Menwa", -6.353471269466313, 106.83177955448627},
-	{"Stasiun UI", -6.361052900888018, 106.83170076459645},
-	{"Fakultas Psikologi", -6.36255935735158, 106.83111906051636},
-	{"FISIP", -6.361574, 106.830172},
-	{"Fakultas Ilmu Pengetahuan Budaya", -6.361254501381427, 106.82978868484497},
-	{"Fakultas Ekonomi dan Bisnis", -6.35946048561971, 106.82582974433899},
-	{"Fakultas Teknik", -6.361043911445512, 106.82325214147568},
-	{"Vokasi", -6.366036735678631, 106.8216535449028},
-	{"SOR", -6.366915739619239, 106.82448193430899},
-	{"FMIPA", -6.369828304090281, 106.8257811293006},
-	{"Fakultas Ilmu Keperawatan", -6.371008186217929, 106.8268945813179},
-	{"Fakultas Kesehatan Masyarakat", -6.371677262480034, 106.8293622136116},
-	{"RIK", -6.36987795182555, 106.8310546875},
-	{"Stasiun Pondok Cina", -6.368212251024606, 106.83178257197142},
-	{"MUI/Perpus UI", -6.3655942342627565, 106.83204710483551},
-	{"Fakultas Hukum", -6.364901492199248, 106.83221206068993},
-	{"Parking", -6.348922, 106.826476},
-	{"Balai Sidang", -6.369147, 106.828450},
-	{"Balairung", -6.36913, 106.82963},
-	{"Fakultas Farmasi", -6.36813, 106.82731},
-	{"RSUI", -6.37285, 106.82869},
+// stopVisit is a stop a bus has arrived at and not departed from yet
+type stopVisit struct {
+	Halte     string
+	ArrivedAt time.Time
 }
 
-func nearestHalte(lat, lng float64) (string, float64) {
-	const earthRadius = 6371000 // meters
-	minDist := 1e9
-	closest := ""
-	for _, halte := range halteList {
-		dLat := (halte.Lat - lat) * (3.141592653589793 / 180)
-		dLng := (halte.Lng - lng) * (3.141592653589793 / 180)
-		alat := lat * (3.141592653589793 / 180)
-		blat := halte.Lat * (3.141592653589793 / 180)
-		a := (dLat/2)*(dLat/2) + (dLng/2)*(dLng/2)*cos(alat)*cos(blat)
-		c := 2 * atan2Sqrt(a, 1-a)
-		dist := earthRadius * c
-		if dist < minDist {
-			minDist = dist
-			closest = halte.Name
+// nearestArrivedHalte returns the closest stop whose arrival radius contains the position
+func (c *container) nearestArrivedHalte(lat, lng float64) (models.Halte, float64, bool) {
+	var closest models.Halte
+	minDist := 0.0
+	found := false
+	for _, halte := range c.halteCatalog.Haltes() {
+		dist := utils.DistanceMeters(lat, lng, halte.Latitude, halte.Longitude)
+		if dist < halte.ArrivalRadius && (!found || dist < minDist) {
+			closest, minDist, found = halte, dist, true
 		}
 	}
-	return closest, minDist
+	return closest, minDist, found
 }
 
-func cos(x float64) float64 {
-	return math.Cos(x)
+// updateStopVisit runs the arrival and departure geofences of a fix and returns the stop the bus is inside of.
+// A bus arrives inside the arrival radius of a stop and departs once it leaves the larger departure radius.
+// When stops are close together a bus only moves on to the next stop once it has left the arrival radius
+// of the current one and is closer to the next, so jitter between both never flips back and forth.
+// Callers must hold ingestMu.
+func (c *container) updateStopVisit(coord *models.BusCoordinate) string {
+	visit, inside := c.state.StopVisit(coord.Imei)
+	candidate, candidateDist, hasCandidate := c.nearestArrivedHalte(coord.Latitude, coord.Longitude)
+
+	if inside {
+		current, known := c.halteCatalog.Halte(visit.Halte)
+		dist := 0.0
+		if known {
+			dist = utils.DistanceMeters(coord.Latitude, coord.Longitude, current.Latitude, current.Longitude)
+		}
+		switch {
+		case !known || dist > current.DepartureRadius:
+		case hasCandidate && candidate.Name != visit.Halte && dist >= current.ArrivalRadius && candidateDist < dist:
+		default:
+			return visit.Halte
+		}
+		c.departStop(coord, visit)
+	}
+
+	if !hasCandidate {
+		return ""
+	}
+	c.state.SetStopVisit(coord.Imei, stopVisit{Halte: candidate.Name, ArrivedAt: coord.GpsTime})
+	c.state.AppendStopSequence(coord.Imei, candidate.Name, stopSequenceLength)
+	log.Printf("Bus %s arrived at %s (%.1fm)", coord.Imei, candidate.Name, candidateDist)
+	c.emitEvent(dto.BusEvent{
+		Type:  "arrived",
+		IMEI:  coord.Imei,
+		At:    coord.GpsTime,
+		Halte: candidate.Name,
+	})
+	return candidate.Name
 }
-func atan2Sqrt(a, b float64) float64 {
-	return math.Atan2(math.Sqrt(a), math.Sqrt(b))
+
+func (c *container) departStop(coord *models.BusCoordinate, visit stopVisit) {
+	c.state.ClearStopVisit(coord.Imei)
+	departedAt := coord.GpsTime
+	c.state.SetLastDeparture(coord.Imei, models.LapHalteVisit{Halte: visit.Halte, ArrivedAt: visit.ArrivedAt, DepartedAt: &departedAt})
+	dwell := coord.GpsTime.Sub(visit.ArrivedAt).Seconds()
+	log.Printf("Bus %s departed from %s after %.0fs", coord.Imei, visit.Halte, dwell)
+	c.emitEvent(dto.BusEvent{
+		Type:         "departed",
+		IMEI:         coord.Imei,
+		At:           coord.GpsTime,
+		Halte:        visit.Halte,
+		DwellSeconds: dwell,
+	})
+
+	if c.state.HasActiveLap(coord.Imei) {
+		imei := coord.Imei
+		c.persist(func(ctx context.Context) {
+			if err := c.busService.SetHalteDepartureOnActiveLap(ctx, imei, visit.Halte, departedAt); err != nil {
+				log.Printf("Failed to record departure from %s on active lap for bus %s: %v", visit.Halte, imei, err)
+			}
+		})
+	}
 }
@@ -2,9 +2,11 @@ package bus
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
+	"slices"
 	"strconv"
 	"strings"
 	"time"
@@ -17,16 +19,18 @@ import (
 )
 
 type handler struct {
-	repo      interfaces.BusRepository
-	service   interfaces.BusService
-	container interfaces.BusContainer
+	repo         interfaces.BusRepository
+	service      interfaces.BusService
+	container    interfaces.BusContainer
+	halteCatalog interfaces.HalteCatalog
 }
 
-func NewHandler(repo interfaces.BusRepository, service interfaces.BusService, container interfaces.BusContainer) *handler {
+func NewHandler(repo interfaces.BusRepository, service interfaces.BusService, container interfaces.BusContainer, halteCatalog interfaces.HalteCatalog) *handler {
 	return &handler{
-		repo:      repo,
-		service:   service,
-		container: container,
+		repo:         repo,
+		service:      service,
+		container:    container,
+		halteCatalog: halteCatalog,
 	}
 }
 
@@ -38,7 +42,6 @@ func (h *handler) WebhookUpdate(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	ctx := context.Background()
 	payload, err := utils.ParseRequestBody[dto.WebhookPayload](r.Body)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
@@ -51,103 +54,100 @@ func (h *handler) WebhookUpdate(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Build coordinate for this bus, deriving halte/next halte like WS parser
-	lat := d.Latitude
-	lng := d.Longitude
-	name, dist := nearestHalte(lat, lng)
-	prev := h.getPreviousHalte(d.IMEI)
-
-	routeType := detectRouteColorFromPair(prev, name)
-	var route []string
-	switch routeType {
-	case "blue":
-		route = blueNormal
-	case "express-blue":
-		route = blueMorning
-	case "red":
-		route = redNormal
-	case "express-red":
-		route = redMorning
-	default:
-		route = nil
-	}
-
-	coord := &models.BusCoordinate{
-		Imei:      d.IMEI,
-		Latitude:  lat,
-		Longitude: lng,
-		Speed:     int(d.Speed),
-		GpsTime:   time.Now(),
-	}
-	if name != "" && dist < 45 {
-		coord.CurrentHalte = name
-		coord.StatusMessage = "Arriving at " + name
-	} else if prev != "" {
-		coord.CurrentHalte = prev
-		coord.StatusMessage = "Depart from " + prev
-	}
-	if route != nil && coord.CurrentHalte != "" {
-		for i, hlt := range route {
-			if hlt == coord.CurrentHalte {
-				if i+1 < len(route) {
-					coord.NextHalte = route[i+1]
-				} else if len(route) > 0 {
-					coord.NextHalte = route[0]
-				}
-				break
-			}
-		}
+	// Apply through the same pipeline, late or repeated deliveries are dropped there
+	coord := webhookDataToCoordinate(payload.EventTime, d, time.Now())
+	response := dto.WebhookUpdateResponse{IMEI: d.IMEI, Accepted: true}
+	if errs := h.container.ApplyExternalCoordinates([]*models.BusCoordinate{coord}); errs[0] != nil {
+		log.Printf("Webhook fix for bus %s was not applied: %v", d.IMEI, errs[0])
+		response.Accepted = false
+		response.Reason = errs[0].Error()
 	}
 
-	// Merge with current coordinates to keep last known locations for all buses
-	coords := make(map[string]*models.BusCoordinate)
-	for k, v := range h.getBusCoordinatesMap() {
-		coords[k] = v
+	utils.EncodeSuccessResponse[dto.WebhookUpdateResponse](w, response)
+}
+
+// Batch webhook endpoint: receives location updates of many buses in one request and
+// reports, per item, whether the fix was accepted
+func (h *handler) WebhookBatchUpdate(w http.ResponseWriter, r *http.Request) {
+	payload, err := utils.ParseRequestBody[dto.WebhookBatchPayload](r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
 	}
-	coords[d.IMEI] = coord
 
-	// Update plate number if provided
-	if d.HullNo != "" {
-		if _, err := h.service.UpdateBusPlateNumberByImei(ctx, d.IMEI, d.HullNo); err != nil {
-			log.Printf("Failed to update plate number for bus %s: %v", d.IMEI, err)
+	receivedAt := time.Now()
+	results := make([]dto.WebhookBatchItemResult, len(payload.Event.Data))
+	fixes := make([]*models.BusCoordinate, 0, len(payload.Event.Data))
+	fixIndexes := make([]int, 0, len(payload.Event.Data))
+	for i, d := range payload.Event.Data {
+		results[i] = dto.WebhookBatchItemResult{Index: i, IMEI: d.IMEI}
+		if d.IMEI == "" {
+			results[i].Reason = "imei is required"
+			continue
 		}
+		fixes = append(fixes, webhookDataToCoordinate(payload.EventTime, d, receivedAt))
+		fixIndexes = append(fixIndexes, i)
 	}
 
-	// Enrich with bus metadata (color, id, number, plate) like WS parser
-	if buses, err := h.service.GetAllBuses(ctx); err == nil {
-		for _, b := range buses {
-			if bc, ok := coords[b.Imei]; ok {
-				bc.Color = b.Color
-				bc.Id = b.Id
-				bc.BusNumber = b.BusNumber
-				if bc.PlateNumber == "" {
-					bc.PlateNumber = b.PlateNumber
-				}
-			}
+	errs := h.container.ApplyExternalCoordinates(fixes)
+	for i, err := range errs {
+		result := &results[fixIndexes[i]]
+		if err != nil {
+			result.Reason = err.Error()
+		} else {
+			result.Accepted = true
 		}
 	}
 
-	// Apply through the same pipeline
-	if c, ok := h.container.(*container); ok {
-		c.ApplyExternalCoordinates(coords)
+	response := dto.WebhookBatchResponse{Results: results}
+	for _, result := range results {
+		if result.Accepted {
+			response.Accepted++
+		} else {
+			response.Rejected++
+		}
 	}
 
-	// Return success and the latest coordinates for all buses
-	utils.EncodeSuccessResponse[map[string]*models.BusCoordinate](w, h.getBusCoordinatesMap())
+	utils.EncodeSuccessResponse[dto.WebhookBatchResponse](w, response)
 }
 
-// Helpers to access concrete container-only fields without exposing them in interfaces
-func (h *handler) getBusCoordinatesMap() map[string]*models.BusCoordinate {
-	if c, ok := h.container.(*container); ok {
-		return c.busCoordinates
+// webhookDataToCoordinate normalizes a vendor fix, halte and bus metadata are derived by the container
+func webhookDataToCoordinate(eventTime int64, d dto.WebhookData, receivedAt time.Time) *models.BusCoordinate {
+	return &models.BusCoordinate{
+		Imei:        d.IMEI,
+		Latitude:    d.Latitude,
+		Longitude:   d.Longitude,
+		Speed:       int(d.Speed),
+		Direction:   d.Direction,
+		EngineOn:    d.EngineOn,
+		PlateNumber: d.HullNo,
+		Driver:      strings.TrimSpace(d.Driver),
+		GpsTime:     webhookDeviceTime(eventTime, d, receivedAt),
+		ReceivedAt:  receivedAt,
 	}
-	return map[string]*models.BusCoordinate{}
 }
-func (h *handler) getPreviousHalte(imei string) string {
-	if c, ok := h.container.(*container); ok {
-		return c.previousHalte[imei]
+
+// webhookDeviceTime picks the time the fix was taken by the device, falling back to the
+// vendor receive time, the event time and finally the time the webhook arrived
+func webhookDeviceTime(eventTime int64, d dto.WebhookData, receivedAt time.Time) time.Time {
+	if t, ok := parseDeviceTime(d.LastPacket); ok {
+		return t
+	}
+	if t, ok := parseDeviceTime(d.LastReceive); ok {
+		return t
 	}
-	return ""
+	if t, ok := parseDeviceTime(strconv.FormatInt(eventTime, 10)); ok {
+		return t
+	}
+	return receivedAt
+}
+
+// GetIngestStatus reports the health of every location source and the ingestion counters
+func (h *handler) GetIngestStatus(w http.ResponseWriter, r *http.Request) {
+	utils.EncodeSuccessResponse[dto.IngestStatusResponse](w, dto.IngestStatusResponse{
+		Sources: h.container.GetLocationSourceStatuses(),
+		Stats:   h.container.GetIngestStats(),
+	})
 }
 
 func (h *handler) GetBuses(w http.ResponseWriter, r *http.Request) {
@@ -177,6 +177,7 @@ func (h *handler) CreateBus(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	h.container.RefreshBusMetadata(ctx)
 
 	utils.EncodeSuccessResponse[models.Bus](w, *res)
 }
@@ -202,6 +203,7 @@ func (h *handler) UpdateBus(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	h.container.RefreshBusMetadata(ctx)
 
 	// If color is being updated, also update the runtime bus coordinates
 	if body.Color != nil {
@@ -229,6 +231,7 @@ func (h *handler) DeleteBus(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	h.container.RefreshBusMetadata(ctx)
 
 	utils.EncodeEmptySuccessResponse(w)
 }
@@ -373,12 +376,167 @@ func (h *handler) GetFilteredLapHistory(w http.ResponseWriter, r *http.Request)
 	utils.EncodeSuccessResponse[dto.PaginatedResponse[models.BusLapHistory]](w, response)
 }
 
+// GetLapStats aggregates closed lap durations matching the lap history filter.
+// group_by is a comma separated subset of route_color, bus, day and hour, defaulting to all of them.
+func (h *handler) GetLapStats(w http.ResponseWriter, r *http.Request) {
+	ctx := context.Background()
+
+	filter, err := h.parseLapHistoryFilter(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	groupBy := lapStatsGroups
+	if groupByStr := r.URL.Query().Get("group_by"); groupByStr != "" {
+		groupBy = make([]string, 0)
+		for _, group := range strings.Split(groupByStr, ",") {
+			group = strings.TrimSpace(group)
+			if !slices.Contains(lapStatsGroups, group) {
+				http.Error(w, fmt.Sprintf("invalid group_by %q (expected any of %s)", group, strings.Join(lapStatsGroups, ", ")), http.StatusBadRequest)
+				return
+			}
+			if !slices.Contains(groupBy, group) {
+				groupBy = append(groupBy, group)
+			}
+		}
+	}
+
+	stats, err := h.service.GetLapStats(ctx, filter, groupBy)
+	if err != nil {
+		log.Printf("Failed to get lap stats: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	utils.EncodeSuccessResponse[dto.GetLapStatsResponse](w, dto.GetLapStatsResponse{
+		GroupBy: groupBy,
+		Groups:  stats,
+	})
+}
+
+// ExportLapHistory streams every lap matching the lap history filter as a download.
+// format is csv (default), xlsx or geojson, rows picks one csv/xlsx row per lap (default) or per halte visit.
+// Pagination is only applied when limit is given.
+func (h *handler) ExportLapHistory(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	query := r.URL.Query()
+
+	filter, err := h.parseLapHistoryFilter(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if filter.Limit != nil && filter.Page != nil && filter.Offset == nil {
+		offset := (*filter.Page - 1) * *filter.Limit
+		filter.Offset = &offset
+	}
+
+	format := query.Get("format")
+	if format == "" {
+		format = LAP_EXPORT_FORMAT_CSV
+	}
+	if !slices.Contains(lapExportFormats, format) {
+		http.Error(w, fmt.Sprintf("invalid format (expected one of %s)", strings.Join(lapExportFormats, ", ")), http.StatusBadRequest)
+		return
+	}
+	rows := query.Get("rows")
+	if rows == "" {
+		rows = LAP_EXPORT_ROWS_LAP
+	}
+	if !slices.Contains(lapExportRows, rows) {
+		http.Error(w, fmt.Sprintf("invalid rows (expected one of %s)", strings.Join(lapExportRows, ", ")), http.StatusBadRequest)
+		return
+	}
+
+	// Headers are only sent with the first lap so a failing query can still be reported as an error
+	var writer lapExportWriter
+	started := false
+	start := func() error {
+		started = true
+		filename := fmt.Sprintf("lap-history-%s.%s", time.Now().Format("20060102-150405"), format)
+		w.Header().Set("Content-Type", lapExportContentTypes[format])
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+		w.WriteHeader(http.StatusOK)
+		writer, err = newLapExportWriter(w, format, rows, h.halteCatalog)
+		return err
+	}
+
+	err = h.service.StreamFilteredLapHistory(ctx, filter, func(lap models.BusLapHistory) error {
+		if !started {
+			if err := start(); err != nil {
+				return err
+			}
+		}
+		return writer.WriteLap(lap)
+	})
+	if err == nil && !started {
+		err = start()
+	}
+	if err != nil {
+		log.Printf("Failed to export lap history: %v", err)
+		if !started {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+	if err := writer.Close(); err != nil {
+		log.Printf("Failed to finish lap history export: %v", err)
+	}
+}
+
+// A driver is no longer counted as on duty once their bus sent no fix for longer than this
+const driverDutyGap = 10 * time.Minute
+
+// GetDriverSummary summarizes laps and hours on duty per driver from from_date to to_date,
+// both Jakarta days (YYYY-MM-DD) that default to today and are included in the range
+func (h *handler) GetDriverSummary(w http.ResponseWriter, r *http.Request) {
+	ctx := context.Background()
+	query := r.URL.Query()
+
+	today := time.Now().In(Jakarta).Format("2006-01-02")
+	fromStr, toStr := query.Get("from_date"), query.Get("to_date")
+	if fromStr == "" {
+		fromStr = today
+	}
+	if toStr == "" {
+		toStr = today
+	}
+	from, err := time.ParseInLocation("2006-01-02", fromStr, Jakarta)
+	if err != nil {
+		http.Error(w, "invalid from_date (expected YYYY-MM-DD)", http.StatusBadRequest)
+		return
+	}
+	to, err := time.ParseInLocation("2006-01-02", toStr, Jakarta)
+	if err != nil {
+		http.Error(w, "invalid to_date (expected YYYY-MM-DD)", http.StatusBadRequest)
+		return
+	}
+	if to.Before(from) {
+		http.Error(w, "to_date must not be before from_date", http.StatusBadRequest)
+		return
+	}
+
+	summaries, err := h.repo.GetDriverSummaries(ctx, from, to.AddDate(0, 0, 1), driverDutyGap)
+	if err != nil {
+		log.Printf("Failed to get driver summaries: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	utils.EncodeSuccessResponse[dto.GetDriverSummaryResponse](w, dto.GetDriverSummaryResponse{
+		FromDate: fromStr,
+		ToDate:   toStr,
+		Drivers:  summaries,
+	})
+}
+
 // Debug endpoint to create test lap data
 func (h *handler) CreateTestLapData(w http.ResponseWriter, r *http.Request) {
 	ctx := context.Background()
 
 	// Create some test lap history data using service layer
-	res, err := h.service.StartLap(ctx, "123456789", "blue")
+	res, err := h.service.StartLap(ctx, "123456789", "blue", "", models.LapHalteVisit{Halte: "Asrama UI", ArrivedAt: time.Now()})
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -414,6 +572,75 @@ func (h *handler) CheckLapHistoryTable(w http.ResponseWriter, r *http.Request) {
 	utils.EncodeSuccessResponse[map[string]interface{}](w, response)
 }
 
+// lapIdParam reads the lap id route parameter
+func lapIdParam(r *http.Request) (int, int, error) {
+	idStr, status, err := middleware.GetRouteParam(r, "id")
+	if err != nil {
+		return 0, status, err
+	}
+	id, err := strconv.Atoi(idStr)
+	if err != nil {
+		return 0, http.StatusBadRequest, fmt.Errorf("invalid lap id")
+	}
+	return id, http.StatusOK, nil
+}
+
+// CorrectLap applies an admin correction to a closed lap and returns its audit entry
+func (h *handler) CorrectLap(w http.ResponseWriter, r *http.Request) {
+	ctx := context.Background()
+
+	id, status, err := lapIdParam(r)
+	if err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+	body, err := utils.ParseRequestBody[dto.LapCorrectionRequest](r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	res, err := h.service.CorrectLap(ctx, id, body, h.container.LapAnomalies)
+	switch {
+	case errors.Is(err, ErrInvalidLapCorrection):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	case errors.Is(err, ErrLapNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	case err != nil:
+		log.Printf("Failed to correct lap %d: %v", id, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	log.Printf("Lap %d corrected (%s) by %q: %s", id, res.Action, res.CorrectedBy, res.Reason)
+
+	utils.EncodeSuccessResponse[models.LapCorrection](w, *res)
+}
+
+// GetLapCorrections lists the corrections involving a lap, oldest first
+func (h *handler) GetLapCorrections(w http.ResponseWriter, r *http.Request) {
+	ctx := context.Background()
+
+	id, status, err := lapIdParam(r)
+	if err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+
+	res, err := h.service.GetLapCorrections(ctx, id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	utils.EncodeSuccessResponse[[]models.LapCorrection](w, res)
+}
+
+var (
+	lapClosureReasons = []string{models.LAP_CLOSURE_COMPLETED, models.LAP_CLOSURE_RESTARTED, models.LAP_CLOSURE_INACTIVITY, models.LAP_CLOSURE_MAX_DURATION}
+	lapAnomalyFlags   = []string{models.LAP_ANOMALY_TOO_FEW_STOPS, models.LAP_ANOMALY_SKIPPED_MANDATORY_STOPS, models.LAP_ANOMALY_TOO_SHORT, models.LAP_ANOMALY_TOO_LONG}
+)
+
 // Helper method to parse lap history filter from query parameters
 func (h *handler) parseLapHistoryFilter(r *http.Request) (dto.LapHistoryFilter, error) {
 	var filter dto.LapHistoryFilter
@@ -438,6 +665,11 @@ func (h *handler) parseLapHistoryFilter(r *http.Request) (dto.LapHistoryFilter,
 		filter.RouteColor = &routeColor
 	}
 
+	// Parse Driver
+	if driver := query.Get("driver"); driver != "" {
+		filter.Driver = &driver
+	}
+
 	// Parse From Date
 	if fromDateStr := query.Get("from_date"); fromDateStr != "" {
 		fromDate, err := time.Parse("2006-01-02", fromDateStr)
@@ -445,11 +677,7 @@ func (h *handler) parseLapHistoryFilter(r *http.Request) (dto.LapHistoryFilter,
 			return filter, err
 		}
 		// Convert to Jakarta timezone
-		jakartaLoc, err := time.LoadLocation("Asia/Jakarta")
-		if err != nil {
-			return filter, fmt.Errorf("failed to load Jakarta timezone: %w", err)
-		}
-		fromDate = time.Date(fromDate.Year(), fromDate.Month(), fromDate.Day(), 0, 0, 0, 0, jakartaLoc)
+		fromDate = time.Date(fromDate.Year(), fromDate.Month(), fromDate.Day(), 0, 0, 0, 0, Jakarta)
 		filter.FromDate = &fromDate
 	}
 
@@ -460,11 +688,7 @@ func (h *handler) parseLapHistoryFilter(r *http.Request) (dto.LapHistoryFilter,
 			return filter, err
 		}
 		// Convert to Jakarta timezone and set to end of day
-		jakartaLoc, err := time.LoadLocation("Asia/Jakarta")
-		if err != nil {
-			return filter, fmt.Errorf("failed to load Jakarta timezone: %w", err)
-		}
-		toDate = time.Date(toDate.Year(), toDate.Month(), toDate.Day(), 23, 59, 59, 999999999, jakartaLoc)
+		toDate = time.Date(toDate.Year(), toDate.Month(), toDate.Day(), 23, 59, 59, 999999999, Jakarta)
 		filter.ToDate = &toDate
 	}
 
@@ -486,6 +710,40 @@ func (h *handler) parseLapHistoryFilter(r *http.Request) (dto.LapHistoryFilter,
 		filter.EndTime = &endTime
 	}
 
+	// Parse Closure Reason
+	if closureReason := query.Get("closure_reason"); closureReason != "" {
+		if !slices.Contains(lapClosureReasons, closureReason) {
+			return filter, fmt.Errorf("invalid closure_reason (expected one of %s)", strings.Join(lapClosureReasons, ", "))
+		}
+		filter.ClosureReason = &closureReason
+	}
+
+	// Parse Anomalous
+	if anomalousStr := query.Get("anomalous"); anomalousStr != "" {
+		anomalous, err := strconv.ParseBool(anomalousStr)
+		if err != nil {
+			return filter, fmt.Errorf("invalid anomalous (expected true or false)")
+		}
+		filter.Anomalous = &anomalous
+	}
+
+	// Parse Include Voided
+	if includeVoidedStr := query.Get("include_voided"); includeVoidedStr != "" {
+		includeVoided, err := strconv.ParseBool(includeVoidedStr)
+		if err != nil {
+			return filter, fmt.Errorf("invalid include_voided (expected true or false)")
+		}
+		filter.IncludeVoided = includeVoided
+	}
+
+	// Parse Anomaly
+	if anomaly := query.Get("anomaly"); anomaly != "" {
+		if !slices.Contains(lapAnomalyFlags, anomaly) {
+			return filter, fmt.Errorf("invalid anomaly (expected one of %s)", strings.Join(lapAnomalyFlags, ", "))
+		}
+		filter.Anomaly = &anomaly
+	}
+
 	// Parse Limit
 	if limitStr := query.Get("limit"); limitStr != "" {
 		limit, err := strconv.Atoi(limitStr)
@@ -0,0 +1,189 @@
+package bus
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/FreeJ1nG/bikuntracker-backend/app/dto"
+	"github.com/FreeJ1nG/bikuntracker-backend/app/models"
+)
+
+// Devices are allowed to be slightly ahead of the server clock, anything further is treated as a broken clock
+const maxFutureFixSkew = 2 * time.Minute
+
+var (
+	ErrDuplicateFix  = errors.New("duplicate fix: same device time as the last accepted fix")
+	ErrOutOfOrderFix = errors.New("out of order fix: older than the last accepted fix")
+	ErrFutureFix     = errors.New("fix device time is too far in the future")
+)
+
+var deviceTimeLayouts = []string{
+	time.RFC3339Nano,
+	"2006-01-02 15:04:05",
+	"2006-01-02T15:04:05",
+	"2006-01-02 15:04:05.000",
+	"02-01-2006 15:04:05",
+}
+
+// Jakarta is the zone devices report local time in and lap service days are counted in, loaded once
+var Jakarta = loadJakartaLocation()
+
+func loadJakartaLocation() *time.Location {
+	loc, err := time.LoadLocation("Asia/Jakarta")
+	if err != nil {
+		return time.FixedZone("WIB", 7*60*60)
+	}
+	return loc
+}
+
+type ingestStats struct {
+	accepted   atomic.Int64
+	duplicate  atomic.Int64
+	outOfOrder atomic.Int64
+	future     atomic.Int64
+	// Fixes rejected by the noise filter
+	zeroPosition    atomic.Int64
+	outsideArea     atomic.Int64
+	impossibleSpeed atomic.Int64
+}
+
+func (s *ingestStats) record(err error) {
+	switch {
+	case err == nil:
+		s.accepted.Add(1)
+	case errors.Is(err, ErrDuplicateFix):
+		s.duplicate.Add(1)
+	case errors.Is(err, ErrOutOfOrderFix):
+		s.outOfOrder.Add(1)
+	case errors.Is(err, ErrFutureFix):
+		s.future.Add(1)
+	case errors.Is(err, ErrZeroFix):
+		s.zeroPosition.Add(1)
+	case errors.Is(err, ErrOutsideArea):
+		s.outsideArea.Add(1)
+	case errors.Is(err, ErrImpossibleSpeed):
+		s.impossibleSpeed.Add(1)
+	}
+}
+
+func (s *ingestStats) snapshot() dto.IngestStats {
+	return dto.IngestStats{
+		Accepted:   s.accepted.Load(),
+		Duplicate:  s.duplicate.Load(),
+		OutOfOrder: s.outOfOrder.Load(),
+		Future:     s.future.Load(),
+		Filtered: dto.FilterStats{
+			ZeroPosition:    s.zeroPosition.Load(),
+			OutsideArea:     s.outsideArea.Load(),
+			ImpossibleSpeed: s.impossibleSpeed.Load(),
+		},
+	}
+}
+
+// parseDeviceTime parses the timestamp reported by a GPS device. Timestamps without
+// a zone are reported in Jakarta local time, numeric values are unix seconds or milliseconds.
+func parseDeviceTime(value string) (time.Time, bool) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return time.Time{}, false
+	}
+	if n, err := strconv.ParseInt(value, 10, 64); err == nil {
+		if n <= 0 {
+			return time.Time{}, false
+		}
+		if n > 1e12 {
+			return time.UnixMilli(n), true
+		}
+		return time.Unix(n, 0), true
+	}
+	for _, layout := range deviceTimeLayouts {
+		if t, err := time.ParseInLocation(layout, value, Jakarta); err == nil {
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// ApplyExternalCoordinates feeds new fixes from an external source (webhook, WS) through the
+// ingestion pipeline. Fixes are processed in device time order, duplicates and fixes older than
+// the newest accepted fix of the same bus are dropped before they reach halte and lap detection,
+// as are (0,0) fixes, fixes outside the campus area and jumps that imply an impossible speed.
+// The returned slice holds, for every input fix, nil if it was accepted or the reason it was dropped.
+// Buses without a new fix keep their last known position.
+func (c *container) ApplyExternalCoordinates(fixes []*models.BusCoordinate) []error {
+	c.ingestMu.Lock()
+	defer c.ingestMu.Unlock()
+
+	errs := make([]error, len(fixes))
+	order := make([]int, len(fixes))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(a, b int) bool {
+		return fixes[order[a]].GpsTime.Before(fixes[order[b]].GpsTime)
+	})
+
+	// A bus may report several fixes in one call, every round holds at most one fix per bus
+	// so each of them goes through halte and lap detection in order
+	rounds := make([]map[string]*models.BusCoordinate, 0, 1)
+	fixCount := make(map[string]int)
+	// previous holds the last accepted fix of every bus in this call, the speed check falls back to the stored coordinate
+	previous := make(map[string]*models.BusCoordinate)
+	now := c.now()
+	for _, i := range order {
+		fix := fixes[i]
+		if fix.ReceivedAt.IsZero() {
+			fix.ReceivedAt = now
+		}
+		if fix.GpsTime.IsZero() {
+			fix.GpsTime = fix.ReceivedAt
+		}
+
+		last, ok := previous[fix.Imei]
+		if !ok {
+			if stored, known := c.state.Coordinate(fix.Imei); known {
+				last = &stored
+			}
+		}
+
+		var err error
+		if fix.GpsTime.Sub(fix.ReceivedAt) > maxFutureFixSkew {
+			err = ErrFutureFix
+		} else if err = c.filter.check(fix, last); err == nil {
+			err = c.state.AcceptFixTime(fix.Imei, fix.GpsTime)
+		}
+		c.ingestStats.record(err)
+		if err != nil {
+			log.Printf("Dropping fix for bus %s at %s: %v", fix.Imei, fix.GpsTime.Format(time.RFC3339), err)
+			errs[i] = err
+			continue
+		}
+
+		previous[fix.Imei] = fix
+		round := fixCount[fix.Imei]
+		fixCount[fix.Imei]++
+		if round == len(rounds) {
+			rounds = append(rounds, make(map[string]*models.BusCoordinate))
+		}
+		rounds[round][fix.Imei] = fix
+	}
+
+	ctx := context.Background()
+	for _, coords := range rounds {
+		c.enrichCoordinates(ctx, coords)
+		c.runPipeline(coords)
+		c.state.MergeCoordinates(coords)
+		if c.telemetryWriter != nil {
+			for _, coord := range coords {
+				c.telemetryWriter.Enqueue(coordinateToPosition(coord))
+			}
+		}
+	}
+	return errs
+}
@@ -0,0 +1,165 @@
+package bus
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/FreeJ1nG/bikuntracker-backend/app/models"
+)
+
+const (
+	lapJanitorInterval           = time.Minute
+	defaultLapMaxDurationSeconds = 7200
+	defaultLapMinDurationSeconds = 600
+	// A lap visiting fewer stops than this is flagged even when its rule has no minimum
+	minLapStops = 3
+)
+
+// RunLapJanitor periodically closes orphaned laps until ctx is cancelled
+func (c *container) RunLapJanitor(ctx context.Context) {
+	ticker := time.NewTicker(lapJanitorInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			c.CloseOrphanedLaps()
+		}
+	}
+}
+
+// lapLastActivity is the last time a lap started, reached a stop or left one
+func lapLastActivity(lap models.BusLapHistory) time.Time {
+	last := lap.StartTime
+	for _, visit := range lap.HalteVisits {
+		if visit.ArrivedAt.After(last) {
+			last = visit.ArrivedAt
+		}
+		if visit.DepartedAt != nil && visit.DepartedAt.After(last) {
+			last = *visit.DepartedAt
+		}
+	}
+	return last
+}
+
+// CloseOrphanedLaps closes open laps that ran for longer than LAP_MAX_DURATION_SECONDS or saw no activity for
+// LAP_AUTO_CLOSE_AFTER_SECONDS. The status monitor only closes the active lap of buses that sent a fix since startup,
+// this also covers laps of buses that went silent before a restart and older laps a bus left open.
+// Laps are closed at their last activity. The database is only used without holding ingestMu.
+func (c *container) CloseOrphanedLaps() {
+	maxDuration := secondsOrDefault(c.config.LapMaxDurationSeconds, defaultLapMaxDurationSeconds)
+	inactiveAfter := secondsOrDefault(c.config.LapAutoCloseAfterSeconds, defaultLapAutoCloseAfterSeconds)
+
+	ctx := context.Background()
+	laps, err := c.busService.GetOpenLaps(ctx)
+	if err != nil {
+		log.Printf("Failed to load open laps: %v", err)
+		return
+	}
+	// Laps come oldest first, the newest open lap of a bus is its active lap
+	activeLapIds := make(map[string]int)
+	for _, lap := range laps {
+		activeLapIds[lap.IMEI] = lap.ID
+	}
+
+	now := c.now()
+	for _, lap := range laps {
+		endTime := lapLastActivity(lap)
+		lastActivity := endTime
+		isActiveLap := activeLapIds[lap.IMEI] == lap.ID
+		var lastFix time.Time
+		if coord, ok := c.state.Coordinate(lap.IMEI); ok && isActiveLap {
+			lastFix = coord.GpsTime
+			if lastFix.After(lastActivity) {
+				lastActivity = lastFix
+			}
+		}
+
+		var closureReason string
+		switch {
+		case now.Sub(lap.StartTime) > maxDuration:
+			closureReason = models.LAP_CLOSURE_MAX_DURATION
+		case now.Sub(lastActivity) > inactiveAfter:
+			closureReason = models.LAP_CLOSURE_INACTIVITY
+		default:
+			continue
+		}
+		if isActiveLap && !c.releaseActiveLap(lap.IMEI, lastFix) {
+			continue
+		}
+
+		closed, err := c.busService.CloseLap(ctx, lap, endTime, closureReason)
+		if err != nil {
+			log.Printf("Failed to close orphaned lap %d of bus %s: %v", lap.ID, lap.IMEI, err)
+			continue
+		}
+		log.Printf("Closed orphaned lap %d of bus %s (%s)", lap.LapNumber, lap.IMEI, closureReason)
+		c.flagLapAnomalies(ctx, closed)
+		if isActiveLap {
+			c.pushLapEvent(ctx, lap.IMEI, "lap_end", closed)
+		}
+	}
+}
+
+// releaseActiveLap stops the pipeline from adding visits to the active lap of a bus before the janitor closes it.
+// It refuses when the bus reported after lastFix, the lap may have changed since the open laps were loaded.
+func (c *container) releaseActiveLap(imei string, lastFix time.Time) bool {
+	c.ingestMu.Lock()
+	defer c.ingestMu.Unlock()
+	if coord, ok := c.state.Coordinate(imei); ok && !coord.GpsTime.Equal(lastFix) {
+		return false
+	}
+	c.state.SetActiveLap(imei, false)
+	c.state.SetLapStops(imei, 0)
+	return true
+}
+
+// lapAnomalies lists what looks wrong about a closed lap driven under the given rule
+func lapAnomalies(lap models.BusLapHistory, rule models.LapRule, minDuration time.Duration, maxDuration time.Duration) []string {
+	anomalies := make([]string, 0)
+	if len(lap.HalteVisits) < max(rule.MinStops, minLapStops) {
+		anomalies = append(anomalies, models.LAP_ANOMALY_TOO_FEW_STOPS)
+	}
+
+	visited := make(map[string]bool, len(lap.HalteVisits))
+	for _, visit := range lap.HalteVisits {
+		visited[visit.Halte] = true
+	}
+	for _, stop := range rule.MandatoryStops {
+		if !visited[stop] {
+			anomalies = append(anomalies, models.LAP_ANOMALY_SKIPPED_MANDATORY_STOPS)
+			break
+		}
+	}
+
+	if lap.EndTime != nil {
+		duration := lap.EndTime.Sub(lap.StartTime)
+		if duration < minDuration {
+			anomalies = append(anomalies, models.LAP_ANOMALY_TOO_SHORT)
+		} else if duration > maxDuration {
+			anomalies = append(anomalies, models.LAP_ANOMALY_TOO_LONG)
+		}
+	}
+	return anomalies
+}
+
+// LapAnomalies is lapAnomalies under the lap rule of the route of the lap and the configured durations
+func (c *container) LapAnomalies(lap models.BusLapHistory) []string {
+	minDuration := secondsOrDefault(c.config.LapMinDurationSeconds, defaultLapMinDurationSeconds)
+	maxDuration := secondsOrDefault(c.config.LapMaxDurationSeconds, defaultLapMaxDurationSeconds)
+	return lapAnomalies(lap, c.lapRule(lap.RouteColor), minDuration, maxDuration)
+}
+
+// flagLapAnomalies stores the anomalies of a lap that was just closed
+func (c *container) flagLapAnomalies(ctx context.Context, lap *models.BusLapHistory) {
+	lap.Anomalies = c.LapAnomalies(*lap)
+	if len(lap.Anomalies) == 0 {
+		return
+	}
+	log.Printf("Lap %d of bus %s is anomalous: %v", lap.LapNumber, lap.IMEI, lap.Anomalies)
+	if err := c.busService.SetLapAnomalies(ctx, lap.ID, lap.Anomalies); err != nil {
+		log.Printf("Failed to flag anomalies of lap %d of bus %s: %v", lap.ID, lap.IMEI, err)
+	}
+}
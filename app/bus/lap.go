@@ -0,0 +1,137 @@
+package bus
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/FreeJ1nG/bikuntracker-backend/app/models"
+	"github.com/FreeJ1nG/bikuntracker-backend/app/route"
+)
+
+// defaultLapRule applies to buses without a detected route and to routes without a lap rule
+var defaultLapRule = models.LapRule{
+	Start: models.LapTransition{From: "Asrama UI", To: "Menwa"},
+	End:   []models.LapTransition{{To: "Parking"}, {From: "Menwa", To: "Asrama UI"}},
+}
+
+type lapAction int
+
+const (
+	lapActionNone lapAction = iota
+	// lapActionStart ends the active lap, if any, and starts a new one
+	lapActionStart
+	lapActionEnd
+)
+
+// evaluateLapRule decides what a move from previousHalte to currentHalte does to the lap of a bus.
+// lapStops is the number of stops visited by the active lap, currentHalte included.
+// A start transition always wins, so a bus that restarts its route without reaching an end begins a new lap.
+func evaluateLapRule(rule models.LapRule, previousHalte string, currentHalte string, active bool, lapStops int) lapAction {
+	if rule.Start.Matches(previousHalte, currentHalte) {
+		return lapActionStart
+	}
+	if !active || lapStops < rule.MinStops {
+		return lapActionNone
+	}
+	for _, transition := range rule.End {
+		if transition.Matches(previousHalte, currentHalte) {
+			return lapActionEnd
+		}
+	}
+	return lapActionNone
+}
+
+// lapRule returns the lap rule of the route a lap of the given route color is driven on
+func (c *container) lapRule(routeColor string) models.LapRule {
+	if r, ok := c.routeOf(routeColor); ok && r.LapRule != nil {
+		return *r.LapRule
+	}
+	return defaultLapRule
+}
+
+// lapFirstVisit is the first stop of a lap starting on a move from previousHalte to the stop of coord.
+// It is the visit to previousHalte when its departure was seen, so the lap starts when the bus left it.
+func (c *container) lapFirstVisit(coord *models.BusCoordinate, previousHalte string) models.LapHalteVisit {
+	if visit, ok := c.state.LastDeparture(coord.Imei); ok && visit.Halte == previousHalte {
+		visit.Sequence = 1
+		return visit
+	}
+	if previousHalte == "" {
+		return models.LapHalteVisit{Sequence: 1, Halte: coord.AtHalte, ArrivedAt: coord.GpsTime}
+	}
+	return models.LapHalteVisit{Sequence: 1, Halte: previousHalte, ArrivedAt: coord.GpsTime}
+}
+
+// updateLap records the arrival of a bus at a new stop on its active lap, then starts or ends laps following
+// the lap rule of its route. Callers must hold ingestMu, the lap is written by RunPersister.
+func (c *container) updateLap(coord *models.BusCoordinate, previousHalte string) {
+	imei, name, arrivedAt := coord.Imei, coord.AtHalte, coord.GpsTime
+	if c.state.HasActiveLap(imei) {
+		c.addHalteVisit(imei, name, arrivedAt)
+	}
+
+	// Laps record the detected variant in their route color, express-<color> for the morning variant
+	routeColor := route.BusColor(route.CoordinateRoute(*coord))
+	if routeColor == "" {
+		routeColor = "grey"
+	}
+	rule := c.lapRule(routeColor)
+	switch evaluateLapRule(rule, previousHalte, name, c.state.HasActiveLap(imei), c.state.LapStops(imei)) {
+	case lapActionStart:
+		log.Printf("Lap start condition met - Bus %s: %s → %s", imei, previousHalte, name)
+		if c.state.HasActiveLap(imei) {
+			log.Printf("Ending previous lap for bus %s to start new one", imei)
+			c.endLap(imei, arrivedAt, routeColor, models.LAP_CLOSURE_RESTARTED)
+		}
+
+		firstVisit := c.lapFirstVisit(coord, previousHalte)
+		driver := coord.Driver
+		c.state.SetActiveLap(imei, true)
+		c.state.SetLapStops(imei, 1)
+		c.persist(func(ctx context.Context) {
+			lapHistory, err := c.busService.StartLap(ctx, imei, routeColor, driver, firstVisit)
+			if err != nil {
+				log.Printf("Failed to start lap for bus %s: %v", imei, err)
+				return
+			}
+			log.Printf("Started lap %d for bus %s at %s (color: %s)", lapHistory.LapNumber, imei, firstVisit.Halte, routeColor)
+			c.pushLapEvent(ctx, imei, "lap_start", lapHistory)
+		})
+		if firstVisit.Halte != name {
+			c.addHalteVisit(imei, name, arrivedAt)
+		}
+	case lapActionEnd:
+		log.Printf("Lap end condition met - Bus %s reached %s from %s", imei, name, previousHalte)
+		c.endLap(imei, arrivedAt, routeColor, models.LAP_CLOSURE_COMPLETED)
+	}
+}
+
+// addHalteVisit appends the arrival at a stop to the active lap of a bus. Callers must hold ingestMu.
+func (c *container) addHalteVisit(imei string, halteName string, arrivedAt time.Time) {
+	c.state.SetLapStops(imei, c.state.LapStops(imei)+1)
+	c.persist(func(ctx context.Context) {
+		if err := c.busService.AddHalteVisitToActiveLap(ctx, imei, halteName, arrivedAt); err != nil {
+			log.Printf("Failed to add halte visit to active lap for bus %s: %v", imei, err)
+		}
+	})
+}
+
+// endLap ends the active lap of a bus at endTime, routeColor is the route detected when it ended.
+// Callers must hold ingestMu.
+func (c *container) endLap(imei string, endTime time.Time, routeColor string, closureReason string) {
+	c.state.SetActiveLap(imei, false)
+	c.state.SetLapStops(imei, 0)
+	c.persist(func(ctx context.Context) {
+		lapHistory, err := c.busService.EndLapAt(ctx, imei, endTime, routeColor, closureReason)
+		if err != nil {
+			log.Printf("Failed to end lap for bus %s: %v", imei, err)
+			return
+		}
+		if lapHistory != nil {
+			log.Printf("Ended lap %d for bus %s (%s)", lapHistory.LapNumber, imei, closureReason)
+			c.flagLapAnomalies(ctx, lapHistory)
+			c.pushLapEvent(ctx, imei, "lap_end", lapHistory)
+		}
+	})
+}
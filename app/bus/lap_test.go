@@ -0,0 +1,141 @@
+package bus
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/FreeJ1nG/bikuntracker-backend/app/halte"
+	"github.com/FreeJ1nG/bikuntracker-backend/app/interfaces"
+	"github.com/FreeJ1nG/bikuntracker-backend/app/models"
+	"github.com/FreeJ1nG/bikuntracker-backend/app/route"
+)
+
+func TestEvaluateLapRule(t *testing.T) {
+	rule := models.LapRule{
+		Start:    models.LapTransition{From: "Asrama UI", To: "Menwa"},
+		End:      []models.LapTransition{{From: "Menwa", To: "Asrama UI"}, {To: "Parking"}},
+		MinStops: 3,
+	}
+	// The start and an end transition both match a move from Menwa to Asrama UI
+	overlapping := models.LapRule{
+		Start: models.LapTransition{From: "Menwa", To: "Asrama UI"},
+		End:   []models.LapTransition{{From: "Menwa", To: "Asrama UI"}},
+	}
+
+	tests := []struct {
+		name          string
+		rule          models.LapRule
+		previousHalte string
+		currentHalte  string
+		active        bool
+		lapStops      int
+		want          lapAction
+	}{
+		{"start without an active lap", rule, "Asrama UI", "Menwa", false, 0, lapActionStart},
+		{"start restarts an active lap", rule, "Asrama UI", "Menwa", true, 5, lapActionStart},
+		{"start beats a matching end", overlapping, "Menwa", "Asrama UI", true, 5, lapActionStart},
+		{"start needs its previous stop", rule, "Stasiun UI", "Menwa", false, 0, lapActionNone},
+		{"end", rule, "Menwa", "Asrama UI", true, 3, lapActionEnd},
+		{"end below min stops", rule, "Menwa", "Asrama UI", true, 2, lapActionNone},
+		{"end needs its previous stop", rule, "Stasiun UI", "Asrama UI", true, 5, lapActionNone},
+		{"end with an empty from matches any previous stop", rule, "Fakultas Teknik", "Parking", true, 5, lapActionEnd},
+		{"end with an empty from after no stop", rule, "", "Parking", true, 5, lapActionEnd},
+		{"end without an active lap", rule, "Fakultas Teknik", "Parking", false, 0, lapActionNone},
+		{"any other move", rule, "Stasiun UI", "Balairung", true, 5, lapActionNone},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := evaluateLapRule(tt.rule, tt.previousHalte, tt.currentHalte, tt.active, tt.lapStops); got != tt.want {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLapFirstVisit(t *testing.T) {
+	const imei = "860000000000001"
+	arrived := time.Date(2024, 1, 1, 7, 0, 0, 0, Jakarta)
+	departed := arrived.Add(2 * time.Minute)
+	at := arrived.Add(5 * time.Minute)
+	coord := &models.BusCoordinate{Imei: imei, AtHalte: "Menwa", GpsTime: at}
+
+	tests := []struct {
+		name          string
+		departure     *models.LapHalteVisit
+		previousHalte string
+		want          models.LapHalteVisit
+	}{
+		{
+			"departure from the previous stop",
+			&models.LapHalteVisit{Sequence: 4, Halte: "Asrama UI", ArrivedAt: arrived, DepartedAt: &departed},
+			"Asrama UI",
+			models.LapHalteVisit{Sequence: 1, Halte: "Asrama UI", ArrivedAt: arrived, DepartedAt: &departed},
+		},
+		{
+			"departure from another stop",
+			&models.LapHalteVisit{Sequence: 4, Halte: "Parking", ArrivedAt: arrived},
+			"Asrama UI",
+			models.LapHalteVisit{Sequence: 1, Halte: "Asrama UI", ArrivedAt: at},
+		},
+		{"no departure", nil, "Asrama UI", models.LapHalteVisit{Sequence: 1, Halte: "Asrama UI", ArrivedAt: at}},
+		{"no previous stop", nil, "", models.LapHalteVisit{Sequence: 1, Halte: "Menwa", ArrivedAt: at}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newTestContainer(t, nil)
+			if tt.departure != nil {
+				c.state.SetLastDeparture(imei, *tt.departure)
+			}
+			if got := c.lapFirstVisit(coord, tt.previousHalte); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+type stubRouteRepository struct {
+	interfaces.RouteRepository
+	routes []models.Route
+}
+
+func (r stubRouteRepository) GetRoutes(ctx context.Context) ([]models.Route, error) {
+	return r.routes, nil
+}
+
+func TestLapRule(t *testing.T) {
+	blueRule := &models.LapRule{
+		Start:    models.LapTransition{From: "Asrama UI", To: "Menwa"},
+		End:      []models.LapTransition{{To: "Parking"}},
+		MinStops: 8,
+	}
+	c := newTestContainer(t, nil)
+	halteCatalog := halte.NewCatalog(nil)
+	routeCatalog := route.NewCatalog(stubRouteRepository{routes: []models.Route{
+		{Name: "blue-normal", Color: "blue", Variant: route.VARIANT_NORMAL, IsActive: true, Stops: []string{"Asrama UI", "Menwa", "Parking"}, LapRule: blueRule},
+		{Name: "blue-morning", Color: "blue", Variant: route.VARIANT_MORNING, IsActive: true, Stops: []string{"Asrama UI", "Menwa", "Parking"}},
+	}}, halteCatalog)
+	if err := routeCatalog.Reload(context.Background()); err != nil {
+		t.Fatalf("Reload: %v", err)
+	}
+	c.routeCatalog = routeCatalog
+
+	tests := []struct {
+		name       string
+		routeColor string
+		want       models.LapRule
+	}{
+		{"route with a lap rule", "blue", *blueRule},
+		{"route without a lap rule", "express-blue", defaultLapRule},
+		{"no route of the color", "red", defaultLapRule},
+		{"undecided color", "grey", defaultLapRule},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := c.lapRule(tt.routeColor); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,124 @@
+package bus
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/FreeJ1nG/bikuntracker-backend/app/dto"
+	"github.com/FreeJ1nG/bikuntracker-backend/app/models"
+)
+
+const (
+	statusMonitorInterval           = 5 * time.Second
+	defaultBusStaleAfterSeconds     = 60
+	defaultBusOfflineAfterSeconds   = 300
+	defaultLapAutoCloseAfterSeconds = 1800
+)
+
+func secondsOrDefault(value int, fallback int) time.Duration {
+	if value <= 0 {
+		value = fallback
+	}
+	return time.Duration(value) * time.Second
+}
+
+// RunStatusMonitor periodically marks silent buses stale or offline until ctx is cancelled
+func (c *container) RunStatusMonitor(ctx context.Context) {
+	ticker := time.NewTicker(statusMonitorInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			c.CheckBusStatuses()
+		}
+	}
+}
+
+// silentLap is the active lap of a bus that went silent, to be closed at the last fix of the bus
+type silentLap struct {
+	imei    string
+	endTime time.Time
+}
+
+// CheckBusStatuses derives the status of every bus from the time since its last accepted fix.
+// The active lap of a bus that stays silent past LAP_AUTO_CLOSE_AFTER_SECONDS is closed at its last fix.
+func (c *container) CheckBusStatuses() {
+	c.ingestMu.Lock()
+	defer c.ingestMu.Unlock()
+	for _, lap := range c.updateBusStatuses() {
+		c.persist(func(ctx context.Context) {
+			c.closeSilentLap(ctx, lap)
+		})
+	}
+}
+
+// updateBusStatuses updates the status of every bus and returns the laps to close. Their buses no longer count
+// as having an active lap, so the pipeline stops adding visits to them before they are closed.
+// Callers must hold ingestMu.
+func (c *container) updateBusStatuses() []silentLap {
+	staleAfter := secondsOrDefault(c.config.BusStaleAfterSeconds, defaultBusStaleAfterSeconds)
+	offlineAfter := secondsOrDefault(c.config.BusOfflineAfterSeconds, defaultBusOfflineAfterSeconds)
+	lapCloseAfter := secondsOrDefault(c.config.LapAutoCloseAfterSeconds, defaultLapAutoCloseAfterSeconds)
+
+	var silentLaps []silentLap
+	now := c.now()
+	for imei, coord := range c.state.CoordinatesMap() {
+		lastSeen := coord.ReceivedAt
+		if lastSeen.IsZero() {
+			lastSeen = coord.GpsTime
+		}
+		silence := now.Sub(lastSeen)
+
+		status := models.BUS_STATUS_ONLINE
+		if silence >= offlineAfter {
+			status = models.BUS_STATUS_OFFLINE
+		} else if silence >= staleAfter {
+			status = models.BUS_STATUS_STALE
+		}
+		if status != coord.Status {
+			c.state.UpdateCoordinate(imei, func(stored *models.BusCoordinate) {
+				stored.Status = status
+			})
+			log.Printf("Bus %s is now %s, last fix %s ago", imei, status, silence.Round(time.Second))
+			c.emitEvent(dto.BusEvent{
+				Type:           "status_change",
+				IMEI:           imei,
+				At:             now,
+				Status:         status,
+				PreviousStatus: coord.Status,
+			})
+		}
+
+		if silence >= lapCloseAfter && c.state.HasActiveLap(imei) {
+			log.Printf("Auto-closing lap of bus %s after %s without fixes", imei, silence.Round(time.Second))
+			c.state.SetActiveLap(imei, false)
+			c.state.SetLapStops(imei, 0)
+			silentLaps = append(silentLaps, silentLap{imei: imei, endTime: coord.GpsTime})
+		}
+	}
+	return silentLaps
+}
+
+// closeSilentLap closes the lap of a silent bus from RunPersister, after the writes queued before the bus went silent.
+// A lap started after the last fix of the bus is left open, it belongs to a later fix.
+func (c *container) closeSilentLap(ctx context.Context, silent silentLap) {
+	lap, err := c.busService.GetActiveLap(ctx, silent.imei)
+	if err != nil {
+		log.Printf("Failed to load the lap of silent bus %s: %v", silent.imei, err)
+		return
+	}
+	if lap == nil || lap.StartTime.After(silent.endTime) {
+		return
+	}
+	closed, err := c.busService.CloseLap(ctx, *lap, silent.endTime, models.LAP_CLOSURE_INACTIVITY)
+	if err != nil {
+		log.Printf("Failed to end lap for bus %s: %v", silent.imei, err)
+		return
+	}
+	log.Printf("Ended lap %d for bus %s (%s)", closed.LapNumber, silent.imei, models.LAP_CLOSURE_INACTIVITY)
+	c.flagLapAnomalies(ctx, closed)
+	c.pushLapEvent(ctx, silent.imei, "lap_end", closed)
+}
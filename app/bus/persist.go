@@ -0,0 +1,56 @@
+package bus
+
+import (
+	"context"
+	"time"
+)
+
+const (
+	// persistQueueSize bounds the pipeline writes waiting for the database, the pipeline blocks once it is full
+	persistQueueSize    = 1000
+	persistWriteTimeout = 10 * time.Second
+)
+
+// persistJob writes an outcome of the ingestion pipeline to the database
+type persistJob func(ctx context.Context)
+
+// persist queues a database write. The pipeline updates the runtime state under ingestMu and leaves the database
+// to RunPersister, which runs writes one at a time in the order they were queued so the writes of a bus follow
+// the order of its fixes. Jobs must not take ingestMu, the pipeline may be waiting for room in the queue.
+func (c *container) persist(job persistJob) {
+	c.persistQueue <- job
+}
+
+// RunPersister runs queued pipeline writes until ctx is cancelled, then runs the writes still queued
+func (c *container) RunPersister(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			for {
+				select {
+				case job := <-c.persistQueue:
+					c.runPersistJob(job)
+				default:
+					return
+				}
+			}
+		case job := <-c.persistQueue:
+			c.runPersistJob(job)
+		}
+	}
+}
+
+func (c *container) runPersistJob(job persistJob) {
+	ctx, cancel := context.WithTimeout(context.Background(), persistWriteTimeout)
+	defer cancel()
+	job(ctx)
+}
+
+// FlushPersister waits until every write queued so far has run, RunPersister has to be running
+func (c *container) FlushPersister() {
+	done := make(chan struct{})
+	c.persist(func(ctx context.Context) {
+		close(done)
+	})
+	<-done
+}
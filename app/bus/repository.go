@@ -3,9 +3,13 @@ package bus
 import (
 	"context"
 	"database/sql"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"slices"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/FreeJ1nG/bikuntracker-backend/app/dto"
 	"github.com/FreeJ1nG/bikuntracker-backend/app/models"
@@ -180,474 +184,1038 @@ func (r *repository) InsertBuses(ctx context.Context, data []models.Bus) (err er
 	return
 }
 
-// Lap history repository methods
-func (r *repository) CreateLapHistory(ctx context.Context, lapHistory *models.BusLapHistory) (*models.BusLapHistory, error) {
-	row := r.db.QueryRow(
+func (r *repository) InsertBusPositions(ctx context.Context, positions []models.BusPosition) (err error) {
+	rows := make([][]interface{}, 0, len(positions))
+	for _, p := range positions {
+		rows = append(rows, []interface{}{p.IMEI, p.Latitude, p.Longitude, p.Speed, p.Direction, p.EngineOn, nullIfEmpty(p.Driver), p.DeviceTime, p.ReceivedAt})
+	}
+	_, err = r.db.CopyFrom(
 		ctx,
-		`INSERT INTO bus_lap_history (bus_id, imei, lap_number, start_time, route_color, halte_visit_history) 
-		 VALUES ($1, $2, $3, $4, $5, $6) 
-		 RETURNING id, bus_id, imei, lap_number, start_time, end_time, route_color, halte_visit_history, created_at, updated_at`,
-		lapHistory.BusID,
-		lapHistory.IMEI,
-		lapHistory.LapNumber,
-		lapHistory.StartTime,
-		lapHistory.RouteColor,
-		lapHistory.HalteVisitHistory,
+		pgx.Identifier{"bus_position"},
+		[]string{"imei", "latitude", "longitude", "speed", "direction", "engine_on", "driver", "device_time", "received_at"},
+		pgx.CopyFromRows(rows),
 	)
+	if err != nil {
+		err = fmt.Errorf("unable to copy bus positions: %w", err)
+		return
+	}
+	return
+}
 
-	var created models.BusLapHistory
-	var endTime sql.NullTime
-	var halteVisitHistory sql.NullString
-	err := row.Scan(
-		&created.ID,
-		&created.BusID,
-		&created.IMEI,
-		&created.LapNumber,
-		&created.StartTime,
-		&endTime,
-		&created.RouteColor,
-		&halteVisitHistory,
-		&created.CreatedAt,
-		&created.UpdatedAt,
+// nullIfEmpty stores an empty string as NULL
+func nullIfEmpty(s string) any {
+	if s == "" {
+		return nil
+	}
+	return s
+}
+
+// GetBusPositions returns the recorded fixes of a bus in [from, to), ordered by device time.
+// An empty imei returns the fixes of every bus.
+func (r *repository) GetBusPositions(ctx context.Context, imei string, from time.Time, to time.Time) (res []models.BusPosition, err error) {
+	rows, err := r.db.Query(
+		ctx,
+		`SELECT id, imei, latitude, longitude, speed, direction, engine_on, COALESCE(driver, ''), device_time, received_at
+		 FROM bus_position
+		 WHERE ($1 = '' OR imei = $1) AND device_time >= $2 AND device_time < $3
+		 ORDER BY device_time, id`,
+		imei,
+		from,
+		to,
 	)
 	if err != nil {
-		return nil, fmt.Errorf("unable to create lap history: %w", err)
+		err = fmt.Errorf("unable to get bus positions: %w", err)
+		return
+	}
+	defer rows.Close()
+
+	res = make([]models.BusPosition, 0)
+	for rows.Next() {
+		var p models.BusPosition
+		err = rows.Scan(&p.ID, &p.IMEI, &p.Latitude, &p.Longitude, &p.Speed, &p.Direction, &p.EngineOn, &p.Driver, &p.DeviceTime, &p.ReceivedAt)
+		if err != nil {
+			err = fmt.Errorf("unable to scan bus position: %w", err)
+			return
+		}
+		res = append(res, p)
+	}
+	if err = rows.Err(); err != nil {
+		err = fmt.Errorf("unable to read bus positions: %w", err)
+		return
+	}
+	return
+}
+
+// Lap history repository methods
+
+const lapHistoryColumns = `blh.id, blh.bus_id, blh.imei, blh.lap_number, blh.service_date, blh.daily_lap_number,
+		blh.start_time, blh.end_time, blh.route_color, blh.driver,
+		blh.halte_visit_history, blh.closure_reason, blh.anomalies, blh.voided_at, blh.corrected_at,
+		blh.created_at, blh.updated_at`
+
+// lapHalteVisitsJSON selects the halte visits of blh as a JSON array ordered by sequence
+const lapHalteVisitsJSON = `COALESCE((
+		SELECT json_agg(json_build_object(
+			'sequence', lhv.sequence, 'halte', lhv.halte, 'arrived_at', lhv.arrived_at, 'departed_at', lhv.departed_at
+		) ORDER BY lhv.sequence)
+		FROM lap_halte_visit lhv
+		WHERE lhv.lap_id = blh.id
+	), '[]')`
+
+// lapHistoryWithVisitsQuery selects laps with their bus and halte visits, scanned by scanLapHistoryWithVisits
+const lapHistoryWithVisitsQuery = `SELECT ` + lapHistoryColumns + `,
+		b.vehicle_no, b.bus_number, b.plate_number, b.is_active, b.color,
+		` + lapHalteVisitsJSON + `
+	FROM bus_lap_history blh
+	JOIN bus b ON blh.bus_id = b.id`
+
+// scanLapHistory scans the lapHistoryColumns of a row, followed by the bus columns when withBus is set
+// and any extra columns selected after them
+func scanLapHistory(row pgx.Row, withBus bool, extra ...any) (lap models.BusLapHistory, err error) {
+	var endTime, voidedAt, correctedAt sql.NullTime
+	var serviceDate time.Time
+	var driver, halteVisitHistory, closureReason, busNumber, plateNumber sql.NullString
+	dest := []any{
+		&lap.ID,
+		&lap.BusID,
+		&lap.IMEI,
+		&lap.LapNumber,
+		&serviceDate,
+		&lap.DailyLapNumber,
+		&lap.StartTime,
+		&endTime,
+		&lap.RouteColor,
+		&driver,
+		&halteVisitHistory,
+		&closureReason,
+		&lap.Anomalies,
+		&voidedAt,
+		&correctedAt,
+		&lap.CreatedAt,
+		&lap.UpdatedAt,
+	}
+	if withBus {
+		dest = append(dest, &lap.VehicleNo, &busNumber, &plateNumber, &lap.IsActive, &lap.Color)
+	}
+	dest = append(dest, extra...)
+	if err = row.Scan(dest...); err != nil {
+		return
 	}
 
 	if endTime.Valid {
-		created.EndTime = &endTime.Time
+		lap.EndTime = &endTime.Time
+	}
+	if voidedAt.Valid {
+		lap.VoidedAt = &voidedAt.Time
 	}
+	if correctedAt.Valid {
+		lap.Corrected = true
+		lap.CorrectedAt = &correctedAt.Time
+	}
+	lap.ServiceDate = serviceDate.Format("2006-01-02")
+	lap.Driver = driver.String
+	lap.HalteVisitHistory = halteVisitHistory.String
+	lap.ClosureReason = closureReason.String
+	lap.BusNumber = busNumber.String
+	lap.PlateNumber = plateNumber.String
+	if lap.Anomalies == nil {
+		lap.Anomalies = make([]string, 0)
+	}
+	return
+}
 
-	if halteVisitHistory.Valid {
-		created.HalteVisitHistory = halteVisitHistory.String
+// scanLapHistoryWithVisits scans the lapHistoryColumns of a row followed by the bus columns when withBus is set
+// and the lapHalteVisitsJSON of the lap, as selected by lapHistoryWithVisitsQuery
+func scanLapHistoryWithVisits(row pgx.Row, withBus bool) (models.BusLapHistory, error) {
+	var visits []byte
+	lap, err := scanLapHistory(row, withBus, &visits)
+	if err != nil {
+		return lap, err
+	}
+	if err := json.Unmarshal(visits, &lap.HalteVisits); err != nil {
+		return lap, fmt.Errorf("unable to decode halte visits of lap %d: %w", lap.ID, err)
 	}
+	return lap, nil
+}
+
+// queryLapHistories runs a query selecting lapHistoryWithVisitsQuery and releases its connection before returning
+func (r *repository) queryLapHistories(ctx context.Context, query string, args ...any) ([]models.BusLapHistory, error) {
+	rows, err := r.db.Query(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("unable to get lap history: %w", err)
+	}
+	defer rows.Close()
+
+	// Initialize empty slice to avoid null response
+	laps := make([]models.BusLapHistory, 0)
+	for rows.Next() {
+		lap, err := scanLapHistoryWithVisits(rows, true)
+		if err != nil {
+			return nil, fmt.Errorf("unable to scan lap history: %w", err)
+		}
+		laps = append(laps, lap)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("unable to read lap history: %w", err)
+	}
+	return laps, nil
+}
+
+// CreateLapHistory inserts a lap with the next lifetime and daily lap number of its bus, the operating day
+// follows Jakarta time. An advisory lock on the bus serializes concurrent starts so numbers are never reused,
+// not even the numbers of voided laps.
+// The LapNumber and DailyLapNumber of lapHistory are ignored.
+func (r *repository) CreateLapHistory(ctx context.Context, lapHistory *models.BusLapHistory) (*models.BusLapHistory, error) {
+	tx, err := r.db.Begin(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("unable to begin transaction: %w", err)
+	}
+	defer func() {
+		_ = tx.Rollback(ctx)
+	}()
+
+	created, err := insertLapHistory(ctx, tx, lapHistory)
+	if err != nil {
+		return nil, err
+	}
+	for _, visit := range lapHistory.HalteVisits {
+		if err := insertLapHalteVisit(ctx, tx, created.ID, visit); err != nil {
+			return nil, err
+		}
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return nil, fmt.Errorf("unable to commit lap history: %w", err)
+	}
+	created.HalteVisits = append(make([]models.LapHalteVisit, 0, len(lapHistory.HalteVisits)), lapHistory.HalteVisits...)
 
 	return &created, nil
 }
 
+// insertLapHistory inserts a lap without its visits as described by CreateLapHistory
+func insertLapHistory(ctx context.Context, tx pgx.Tx, lapHistory *models.BusLapHistory) (models.BusLapHistory, error) {
+	if _, err := tx.Exec(ctx, `SELECT pg_advisory_xact_lock(hashtext('bus_lap_history'), $1)`, lapHistory.BusID); err != nil {
+		return models.BusLapHistory{}, fmt.Errorf("unable to lock lap numbers: %w", err)
+	}
+
+	created, err := scanLapHistory(tx.QueryRow(
+		ctx,
+		`INSERT INTO bus_lap_history AS blh (bus_id, imei, lap_number, service_date, daily_lap_number, start_time, route_color, halte_visit_history, driver) 
+		 SELECT $1, $2,
+		        COALESCE(MAX(lap_number), 0) + 1,
+		        ($3::timestamptz AT TIME ZONE 'Asia/Jakarta')::DATE,
+		        COALESCE(MAX(daily_lap_number) FILTER (WHERE service_date = ($3::timestamptz AT TIME ZONE 'Asia/Jakarta')::DATE), 0) + 1,
+		        $3, $4, $5, $6
+		 FROM bus_lap_history
+		 WHERE bus_id = $1
+		 RETURNING `+lapHistoryColumns,
+		lapHistory.BusID,
+		lapHistory.IMEI,
+		lapHistory.StartTime,
+		lapHistory.RouteColor,
+		lapHistory.HalteVisitHistory,
+		nullIfEmpty(lapHistory.Driver),
+	), false)
+	if err != nil {
+		return created, fmt.Errorf("unable to create lap history: %w", err)
+	}
+	return created, nil
+}
+
 func (r *repository) UpdateLapHistory(ctx context.Context, id int, endTime interface{}) (*models.BusLapHistory, error) {
-	row := r.db.QueryRow(
+	updated, err := scanLapHistoryWithVisits(r.db.QueryRow(
 		ctx,
-		`UPDATE bus_lap_history SET end_time = $1, updated_at = now() 
+		`UPDATE bus_lap_history blh SET end_time = $1, updated_at = now() 
 		 WHERE id = $2 
-		 RETURNING id, bus_id, imei, lap_number, start_time, end_time, route_color, halte_visit_history, created_at, updated_at`,
+		 RETURNING `+lapHistoryColumns+`, `+lapHalteVisitsJSON,
 		endTime,
 		id,
-	)
-
-	var updated models.BusLapHistory
-	var endTimeNull sql.NullTime
-	var halteVisitHistory sql.NullString
-	err := row.Scan(
-		&updated.ID,
-		&updated.BusID,
-		&updated.IMEI,
-		&updated.LapNumber,
-		&updated.StartTime,
-		&endTimeNull,
-		&updated.RouteColor,
-		&halteVisitHistory,
-		&updated.CreatedAt,
-		&updated.UpdatedAt,
-	)
+	), false)
 	if err != nil {
 		return nil, fmt.Errorf("unable to update lap history: %w", err)
 	}
 
-	if endTimeNull.Valid {
-		updated.EndTime = &endTimeNull.Time
-	}
-
-	if halteVisitHistory.Valid {
-		updated.HalteVisitHistory = halteVisitHistory.String
-	}
-
 	return &updated, nil
 }
 
-func (r *repository) UpdateLapHistoryWithColor(ctx context.Context, id int, endTime interface{}, routeColor string) (*models.BusLapHistory, error) {
-	row := r.db.QueryRow(
+// CloseLapHistory ends a lap with the route color it was driven on and the reason it was closed
+func (r *repository) CloseLapHistory(ctx context.Context, id int, endTime time.Time, routeColor string, closureReason string) (*models.BusLapHistory, error) {
+	updated, err := scanLapHistoryWithVisits(r.db.QueryRow(
 		ctx,
-		`UPDATE bus_lap_history SET end_time = $1, route_color = $2, updated_at = now() 
-		 WHERE id = $3 
-		 RETURNING id, bus_id, imei, lap_number, start_time, end_time, route_color, halte_visit_history, created_at, updated_at`,
+		`UPDATE bus_lap_history blh SET end_time = $1, route_color = $2, closure_reason = $3, updated_at = now() 
+		 WHERE id = $4 
+		 RETURNING `+lapHistoryColumns+`, `+lapHalteVisitsJSON,
 		endTime,
 		routeColor,
+		closureReason,
 		id,
-	)
+	), false)
+	if err != nil {
+		return nil, fmt.Errorf("unable to close lap history: %w", err)
+	}
 
-	var updated models.BusLapHistory
-	var endTimeNull sql.NullTime
-	var halteVisitHistory sql.NullString
-	err := row.Scan(
-		&updated.ID,
-		&updated.BusID,
-		&updated.IMEI,
-		&updated.LapNumber,
-		&updated.StartTime,
-		&endTimeNull,
-		&updated.RouteColor,
-		&halteVisitHistory,
-		&updated.CreatedAt,
-		&updated.UpdatedAt,
+	return &updated, nil
+}
+
+func (r *repository) SetLapAnomalies(ctx context.Context, id int, anomalies []string) error {
+	if anomalies == nil {
+		anomalies = make([]string, 0)
+	}
+	_, err := r.db.Exec(
+		ctx,
+		`UPDATE bus_lap_history SET anomalies = $1, updated_at = now() WHERE id = $2`,
+		anomalies,
+		id,
 	)
 	if err != nil {
-		return nil, fmt.Errorf("unable to update lap history with color: %w", err)
+		return fmt.Errorf("unable to set lap anomalies: %w", err)
 	}
+	return nil
+}
 
-	if endTimeNull.Valid {
-		updated.EndTime = &endTimeNull.Time
+func insertLapHalteVisit(ctx context.Context, tx pgx.Tx, lapId int, visit models.LapHalteVisit) error {
+	_, err := tx.Exec(
+		ctx,
+		`INSERT INTO lap_halte_visit (lap_id, sequence, halte, arrived_at, departed_at)
+		 VALUES ($1, $2, $3, $4, $5)`,
+		lapId,
+		visit.Sequence,
+		visit.Halte,
+		visit.ArrivedAt,
+		visit.DepartedAt,
+	)
+	if err != nil {
+		return fmt.Errorf("unable to insert lap halte visit: %w", err)
 	}
+	return nil
+}
 
-	if halteVisitHistory.Valid {
-		updated.HalteVisitHistory = halteVisitHistory.String
+// AddHalteVisitToActiveLap appends a visit to the active lap of a bus unless its last visit already is to halteName.
+// The sequence is computed and the legacy halte_visit_history string appended to in the same statement.
+func (r *repository) AddHalteVisitToActiveLap(ctx context.Context, imei string, halteName string, arrivedAt time.Time) error {
+	_, err := r.db.Exec(
+		ctx,
+		`WITH lap AS (
+			SELECT id FROM bus_lap_history
+			WHERE imei = $1 AND end_time IS NULL
+			ORDER BY start_time DESC
+			LIMIT 1
+		 ), last_visit AS (
+			SELECT lhv.sequence, lhv.halte FROM lap_halte_visit lhv
+			JOIN lap ON lap.id = lhv.lap_id
+			ORDER BY lhv.sequence DESC
+			LIMIT 1
+		 ), visit AS (
+			INSERT INTO lap_halte_visit (lap_id, sequence, halte, arrived_at)
+			SELECT lap.id, COALESCE((SELECT sequence FROM last_visit), 0) + 1, $2, $3
+			FROM lap
+			WHERE (SELECT halte FROM last_visit) IS DISTINCT FROM $2
+			RETURNING lap_id
+		 )
+		 UPDATE bus_lap_history blh
+		 SET halte_visit_history = CASE
+				WHEN COALESCE(blh.halte_visit_history, '') = '' THEN $4
+				ELSE blh.halte_visit_history || ' -> ' || $4
+			END,
+			updated_at = now()
+		 FROM visit
+		 WHERE blh.id = visit.lap_id`,
+		imei,
+		halteName,
+		arrivedAt,
+		FormatHalteVisit(models.LapHalteVisit{Halte: halteName, ArrivedAt: arrivedAt}),
+	)
+	if err != nil {
+		return fmt.Errorf("unable to add halte visit to active lap: %w", err)
 	}
-
-	return &updated, nil
+	return nil
 }
 
-func (r *repository) UpdateLapHistoryHalteVisits(ctx context.Context, id int, halteVisitHistory string) error {
+// SetLapHalteVisitDeparture sets the departure time of the last visit of a lap when it is a visit to the given halte
+func (r *repository) SetLapHalteVisitDeparture(ctx context.Context, lapId int, halteName string, departedAt time.Time) error {
 	_, err := r.db.Exec(
 		ctx,
-		`UPDATE bus_lap_history SET halte_visit_history = $1, updated_at = now() 
-		 WHERE id = $2`,
-		halteVisitHistory,
-		id,
+		`UPDATE lap_halte_visit SET departed_at = $3
+		 WHERE lap_id = $1 AND halte = $2
+		   AND sequence = (SELECT MAX(sequence) FROM lap_halte_visit WHERE lap_id = $1)`,
+		lapId,
+		halteName,
+		departedAt,
 	)
 	if err != nil {
-		return fmt.Errorf("unable to update lap history halte visits: %w", err)
+		return fmt.Errorf("unable to set lap halte visit departure: %w", err)
 	}
 	return nil
 }
 
 func (r *repository) GetActiveLapByImei(ctx context.Context, imei string) (*models.BusLapHistory, error) {
-	row := r.db.QueryRow(
+	laps, err := r.queryLapHistories(
 		ctx,
-		`SELECT blh.id, blh.bus_id, blh.imei, blh.lap_number, blh.start_time, blh.end_time, blh.route_color, blh.halte_visit_history, blh.created_at, blh.updated_at,
-		        b.vehicle_no, b.bus_number, b.plate_number, b.is_active, b.color
-		 FROM bus_lap_history blh 
-		 JOIN bus b ON blh.bus_id = b.id
+		lapHistoryWithVisitsQuery+`
 		 WHERE blh.imei = $1 AND blh.end_time IS NULL 
 		 ORDER BY blh.start_time DESC 
 		 LIMIT 1`,
 		imei,
 	)
-
-	var lap models.BusLapHistory
-	var endTime sql.NullTime
-	var halteVisitHistory, busNumber, plateNumber sql.NullString
-	err := row.Scan(
-		&lap.ID,
-		&lap.BusID,
-		&lap.IMEI,
-		&lap.LapNumber,
-		&lap.StartTime,
-		&endTime,
-		&lap.RouteColor,
-		&halteVisitHistory,
-		&lap.CreatedAt,
-		&lap.UpdatedAt,
-		&lap.VehicleNo,
-		&busNumber,
-		&plateNumber,
-		&lap.IsActive,
-		&lap.Color,
-	)
 	if err != nil {
-		if err == pgx.ErrNoRows {
-			return nil, nil // No active lap found
-		}
 		return nil, fmt.Errorf("unable to get active lap: %w", err)
 	}
+	if len(laps) == 0 {
+		return nil, nil // No active lap found
+	}
+	return &laps[0], nil
+}
 
-	if endTime.Valid {
-		lap.EndTime = &endTime.Time
+// GetOpenLaps returns every lap without an end time, oldest first
+func (r *repository) GetOpenLaps(ctx context.Context) ([]models.BusLapHistory, error) {
+	return r.queryLapHistories(ctx, lapHistoryWithVisitsQuery+`
+		 WHERE blh.end_time IS NULL
+		 ORDER BY blh.start_time`)
+}
+
+func (r *repository) GetLapHistoryByImei(ctx context.Context, imei string) ([]models.BusLapHistory, error) {
+	return r.queryLapHistories(
+		ctx,
+		lapHistoryWithVisitsQuery+`
+		 WHERE blh.imei = $1 AND blh.voided_at IS NULL
+		 ORDER BY blh.start_time DESC`,
+		imei,
+	)
+}
+
+// lapHistoryFilterSQL turns a filter into " AND ..." conditions on bus_lap_history blh, numbering
+// placeholders from $1. Pagination fields are left to the caller.
+func lapHistoryFilterSQL(filter dto.LapHistoryFilter) (conditions string, args []any, err error) {
+	add := func(condition string, arg any) {
+		args = append(args, arg)
+		conditions += " AND " + fmt.Sprintf(condition, len(args))
 	}
 
-	if halteVisitHistory.Valid {
-		lap.HalteVisitHistory = halteVisitHistory.String
+	if filter.IMEI != nil {
+		add("blh.imei = $%d", *filter.IMEI)
+	}
+	if filter.BusID != nil {
+		add("blh.bus_id = $%d", *filter.BusID)
+	}
+	if filter.RouteColor != nil {
+		add("blh.route_color = $%d", *filter.RouteColor)
+	}
+	if filter.Driver != nil {
+		add("blh.driver = $%d", *filter.Driver)
 	}
+	if filter.FromDate != nil {
+		add("blh.start_time >= $%d", *filter.FromDate)
+	}
+	if filter.ToDate != nil {
+		add("blh.start_time <= $%d", *filter.ToDate)
+	}
+	if filter.StartTime != nil {
+		// Convert HH:MM to minutes since midnight
+		startMinutes, minutesErr := timeStringToMinutes(*filter.StartTime)
+		if minutesErr != nil {
+			return "", nil, fmt.Errorf("invalid start_time format: %w", minutesErr)
+		}
+		add("EXTRACT(HOUR FROM blh.start_time) * 60 + EXTRACT(MINUTE FROM blh.start_time) >= $%d", startMinutes)
+	}
+	if filter.EndTime != nil {
+		endMinutes, minutesErr := timeStringToMinutes(*filter.EndTime)
+		if minutesErr != nil {
+			return "", nil, fmt.Errorf("invalid end_time format: %w", minutesErr)
+		}
+		add("EXTRACT(HOUR FROM blh.start_time) * 60 + EXTRACT(MINUTE FROM blh.start_time) <= $%d", endMinutes)
+	}
+	if filter.ClosureReason != nil {
+		add("blh.closure_reason = $%d", *filter.ClosureReason)
+	}
+	if filter.Anomaly != nil {
+		add("$%d = ANY(blh.anomalies)", *filter.Anomaly)
+	}
+	if !filter.IncludeVoided {
+		conditions += " AND blh.voided_at IS NULL"
+	}
+	if filter.Anomalous != nil {
+		if *filter.Anomalous {
+			conditions += " AND cardinality(blh.anomalies) > 0"
+		} else {
+			conditions += " AND cardinality(blh.anomalies) = 0"
+		}
+	}
+	return
+}
 
-	if busNumber.Valid {
-		lap.BusNumber = busNumber.String
+func (r *repository) GetFilteredLapHistory(ctx context.Context, filter dto.LapHistoryFilter) ([]models.BusLapHistory, error) {
+	conditions, args, err := lapHistoryFilterSQL(filter)
+	if err != nil {
+		return nil, err
 	}
+	query := lapHistoryWithVisitsQuery + " WHERE 1=1" + conditions + " ORDER BY blh.start_time DESC"
+	query, args = lapHistoryPaginationSQL(filter, query, args)
 
-	if plateNumber.Valid {
-		lap.PlateNumber = plateNumber.String
+	laps, err := r.queryLapHistories(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("unable to get filtered lap history: %w", err)
 	}
+	return laps, nil
+}
 
-	return &lap, nil
+// lapHistoryPaginationSQL appends the limit and offset of filter to query
+func lapHistoryPaginationSQL(filter dto.LapHistoryFilter, query string, args []any) (string, []any) {
+	if filter.Limit != nil {
+		args = append(args, *filter.Limit)
+		query += fmt.Sprintf(" LIMIT $%d", len(args))
+	}
+	if filter.Offset != nil {
+		args = append(args, *filter.Offset)
+		query += fmt.Sprintf(" OFFSET $%d", len(args))
+	}
+	return query, args
 }
 
-func (r *repository) GetLapHistoryByImei(ctx context.Context, imei string) ([]models.BusLapHistory, error) {
-	rows, err := r.db.Query(
-		ctx,
-		`SELECT blh.id, blh.bus_id, blh.imei, blh.lap_number, blh.start_time, blh.end_time, blh.route_color, blh.halte_visit_history, blh.created_at, blh.updated_at,
-		        b.vehicle_no, b.bus_number, b.plate_number, b.is_active, b.color
-		 FROM bus_lap_history blh 
-		 JOIN bus b ON blh.bus_id = b.id
-		 WHERE blh.imei = $1 
-		 ORDER BY blh.start_time DESC`,
-		imei,
-	)
+// Laps read per query by StreamFilteredLapHistory
+const lapHistoryStreamPageSize = 500
+
+// StreamFilteredLapHistory calls fn with every lap matching filter, newest first and with its halte visits.
+// Laps are read in pages of lapHistoryStreamPageSize and every page is released before fn sees it, so a slow
+// consumer never holds a pool connection. An error returned by fn stops the stream and is returned as is.
+func (r *repository) StreamFilteredLapHistory(ctx context.Context, filter dto.LapHistoryFilter, fn func(lap models.BusLapHistory) error) error {
+	conditions, args, err := lapHistoryFilterSQL(filter)
 	if err != nil {
-		return nil, fmt.Errorf("unable to get lap history: %w", err)
+		return err
 	}
-	defer rows.Close()
-
-	var laps []models.BusLapHistory
-	// Initialize empty slice to avoid null response
-	laps = make([]models.BusLapHistory, 0)
 
-	for rows.Next() {
-		var lap models.BusLapHistory
-		var endTime sql.NullTime
-		var halteVisitHistory, busNumber, plateNumber sql.NullString
-		err := rows.Scan(
-			&lap.ID,
-			&lap.BusID,
-			&lap.IMEI,
-			&lap.LapNumber,
-			&lap.StartTime,
-			&endTime,
-			&lap.RouteColor,
-			&halteVisitHistory,
-			&lap.CreatedAt,
-			&lap.UpdatedAt,
-			&lap.VehicleNo,
-			&busNumber,
-			&plateNumber,
-			&lap.IsActive,
-			&lap.Color,
-		)
-		if err != nil {
-			return nil, fmt.Errorf("unable to scan lap history: %w", err)
+	remaining := -1
+	if filter.Limit != nil {
+		remaining = *filter.Limit
+	}
+	var last *models.BusLapHistory
+	for remaining != 0 {
+		pageSize := lapHistoryStreamPageSize
+		if remaining > 0 && remaining < pageSize {
+			pageSize = remaining
 		}
-
-		if endTime.Valid {
-			lap.EndTime = &endTime.Time
+		pageArgs := append([]any(nil), args...)
+		query := lapHistoryWithVisitsQuery + " WHERE 1=1" + conditions
+		if last != nil {
+			// Continue after the last lap of the previous page, the order is (start_time, id) descending
+			pageArgs = append(pageArgs, last.StartTime, last.ID)
+			query += fmt.Sprintf(" AND (blh.start_time, blh.id) < ($%d, $%d)", len(pageArgs)-1, len(pageArgs))
 		}
-
-		if halteVisitHistory.Valid {
-			lap.HalteVisitHistory = halteVisitHistory.String
+		pageArgs = append(pageArgs, pageSize)
+		query += fmt.Sprintf(" ORDER BY blh.start_time DESC, blh.id DESC LIMIT $%d", len(pageArgs))
+		if last == nil && filter.Offset != nil {
+			pageArgs = append(pageArgs, *filter.Offset)
+			query += fmt.Sprintf(" OFFSET $%d", len(pageArgs))
 		}
 
-		if busNumber.Valid {
-			lap.BusNumber = busNumber.String
+		page, err := r.queryLapHistories(ctx, query, pageArgs...)
+		if err != nil {
+			return err
 		}
-
-		if plateNumber.Valid {
-			lap.PlateNumber = plateNumber.String
+		for _, lap := range page {
+			if err := fn(lap); err != nil {
+				return err
+			}
+		}
+		if len(page) < pageSize {
+			return nil
+		}
+		last = &page[len(page)-1]
+		if remaining > 0 {
+			remaining -= len(page)
 		}
-
-		laps = append(laps, lap)
 	}
-
-	return laps, nil
+	return nil
 }
 
-func (r *repository) GetFilteredLapHistory(ctx context.Context, filter dto.LapHistoryFilter) ([]models.BusLapHistory, error) {
-	query := `SELECT blh.id, blh.bus_id, blh.imei, blh.lap_number, blh.start_time, blh.end_time, blh.route_color, blh.halte_visit_history, blh.created_at, blh.updated_at,
-			         b.vehicle_no, b.bus_number, b.plate_number, b.is_active, b.color
+func (r *repository) GetFilteredLapHistoryCount(ctx context.Context, filter dto.LapHistoryFilter) (int, error) {
+	conditions, args, err := lapHistoryFilterSQL(filter)
+	if err != nil {
+		return 0, err
+	}
+	query := `SELECT COUNT(*) 
 			  FROM bus_lap_history blh 
 			  JOIN bus b ON blh.bus_id = b.id 
-			  WHERE 1=1`
+			  WHERE 1=1` + conditions
 
-	var args []interface{}
-	argIndex := 1
-
-	// Add filters dynamically
-	if filter.IMEI != nil {
-		query += fmt.Sprintf(" AND blh.imei = $%d", argIndex)
-		args = append(args, *filter.IMEI)
-		argIndex++
+	var count int
+	if err := r.db.QueryRow(ctx, query, args...).Scan(&count); err != nil {
+		return 0, fmt.Errorf("unable to get filtered lap history count: %w", err)
 	}
 
-	if filter.BusID != nil {
-		query += fmt.Sprintf(" AND blh.bus_id = $%d", argIndex)
-		args = append(args, *filter.BusID)
-		argIndex++
-	}
+	return count, nil
+}
 
-	if filter.RouteColor != nil {
-		query += fmt.Sprintf(" AND blh.route_color = $%d", argIndex)
-		args = append(args, *filter.RouteColor)
-		argIndex++
-	}
+// Lap corrections
 
-	if filter.FromDate != nil {
-		query += fmt.Sprintf(" AND blh.start_time >= $%d", argIndex)
-		args = append(args, *filter.FromDate)
-		argIndex++
+// getLapForCorrection locks a lap for the rest of tx and loads it with its visits, nil when it does not exist
+func getLapForCorrection(ctx context.Context, tx pgx.Tx, id int) (*models.BusLapHistory, error) {
+	if _, err := tx.Exec(ctx, `SELECT id FROM bus_lap_history WHERE id = $1 FOR UPDATE`, id); err != nil {
+		return nil, fmt.Errorf("unable to lock lap %d: %w", id, err)
+	}
+	lap, err := scanLapHistoryWithVisits(tx.QueryRow(ctx, lapHistoryWithVisitsQuery+` WHERE blh.id = $1`, id), true)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to get lap %d: %w", id, err)
 	}
+	return &lap, nil
+}
 
-	if filter.ToDate != nil {
-		query += fmt.Sprintf(" AND blh.start_time <= $%d", argIndex)
-		args = append(args, *filter.ToDate)
-		argIndex++
+// CorrectLaps locks and loads the laps with the given ids, has correct work out what the correction does to them
+// and applies it in one transaction. correct can count the laps started between two laps inside the transaction.
+// The laps after the correction replace the stored ones with their visits, new laps get the next numbers of their bus
+// and every lap involved is marked as corrected. Lap numbers never change. correction is recorded with snapshots
+// of the laps before and after it, its LapID, Action, CorrectedBy and Reason are set by the caller.
+func (r *repository) CorrectLaps(ctx context.Context, correction models.LapCorrection, lapIds []int, correct func(laps []models.BusLapHistory, lapsBetween dto.LapsBetweenFunc) (dto.LapCorrectionChange, error)) (*models.LapCorrection, error) {
+	tx, err := r.db.Begin(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("unable to begin transaction: %w", err)
 	}
+	defer func() {
+		_ = tx.Rollback(ctx)
+	}()
 
-	if filter.StartTime != nil {
-		query += fmt.Sprintf(" AND EXTRACT(HOUR FROM blh.start_time) * 60 + EXTRACT(MINUTE FROM blh.start_time) >= $%d", argIndex)
-		// Convert HH:MM to minutes since midnight
-		startMinutes, err := timeStringToMinutes(*filter.StartTime)
+	before := make([]models.BusLapHistory, 0, len(lapIds))
+	for _, id := range lapIds {
+		lap, err := getLapForCorrection(ctx, tx, id)
 		if err != nil {
-			return nil, fmt.Errorf("invalid start_time format: %w", err)
+			return nil, err
+		}
+		if lap == nil {
+			return nil, fmt.Errorf("%w: %d", ErrLapNotFound, id)
 		}
-		args = append(args, startMinutes)
-		argIndex++
+		before = append(before, *lap)
+	}
+	laps := make([]models.BusLapHistory, len(before))
+	for i, lap := range before {
+		lap.HalteVisits = slices.Clone(lap.HalteVisits)
+		laps[i] = lap
+	}
+	change, err := correct(laps, func(earlier models.BusLapHistory, later models.BusLapHistory) (int, error) {
+		return lapsStartedBetween(ctx, tx, earlier, later)
+	})
+	if err != nil {
+		return nil, err
 	}
 
-	if filter.EndTime != nil {
-		query += fmt.Sprintf(" AND EXTRACT(HOUR FROM blh.start_time) * 60 + EXTRACT(MINUTE FROM blh.start_time) <= $%d", argIndex)
-		// Convert HH:MM to minutes since midnight
-		endMinutes, err := timeStringToMinutes(*filter.EndTime)
+	// Visits are written again from the laps after the correction
+	if _, err := tx.Exec(ctx, `DELETE FROM lap_halte_visit WHERE lap_id = ANY($1)`, lapIds); err != nil {
+		return nil, fmt.Errorf("unable to clear halte visits of corrected laps: %w", err)
+	}
+	ids := make([]int, 0, len(change.After))
+	for _, lap := range change.After {
+		if lap.ID == 0 {
+			created, err := insertLapHistory(ctx, tx, &lap)
+			if err != nil {
+				return nil, err
+			}
+			lap.ID = created.ID
+			if change.RelatedLapID == nil {
+				change.RelatedLapID = &created.ID
+			}
+		}
+		if err := updateCorrectedLap(ctx, tx, lap); err != nil {
+			return nil, err
+		}
+		for _, visit := range lap.HalteVisits {
+			if err := insertLapHalteVisit(ctx, tx, lap.ID, visit); err != nil {
+				return nil, err
+			}
+		}
+		ids = append(ids, lap.ID)
+	}
+
+	after := make([]models.BusLapHistory, 0, len(ids))
+	for _, id := range ids {
+		corrected, err := getLapForCorrection(ctx, tx, id)
 		if err != nil {
-			return nil, fmt.Errorf("invalid end_time format: %w", err)
+			return nil, err
 		}
-		args = append(args, endMinutes)
-		argIndex++
+		after = append(after, *corrected)
 	}
 
-	// Add ordering
-	query += " ORDER BY blh.start_time DESC"
+	correction.RelatedLapID = change.RelatedLapID
+	correction.Before = before
+	correction.After = after
+	beforeJSON, err := json.Marshal(before)
+	if err != nil {
+		return nil, fmt.Errorf("unable to encode laps before correction: %w", err)
+	}
+	afterJSON, err := json.Marshal(after)
+	if err != nil {
+		return nil, fmt.Errorf("unable to encode laps after correction: %w", err)
+	}
+	err = tx.QueryRow(
+		ctx,
+		`INSERT INTO lap_correction (lap_id, related_lap_id, action, corrected_by, reason, before, after)
+		 VALUES ($1, $2, $3, $4, $5, $6, $7)
+		 RETURNING id, created_at`,
+		correction.LapID,
+		correction.RelatedLapID,
+		correction.Action,
+		correction.CorrectedBy,
+		correction.Reason,
+		string(beforeJSON),
+		string(afterJSON),
+	).Scan(&correction.ID, &correction.CreatedAt)
+	if err != nil {
+		return nil, fmt.Errorf("unable to record lap correction: %w", err)
+	}
 
-	// Add limit and offset
-	if filter.Limit != nil {
-		query += fmt.Sprintf(" LIMIT $%d", argIndex)
-		args = append(args, *filter.Limit)
-		argIndex++
+	if err := tx.Commit(ctx); err != nil {
+		return nil, fmt.Errorf("unable to commit lap correction: %w", err)
 	}
+	return &correction, nil
+}
 
-	if filter.Offset != nil {
-		query += fmt.Sprintf(" OFFSET $%d", argIndex)
-		args = append(args, *filter.Offset)
+// updateCorrectedLap stores the corrected fields of a lap and marks it as corrected
+func updateCorrectedLap(ctx context.Context, tx pgx.Tx, lap models.BusLapHistory) error {
+	anomalies := lap.Anomalies
+	if anomalies == nil {
+		anomalies = make([]string, 0)
+	}
+	_, err := tx.Exec(
+		ctx,
+		`UPDATE bus_lap_history
+		 SET start_time = $2, end_time = $3, route_color = $4, closure_reason = $5, anomalies = $6,
+		     halte_visit_history = $7, voided_at = $8, corrected_at = now(), updated_at = now()
+		 WHERE id = $1`,
+		lap.ID,
+		lap.StartTime,
+		lap.EndTime,
+		lap.RouteColor,
+		nullIfEmpty(lap.ClosureReason),
+		anomalies,
+		lap.HalteVisitHistory,
+		lap.VoidedAt,
+	)
+	if err != nil {
+		return fmt.Errorf("unable to correct lap %d: %w", lap.ID, err)
 	}
+	return nil
+}
 
-	rows, err := r.db.Query(ctx, query, args...)
+// lapsStartedBetween counts the laps of the bus of earlier that are not voided and started between earlier and later
+func lapsStartedBetween(ctx context.Context, tx pgx.Tx, earlier models.BusLapHistory, later models.BusLapHistory) (int, error) {
+	var count int
+	err := tx.QueryRow(
+		ctx,
+		`SELECT COUNT(*) FROM bus_lap_history
+		 WHERE bus_id = $1 AND voided_at IS NULL AND id <> $2 AND id <> $3
+		   AND start_time BETWEEN $4 AND $5`,
+		earlier.BusID,
+		earlier.ID,
+		later.ID,
+		earlier.StartTime,
+		later.StartTime,
+	).Scan(&count)
 	if err != nil {
-		return nil, fmt.Errorf("unable to get filtered lap history: %w", err)
+		return 0, fmt.Errorf("unable to count laps between laps %d and %d: %w", earlier.ID, later.ID, err)
 	}
-	defer rows.Close()
+	return count, nil
+}
 
-	var laps []models.BusLapHistory
-	// Initialize empty slice to avoid null response
-	laps = make([]models.BusLapHistory, 0)
+// GetLapCorrections returns the corrections involving a lap, oldest first
+func (r *repository) GetLapCorrections(ctx context.Context, lapId int) ([]models.LapCorrection, error) {
+	rows, err := r.db.Query(
+		ctx,
+		`SELECT id, lap_id, related_lap_id, action, corrected_by, reason, before, after, created_at
+		 FROM lap_correction
+		 WHERE lap_id = $1 OR related_lap_id = $1
+		 ORDER BY created_at, id`,
+		lapId,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("unable to get lap corrections: %w", err)
+	}
+	defer rows.Close()
 
+	corrections := make([]models.LapCorrection, 0)
 	for rows.Next() {
-		var lap models.BusLapHistory
-		var endTime sql.NullTime
-		var halteVisitHistory, busNumber, plateNumber sql.NullString
-		err := rows.Scan(
-			&lap.ID,
-			&lap.BusID,
-			&lap.IMEI,
-			&lap.LapNumber,
-			&lap.StartTime,
-			&endTime,
-			&lap.RouteColor,
-			&halteVisitHistory,
-			&lap.CreatedAt,
-			&lap.UpdatedAt,
-			&lap.VehicleNo,
-			&busNumber,
-			&plateNumber,
-			&lap.IsActive,
-			&lap.Color,
-		)
-		if err != nil {
-			return nil, fmt.Errorf("unable to scan filtered lap history: %w", err)
+		var correction models.LapCorrection
+		var before, after []byte
+		if err := rows.Scan(
+			&correction.ID,
+			&correction.LapID,
+			&correction.RelatedLapID,
+			&correction.Action,
+			&correction.CorrectedBy,
+			&correction.Reason,
+			&before,
+			&after,
+			&correction.CreatedAt,
+		); err != nil {
+			return nil, fmt.Errorf("unable to scan lap correction: %w", err)
 		}
-
-		if endTime.Valid {
-			lap.EndTime = &endTime.Time
+		if err := json.Unmarshal(before, &correction.Before); err != nil {
+			return nil, fmt.Errorf("unable to decode lap correction %d: %w", correction.ID, err)
 		}
-
-		if halteVisitHistory.Valid {
-			lap.HalteVisitHistory = halteVisitHistory.String
+		if err := json.Unmarshal(after, &correction.After); err != nil {
+			return nil, fmt.Errorf("unable to decode lap correction %d: %w", correction.ID, err)
 		}
+		corrections = append(corrections, correction)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("unable to read lap corrections: %w", err)
+	}
+	return corrections, nil
+}
 
-		if busNumber.Valid {
-			lap.BusNumber = busNumber.String
-		}
+// Driver attribution
 
-		if plateNumber.Valid {
-			lap.PlateNumber = plateNumber.String
+// RecordDriverChange stores that a bus reported another driver, previousDriver is empty for the first driver seen
+func (r *repository) RecordDriverChange(ctx context.Context, imei string, previousDriver string, driver string, changedAt time.Time) error {
+	_, err := r.db.Exec(
+		ctx,
+		`INSERT INTO bus_driver_change (imei, previous_driver, driver, changed_at) VALUES ($1, $2, $3, $4)`,
+		imei,
+		nullIfEmpty(previousDriver),
+		driver,
+		changedAt,
+	)
+	if err != nil {
+		return fmt.Errorf("unable to record driver change: %w", err)
+	}
+	return nil
+}
+
+// GetCurrentDrivers returns the latest driver of every bus that ever reported one, by imei
+func (r *repository) GetCurrentDrivers(ctx context.Context) (map[string]string, error) {
+	rows, err := r.db.Query(
+		ctx,
+		`SELECT DISTINCT ON (imei) imei, driver
+		 FROM bus_driver_change
+		 ORDER BY imei, changed_at DESC, id DESC`,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("unable to get current drivers: %w", err)
+	}
+	defer rows.Close()
+
+	drivers := make(map[string]string)
+	for rows.Next() {
+		var imei, driver string
+		if err := rows.Scan(&imei, &driver); err != nil {
+			return nil, fmt.Errorf("unable to scan current driver: %w", err)
 		}
+		drivers[imei] = driver
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("unable to read current drivers: %w", err)
+	}
+	return drivers, nil
+}
 
-		laps = append(laps, lap)
+// GetDriverSummaries summarizes every driver seen in [from, to). The fixes of a bus are cut into stretches
+// whenever the driver changes or no fix arrived for longer than dutyGap, hours on duty add up the stretches
+// of a driver. Laps are closed laps that are not voided and started in the range.
+func (r *repository) GetDriverSummaries(ctx context.Context, from time.Time, to time.Time, dutyGap time.Duration) ([]dto.DriverSummary, error) {
+	rows, err := r.db.Query(
+		ctx,
+		`WITH positions AS (
+			SELECT id, imei, driver, device_time,
+			       CASE WHEN LAG(device_time) OVER w IS NULL
+			              OR LAG(driver) OVER w IS DISTINCT FROM driver
+			              OR device_time - LAG(device_time) OVER w > $3::DOUBLE PRECISION * INTERVAL '1 second'
+			            THEN 1 ELSE 0 END AS starts_stretch
+			FROM bus_position
+			WHERE device_time >= $1 AND device_time < $2
+			WINDOW w AS (PARTITION BY imei ORDER BY device_time, id)
+		), stretches AS (
+			SELECT imei, driver, device_time,
+			       SUM(starts_stretch) OVER (PARTITION BY imei ORDER BY device_time, id ROWS UNBOUNDED PRECEDING) AS stretch
+			FROM positions
+		), duty AS (
+			SELECT driver, SUM(seconds) AS seconds
+			FROM (
+				SELECT driver, EXTRACT(EPOCH FROM MAX(device_time) - MIN(device_time)) AS seconds
+				FROM stretches
+				WHERE driver IS NOT NULL
+				GROUP BY imei, stretch, driver
+			) s
+			GROUP BY driver
+		), laps AS (
+			SELECT driver, COUNT(*) AS lap_count, AVG(EXTRACT(EPOCH FROM end_time - start_time)) AS mean_duration
+			FROM bus_lap_history
+			WHERE driver IS NOT NULL AND end_time IS NOT NULL AND voided_at IS NULL
+			  AND start_time >= $1 AND start_time < $2
+			GROUP BY driver
+		)
+		SELECT COALESCE(d.driver, l.driver),
+		       COALESCE(l.lap_count, 0),
+		       COALESCE(d.seconds, 0)::DOUBLE PRECISION / 3600,
+		       COALESCE(l.mean_duration, 0)::DOUBLE PRECISION
+		FROM duty d
+		FULL OUTER JOIN laps l ON l.driver = d.driver
+		ORDER BY 1`,
+		from,
+		to,
+		dutyGap.Seconds(),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("unable to get driver summaries: %w", err)
 	}
+	defer rows.Close()
 
-	return laps, nil
+	summaries := make([]dto.DriverSummary, 0)
+	for rows.Next() {
+		var summary dto.DriverSummary
+		if err := rows.Scan(&summary.Driver, &summary.LapCount, &summary.HoursOnDuty, &summary.MeanLapDurationSeconds); err != nil {
+			return nil, fmt.Errorf("unable to scan driver summary: %w", err)
+		}
+		summaries = append(summaries, summary)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("unable to read driver summaries: %w", err)
+	}
+	return summaries, nil
 }
 
-func (r *repository) GetFilteredLapHistoryCount(ctx context.Context, filter dto.LapHistoryFilter) (int, error) {
-	query := `SELECT COUNT(*) 
-			  FROM bus_lap_history blh 
-			  JOIN bus b ON blh.bus_id = b.id 
-			  WHERE 1=1`
+// Lap statistics can be grouped by any combination of these
+const (
+	LAP_STATS_GROUP_ROUTE_COLOR = "route_color"
+	LAP_STATS_GROUP_BUS         = "bus"
+	LAP_STATS_GROUP_DAY         = "day"
+	LAP_STATS_GROUP_HOUR        = "hour"
+)
 
-	var args []interface{}
-	argIndex := 1
+var lapStatsGroups = []string{LAP_STATS_GROUP_ROUTE_COLOR, LAP_STATS_GROUP_BUS, LAP_STATS_GROUP_DAY, LAP_STATS_GROUP_HOUR}
 
-	// Add the same filters as GetFilteredLapHistory but for count
-	if filter.IMEI != nil {
-		query += fmt.Sprintf(" AND blh.imei = $%d", argIndex)
-		args = append(args, *filter.IMEI)
-		argIndex++
-	}
+// lapStatsGroupColumns are the columns selected, grouped and ordered by for every grouping
+var lapStatsGroupColumns = map[string][]string{
+	LAP_STATS_GROUP_ROUTE_COLOR: {"blh.route_color"},
+	LAP_STATS_GROUP_BUS:         {"blh.bus_id", "blh.imei", "b.bus_number"},
+	LAP_STATS_GROUP_DAY:         {"blh.service_date"},
+	LAP_STATS_GROUP_HOUR:        {"EXTRACT(HOUR FROM blh.start_time AT TIME ZONE 'Asia/Jakarta')::INTEGER"},
+}
 
-	if filter.BusID != nil {
-		query += fmt.Sprintf(" AND blh.bus_id = $%d", argIndex)
-		args = append(args, *filter.BusID)
-		argIndex++
+// GetLapStats aggregates the closed laps matching filter in SQL, grouped by the given groupings in order.
+// Pagination fields of the filter are ignored.
+func (r *repository) GetLapStats(ctx context.Context, filter dto.LapHistoryFilter, groupBy []string) ([]dto.LapStats, error) {
+	conditions, args, err := lapHistoryFilterSQL(filter)
+	if err != nil {
+		return nil, err
 	}
 
-	if filter.RouteColor != nil {
-		query += fmt.Sprintf(" AND blh.route_color = $%d", argIndex)
-		args = append(args, *filter.RouteColor)
-		argIndex++
+	columns := make([]string, 0)
+	for _, group := range groupBy {
+		columns = append(columns, lapStatsGroupColumns[group]...)
 	}
-
-	if filter.FromDate != nil {
-		query += fmt.Sprintf(" AND blh.start_time >= $%d", argIndex)
-		args = append(args, *filter.FromDate)
-		argIndex++
+	selectColumns, groupClause := "", ""
+	if len(columns) > 0 {
+		selectColumns = strings.Join(columns, ", ") + ","
+		groupClause = " GROUP BY " + strings.Join(columns, ", ") + " ORDER BY " + strings.Join(columns, ", ")
 	}
 
-	if filter.ToDate != nil {
-		query += fmt.Sprintf(" AND blh.start_time <= $%d", argIndex)
-		args = append(args, *filter.ToDate)
-		argIndex++
+	query := `SELECT ` + selectColumns + `
+			COUNT(*),
+			COUNT(*) FILTER (WHERE blh.closure_reason = '` + models.LAP_CLOSURE_COMPLETED + `'),
+			COUNT(*) FILTER (WHERE blh.closure_reason IN ('` + models.LAP_CLOSURE_INACTIVITY + `', '` + models.LAP_CLOSURE_MAX_DURATION + `')),
+			AVG(lap.duration),
+			percentile_cont(0.5) WITHIN GROUP (ORDER BY lap.duration),
+			percentile_cont(0.9) WITHIN GROUP (ORDER BY lap.duration)
+		FROM bus_lap_history blh
+		JOIN bus b ON blh.bus_id = b.id
+		CROSS JOIN LATERAL (SELECT EXTRACT(EPOCH FROM blh.end_time - blh.start_time)::DOUBLE PRECISION AS duration) lap
+		WHERE blh.end_time IS NOT NULL` + conditions + groupClause
+
+	rows, err := r.db.Query(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("unable to get lap stats: %w", err)
 	}
+	defer rows.Close()
 
-	if filter.StartTime != nil {
-		query += fmt.Sprintf(" AND EXTRACT(HOUR FROM blh.start_time) * 60 + EXTRACT(MINUTE FROM blh.start_time) >= $%d", argIndex)
-		startMinutes, err := timeStringToMinutes(*filter.StartTime)
-		if err != nil {
-			return 0, fmt.Errorf("invalid start_time format: %w", err)
+	res := make([]dto.LapStats, 0)
+	for rows.Next() {
+		var stats dto.LapStats
+		var serviceDate time.Time
+		var busNumber sql.NullString
+		var mean, median, p90 sql.NullFloat64
+		dest := make([]any, 0)
+		for _, group := range groupBy {
+			switch group {
+			case LAP_STATS_GROUP_ROUTE_COLOR:
+				stats.RouteColor = new(string)
+				dest = append(dest, stats.RouteColor)
+			case LAP_STATS_GROUP_BUS:
+				stats.BusID, stats.IMEI = new(int), new(string)
+				dest = append(dest, stats.BusID, stats.IMEI, &busNumber)
+			case LAP_STATS_GROUP_DAY:
+				dest = append(dest, &serviceDate)
+			case LAP_STATS_GROUP_HOUR:
+				stats.Hour = new(int)
+				dest = append(dest, stats.Hour)
+			}
+		}
+		dest = append(dest, &stats.LapCount, &stats.CompletedCount, &stats.AutoClosedCount, &mean, &median, &p90)
+		if err := rows.Scan(dest...); err != nil {
+			return nil, fmt.Errorf("unable to scan lap stats: %w", err)
 		}
-		args = append(args, startMinutes)
-		argIndex++
-	}
 
-	if filter.EndTime != nil {
-		query += fmt.Sprintf(" AND EXTRACT(HOUR FROM blh.start_time) * 60 + EXTRACT(MINUTE FROM blh.start_time) <= $%d", argIndex)
-		endMinutes, err := timeStringToMinutes(*filter.EndTime)
-		if err != nil {
-			return 0, fmt.Errorf("invalid end_time format: %w", err)
+		if slices.Contains(groupBy, LAP_STATS_GROUP_BUS) {
+			stats.BusNumber = &busNumber.String
 		}
-		args = append(args, endMinutes)
-		argIndex++
+		if slices.Contains(groupBy, LAP_STATS_GROUP_DAY) {
+			day := serviceDate.Format("2006-01-02")
+			stats.ServiceDate = &day
+		}
+		stats.MeanDurationSeconds = mean.Float64
+		stats.MedianDurationSeconds = median.Float64
+		stats.P90DurationSeconds = p90.Float64
+		res = append(res, stats)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("unable to read lap stats: %w", err)
 	}
+	return res, nil
+}
 
-	var count int
-	err := r.db.QueryRow(ctx, query, args...).Scan(&count)
+// GetSegmentTimes computes the median travel time between consecutive stops of the laps started since from,
+// per route color and Jakarta hour, together with the pooled buckets over every color, every hour or both.
+// Samples longer than maxSeconds are skipped, hourly buckets need at least minHourSamples samples.
+func (r *repository) GetSegmentTimes(ctx context.Context, from time.Time, maxSeconds float64, minHourSamples int) ([]dto.SegmentTime, error) {
+	rows, err := r.db.Query(
+		ctx,
+		`WITH segment AS (
+			SELECT blh.route_color AS color,
+				visit.halte AS from_halte,
+				next_visit.halte AS to_halte,
+				EXTRACT(HOUR FROM visit.arrived_at AT TIME ZONE 'Asia/Jakarta')::INTEGER AS hour,
+				EXTRACT(EPOCH FROM next_visit.arrived_at - visit.arrived_at)::DOUBLE PRECISION AS seconds
+			FROM bus_lap_history blh
+			JOIN lap_halte_visit visit ON visit.lap_id = blh.id
+			JOIN lap_halte_visit next_visit ON next_visit.lap_id = visit.lap_id AND next_visit.sequence = visit.sequence + 1
+			WHERE blh.start_time >= $1 AND blh.voided_at IS NULL AND next_visit.halte <> visit.halte
+		)
+		SELECT color, from_halte, to_halte, hour,
+			percentile_cont(0.5) WITHIN GROUP (ORDER BY seconds), COUNT(*)
+		FROM segment
+		WHERE seconds > 0 AND seconds <= $2
+		GROUP BY GROUPING SETS ((color, from_halte, to_halte, hour), (color, from_halte, to_halte), (from_halte, to_halte, hour), (from_halte, to_halte))
+		HAVING GROUPING(hour) = 1 OR COUNT(*) >= $3`,
+		from,
+		maxSeconds,
+		minHourSamples,
+	)
 	if err != nil {
-		return 0, fmt.Errorf("unable to get filtered lap history count: %w", err)
+		return nil, fmt.Errorf("unable to get segment times: %w", err)
 	}
+	defer rows.Close()
 
-	return count, nil
+	res := make([]dto.SegmentTime, 0)
+	for rows.Next() {
+		var segment dto.SegmentTime
+		var color sql.NullString
+		if err := rows.Scan(&color, &segment.FromHalte, &segment.ToHalte, &segment.Hour, &segment.MedianSeconds, &segment.Samples); err != nil {
+			return nil, fmt.Errorf("unable to scan segment time: %w", err)
+		}
+		segment.Color = color.String
+		res = append(res, segment)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("unable to read segment times: %w", err)
+	}
+	return res, nil
 }
 
 // Helper function to convert time string (HH:MM) to minutes since midnight
@@ -1,50 +1,87 @@
 package bus
 
-var blueNormal = []string{"Asrama UI", "Menwa", "Stasiun UI", "Fakultas Psikologi", "FISIP", "Fakultas Ilmu Pengetahuan Budaya", "Fakultas Ekonomi dan Bisnis", "Fakultas Teknik", "Vokasi", "SOR", "Fakultas Farmasi", "Balai Sidang", "Balairung", "Stasiun Pondok Cina", "MUI/Perpus UI", "Fakultas Hukum", "Stasiun UI", "Menwa", "Asrama UI", "Parking"}
-var blueMorning = []string{"Asrama UI", "Menwa", "Stasiun UI", "Fakultas Psikologi", "FISIP", "Fakultas Ilmu Pengetahuan Budaya", "Fakultas Ekonomi dan Bisnis", "Fakultas Teknik", "Vokasi", "SOR", "FIA", "Balairung", "Stasiun Pondok Cina", "MUI/Perpus UI", "Fakultas Hukum", "Fakultas Psikologi", "FISIP", "Fakultas Ilmu Pengetahuan Budaya", "Fakultas Ekonomi dan Bisnis", "Fakultas Teknik", "Parking"}
-var redNormal = []string{"Asrama UI", "Menwa", "Stasiun UI", "Fakultas Hukum", "Balairung", "RIK", "Fakultas Kesehatan Masyarakat", "RSUI", "Fakultas Ilmu Keperawatan", "FMIPA", "SOR", "Vokasi", "Fakultas Teknik", "Fakultas Ekonomi dan Bisnis", "Fakultas Ilmu Pengetahuan Budaya", "FISIP", "Fakultas Psikologi", "Stasiun UI", "Menwa", "Asrama UI", "Parking"}
-var redMorning = []string{"Asrama UI", "Menwa", "Stasiun UI", "Fakultas Hukum", "Balairung", "RIK", "Fakultas Kesehatan Masyarakat", "RSUI", "Fakultas Ilmu Keperawatan", "FMIPA", "SOR", "Vokasi", "Fakultas Teknik", "Parking"}
-var (
-	blueNormalSet  = make(map[[2]string]bool)
-	blueMorningSet = make(map[[2]string]bool)
-	redNormalSet   = make(map[[2]string]bool)
-	redMorningSet  = make(map[[2]string]bool)
+import (
+	"sort"
+
+	"github.com/FreeJ1nG/bikuntracker-backend/app/models"
+	"github.com/FreeJ1nG/bikuntracker-backend/app/route"
 )
 
-func init() {
-	for i := 0; i < len(blueNormal)-1; i++ {
-		blueNormalSet[[2]string{blueNormal[i], blueNormal[i+1]}] = true
-	}
-	for i := 0; i < len(blueMorning)-1; i++ {
-		blueMorningSet[[2]string{blueMorning[i], blueMorning[i+1]}] = true
-	}
-	for i := 0; i < len(redNormal)-1; i++ {
-		redNormalSet[[2]string{redNormal[i], redNormal[i+1]}] = true
+const (
+	// Number of recent stops scored against the routes
+	stopSequenceLength = 8
+	// Every older transition weighs this much less than the one after it
+	sequenceDecay = 0.8
+	// A transition that skips one stop of a route only counts this much, the bus may have missed a geofence
+	skippedStopWeight = 0.5
+	// The best route must explain at least this share of the weighted transitions
+	minRouteFit = 0.5
+	// Routes of another color must fit at least this much worse, otherwise the color stays undecided
+	minColorMargin = 0.2
+)
+
+// routeDetection is the route that best explains the recent stops of a bus
+type routeDetection struct {
+	route models.Route
+	// color is the color of the route, grey means undecided. The variant only lives in route.
+	color string
+	// confidence is the share of the weighted transitions the route explains, between 0 and 1
+	confidence float64
+}
+
+// detectRoute scores the recent stop sequence of a bus against every route variant. Every transition between
+// consecutive stops counts for the routes driving it, recent transitions weigh more than older ones.
+// Variants of the same color often share most transitions, a tie is resolved to the normal variant.
+func (c *container) detectRoute(sequence []string) routeDetection {
+	undecided := routeDetection{color: "grey"}
+	routes := c.routeCatalog.Routes()
+	if len(sequence) < 2 || len(routes) == 0 {
+		return undecided
 	}
-	for i := 0; i < len(redMorning)-1; i++ {
-		redMorningSet[[2]string{redMorning[i], redMorning[i+1]}] = true
+
+	fits := make([]float64, len(routes))
+	total := 0.0
+	weight := 1.0
+	for j := len(sequence) - 1; j > 0; j-- {
+		transitions := c.routeCatalog.Transitions(sequence[j-1], sequence[j])
+		for i, r := range routes {
+			switch transitions[r.Name] {
+			case 1:
+				fits[i] += weight
+			case 2:
+				fits[i] += weight * skippedStopWeight
+			}
+		}
+		total += weight
+		weight *= sequenceDecay
 	}
-	blueNormalSet[[2]string{blueNormal[len(blueNormal)-1], blueNormal[0]}] = true
-	blueMorningSet[[2]string{blueMorning[len(blueMorning)-1], blueMorning[0]}] = true
-	redNormalSet[[2]string{redNormal[len(redNormal)-1], redNormal[0]}] = true
-	redMorningSet[[2]string{redMorning[len(redMorning)-1], redMorning[0]}] = true
-}
 
-func detectRouteColorFromPair(previousHalte, currentHalte string) string {
-	if previousHalte == "" || currentHalte == "" {
-		return "grey"
+	order := make([]int, len(routes))
+	for i := range order {
+		order[i] = i
+		fits[i] /= total
 	}
+	sort.SliceStable(order, func(a, b int) bool {
+		if fits[order[a]] != fits[order[b]] {
+			return fits[order[a]] > fits[order[b]]
+		}
+		return routes[order[a]].Variant == route.VARIANT_NORMAL && routes[order[b]].Variant != route.VARIANT_NORMAL
+	})
 
-	haltePair := [2]string{previousHalte, currentHalte}
-	inBlueNormal := blueNormalSet[haltePair]
-	inBlueMorning := blueMorningSet[haltePair]
-	inRedNormal := redNormalSet[haltePair]
-	inRedMorning := redMorningSet[haltePair]
-	if (inBlueNormal || inBlueMorning) && !inRedNormal && !inRedMorning {
-		return "blue"
+	best := order[0]
+	if fits[best] < minRouteFit {
+		return undecided
 	}
-	if (inRedNormal || inRedMorning) && !inBlueNormal && !inBlueMorning {
-		return "red"
+	for i, r := range routes {
+		if r.Color != routes[best].Color && fits[best]-fits[i] < minColorMargin {
+			return undecided
+		}
 	}
-	return "grey"
+
+	return routeDetection{route: routes[best], color: routes[best].Color, confidence: fits[best]}
+}
+
+// routeOf returns the route of a bus color, express colors run the morning variant
+func (c *container) routeOf(busColor string) (models.Route, bool) {
+	return c.routeCatalog.Route(route.ColorVariant(busColor))
 }
@@ -3,7 +3,6 @@ package bus
 import (
 	"context"
 	"errors"
-	"strings"
 	"time"
 
 	"github.com/FreeJ1nG/bikuntracker-backend/app/dto"
@@ -78,8 +77,19 @@ func (s *service) GetAllBuses(ctx context.Context) ([]models.Bus, error) {
 	return s.repo.GetBuses(ctx)
 }
 
+func (s *service) RecordDriverChange(ctx context.Context, imei string, previousDriver string, driver string, changedAt time.Time) error {
+	return s.repo.RecordDriverChange(ctx, imei, previousDriver, driver, changedAt)
+}
+
+func (s *service) GetCurrentDrivers(ctx context.Context) (map[string]string, error) {
+	return s.repo.GetCurrentDrivers(ctx)
+}
+
 // Lap tracking methods
-func (s *service) StartLap(ctx context.Context, imei string, routeColor string) (*models.BusLapHistory, error) {
+
+// StartLap starts a lap at its first stop, the lap starts when the bus departed from it or,
+// when the departure was not seen, when it arrived there. driver is empty when the bus never reported one.
+func (s *service) StartLap(ctx context.Context, imei string, routeColor string, driver string, firstVisit models.LapHalteVisit) (*models.BusLapHistory, error) {
 	// Get bus info to get bus_id
 	buses, err := s.repo.GetBuses(ctx)
 	if err != nil {
@@ -98,22 +108,21 @@ func (s *service) StartLap(ctx context.Context, imei string, routeColor string)
 		return nil, errors.New("no bus found with the given IMEI")
 	}
 
-	// Get current lap number by checking existing laps
-	existingLaps, _ := s.repo.GetLapHistoryByImei(ctx, imei)
-	lapNumber := len(existingLaps) + 1
-
-	// Initialize halte visit history with starting point and timestamp
-	jakarta, _ := time.LoadLocation("Asia/Jakarta")
-	startTimeJakarta := time.Now().In(jakarta)
-	initialHalteHistory := "Asrama UI [" + startTimeJakarta.Format("2006-01-02 15:04:05") + "]"
+	// Initialize halte visit history with the first stop and its timestamp
+	firstVisit.Sequence = 1
+	startTime := firstVisit.ArrivedAt
+	if firstVisit.DepartedAt != nil {
+		startTime = *firstVisit.DepartedAt
+	}
 
 	lapHistory := &models.BusLapHistory{
 		BusID:             busID,
 		IMEI:              imei,
-		LapNumber:         lapNumber,
-		StartTime:         time.Now(),
+		StartTime:         startTime,
 		RouteColor:        routeColor,
-		HalteVisitHistory: initialHalteHistory,
+		Driver:            driver,
+		HalteVisitHistory: FormatHalteVisit(firstVisit),
+		HalteVisits:       []models.LapHalteVisit{firstVisit},
 	}
 
 	result, err := s.repo.CreateLapHistory(ctx, lapHistory)
@@ -128,6 +137,12 @@ func (s *service) StartLap(ctx context.Context, imei string, routeColor string)
 }
 
 func (s *service) EndLap(ctx context.Context, imei string) (*models.BusLapHistory, error) {
+	return s.EndLapAt(ctx, imei, time.Now(), "", models.LAP_CLOSURE_COMPLETED)
+}
+
+// EndLapAt ends the active lap at the given time, used when a lap is closed after the fact. The lap keeps the route
+// color it was started with, a lap started before the route of the bus was detected takes routeColor.
+func (s *service) EndLapAt(ctx context.Context, imei string, endTime time.Time, routeColor string, closureReason string) (*models.BusLapHistory, error) {
 	activeLap, err := s.repo.GetActiveLapByImei(ctx, imei)
 	if err != nil {
 		return nil, err
@@ -137,32 +152,45 @@ func (s *service) EndLap(ctx context.Context, imei string) (*models.BusLapHistor
 		return nil, nil // No active lap to end
 	}
 
-	// Get the current bus to fetch its latest color
-	buses, err := s.repo.GetBuses(ctx)
-	if err != nil {
-		return nil, err
+	if activeLap.RouteColor == "grey" && routeColor != "" {
+		activeLap.RouteColor = routeColor
 	}
+	return s.CloseLap(ctx, *activeLap, endTime, closureReason)
+}
 
-	var currentBusColor string = "grey" // Default fallback color
-	for _, bus := range buses {
-		if bus.Imei == imei {
-			currentBusColor = bus.Color
-			break
-		}
+// CloseLap closes an open lap that may not be the active lap of its bus, such as a lap left open by a restart
+func (s *service) CloseLap(ctx context.Context, lap models.BusLapHistory, endTime time.Time, closureReason string) (*models.BusLapHistory, error) {
+	if endTime.Before(lap.StartTime) {
+		endTime = lap.StartTime
 	}
-
-	endTime := time.Now()
-	result, err := s.repo.UpdateLapHistoryWithColor(ctx, activeLap.ID, endTime, currentBusColor)
+	result, err := s.repo.CloseLapHistory(ctx, lap.ID, endTime, lap.RouteColor, closureReason)
 	if err != nil {
 		return nil, err
 	}
 
-	// Convert all time fields to UTC (Zulu time)
 	s.convertLapHistoryToUTC(result)
 
 	return result, nil
 }
 
+func (s *service) SetLapAnomalies(ctx context.Context, lapId int, anomalies []string) error {
+	return s.repo.SetLapAnomalies(ctx, lapId, anomalies)
+}
+
+// GetOpenLaps returns every lap without an end time, oldest first
+func (s *service) GetOpenLaps(ctx context.Context) ([]models.BusLapHistory, error) {
+	laps, err := s.repo.GetOpenLaps(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range laps {
+		s.convertLapHistoryToUTC(&laps[i])
+	}
+
+	return laps, nil
+}
+
 func (s *service) GetActiveLap(ctx context.Context, imei string) (*models.BusLapHistory, error) {
 	lap, err := s.repo.GetActiveLapByImei(ctx, imei)
 	if err != nil {
@@ -193,43 +221,35 @@ func (s *service) GetFilteredLapHistoryCount(ctx context.Context, filter dto.Lap
 	return s.repo.GetFilteredLapHistoryCount(ctx, filter)
 }
 
-func (s *service) AddHalteVisitToActiveLap(ctx context.Context, imei string, halteName string) error {
-	// Get the active lap for this bus
+func (s *service) StreamFilteredLapHistory(ctx context.Context, filter dto.LapHistoryFilter, fn func(lap models.BusLapHistory) error) error {
+	return s.repo.StreamFilteredLapHistory(ctx, filter, fn)
+}
+
+func (s *service) GetLapStats(ctx context.Context, filter dto.LapHistoryFilter, groupBy []string) ([]dto.LapStats, error) {
+	return s.repo.GetLapStats(ctx, filter, groupBy)
+}
+
+func (s *service) GetSegmentTimes(ctx context.Context, from time.Time, maxSeconds float64, minHourSamples int) ([]dto.SegmentTime, error) {
+	return s.repo.GetSegmentTimes(ctx, from, maxSeconds, minHourSamples)
+}
+
+// FormatHalteVisit renders a visit the way the legacy halte_visit_history string stores it, in Jakarta time
+func FormatHalteVisit(visit models.LapHalteVisit) string {
+	return visit.Halte + " [" + visit.ArrivedAt.In(Jakarta).Format("2006-01-02 15:04:05") + "]"
+}
+
+func (s *service) AddHalteVisitToActiveLap(ctx context.Context, imei string, halteName string, arrivedAt time.Time) error {
+	return s.repo.AddHalteVisitToActiveLap(ctx, imei, halteName, arrivedAt)
+}
+
+// SetHalteDepartureOnActiveLap records when the bus left the last stop of its active lap
+func (s *service) SetHalteDepartureOnActiveLap(ctx context.Context, imei string, halteName string, departedAt time.Time) error {
 	activeLap, err := s.repo.GetActiveLapByImei(ctx, imei)
 	if err != nil {
 		return err
 	}
-
 	if activeLap == nil {
-		// No active lap, nothing to update
 		return nil
 	}
-
-	// Build the new halte visit history with timestamp
-	jakarta, _ := time.LoadLocation("Asia/Jakarta")
-	currentTimeJakarta := time.Now().In(jakarta)
-	halteWithTimestamp := halteName + " [" + currentTimeJakarta.Format("2006-01-02 15:04:05") + "]"
-
-	var newHalteHistory string
-	if activeLap.HalteVisitHistory == "" {
-		newHalteHistory = halteWithTimestamp
-	} else {
-		// Check if this halte is already the last one to avoid duplicates
-		existingHaltes := strings.Split(activeLap.HalteVisitHistory, " -> ")
-		if len(existingHaltes) > 0 {
-			// Extract just the halte name from the last entry (without timestamp)
-			lastHalte := existingHaltes[len(existingHaltes)-1]
-			if strings.Contains(lastHalte, " [") {
-				lastHalte = strings.Split(lastHalte, " [")[0]
-			}
-			if lastHalte == halteName {
-				// Same halte as last, don't add duplicate
-				return nil
-			}
-		}
-		newHalteHistory = activeLap.HalteVisitHistory + " -> " + halteWithTimestamp
-	}
-
-	// Update the halte visit history
-	return s.repo.UpdateLapHistoryHalteVisits(ctx, activeLap.ID, newHalteHistory)
+	return s.repo.SetLapHalteVisitDeparture(ctx, activeLap.ID, halteName, departedAt)
 }
@@ -0,0 +1,72 @@
+package bus
+
+import (
+	"context"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/FreeJ1nG/bikuntracker-backend/app/interfaces"
+	"github.com/FreeJ1nG/bikuntracker-backend/app/models"
+)
+
+// stubBusRepository holds a single open lap. Methods the service does not call are left to the embedded interface.
+type stubBusRepository struct {
+	interfaces.BusRepository
+	lap models.BusLapHistory
+}
+
+func (r *stubBusRepository) GetActiveLapByImei(ctx context.Context, imei string) (*models.BusLapHistory, error) {
+	if r.lap.IMEI != imei || r.lap.EndTime != nil {
+		return nil, nil
+	}
+	lap := r.lap
+	return &lap, nil
+}
+
+func (r *stubBusRepository) CloseLapHistory(ctx context.Context, id int, endTime time.Time, routeColor string, closureReason string) (*models.BusLapHistory, error) {
+	r.lap.EndTime = &endTime
+	r.lap.RouteColor = routeColor
+	r.lap.ClosureReason = closureReason
+	lap := r.lap
+	return &lap, nil
+}
+
+func TestEndLapAtRouteColor(t *testing.T) {
+	const imei = "860000000000001"
+	start := time.Date(2024, 1, 1, 7, 0, 0, 0, Jakarta)
+	c := newTestContainer(t, nil)
+
+	tests := []struct {
+		name       string
+		lapColor   string
+		routeColor string
+		want       string
+	}{
+		{"express lap keeps its color", "express-blue", "blue", "express-blue"},
+		{"lap without a route takes the detected one", "grey", "express-blue", "express-blue"},
+		{"lap without a route and no detected one", "grey", "", "grey"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Seven stops of blue-morning, enough for the morning lap rule but not for the normal one
+			lap := testLap(1, 1, start, "Asrama UI", "Menwa", "Stasiun UI", "Fakultas Teknik", "SOR", "Balairung", "Parking")
+			lap.IMEI = imei
+			lap.RouteColor = tt.lapColor
+			lap.EndTime = nil
+			lap.ClosureReason = ""
+			s := NewService(&stubBusRepository{lap: lap})
+
+			closed, err := s.EndLapAt(context.Background(), imei, start.Add(15*time.Minute), tt.routeColor, models.LAP_CLOSURE_COMPLETED)
+			if err != nil {
+				t.Fatalf("EndLapAt: %v", err)
+			}
+			if closed.RouteColor != tt.want {
+				t.Errorf("closed lap has route color %s, want %s", closed.RouteColor, tt.want)
+			}
+			if anomalies := c.LapAnomalies(*closed); tt.want == "express-blue" && slices.Contains(anomalies, models.LAP_ANOMALY_TOO_FEW_STOPS) {
+				t.Errorf("got anomalies %v, an express lap of seven stops has enough stops", anomalies)
+			}
+		})
+	}
+}
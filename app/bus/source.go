@@ -0,0 +1,99 @@
+package bus
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/FreeJ1nG/bikuntracker-backend/app/dto"
+	"github.com/FreeJ1nG/bikuntracker-backend/app/interfaces"
+	"github.com/FreeJ1nG/bikuntracker-backend/app/models"
+)
+
+const (
+	SOURCE_WEBHOOK = "webhook"
+	SOURCE_WS      = "ws"
+	SOURCE_REPLAY  = "replay"
+)
+
+// EnabledLocationSources returns the source names listed in LOCATION_SOURCES, defaulting to the webhook only
+func EnabledLocationSources(config *models.Config) []string {
+	res := make([]string, 0)
+	for _, name := range strings.Split(config.LocationSources, ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name != "" {
+			res = append(res, name)
+		}
+	}
+	if len(res) == 0 {
+		res = append(res, SOURCE_WEBHOOK)
+	}
+	return res
+}
+
+func IsLocationSourceEnabled(config *models.Config, name string) bool {
+	for _, enabled := range EnabledLocationSources(config) {
+		if enabled == name {
+			return true
+		}
+	}
+	return false
+}
+
+// NewLocationSources builds the pull based sources enabled in config. The webhook is push based,
+// its fixes arrive through the /wh routes which are only registered when it is enabled.
+func NewLocationSources(config *models.Config) (res []interfaces.LocationSource, err error) {
+	res = make([]interfaces.LocationSource, 0)
+	for _, name := range EnabledLocationSources(config) {
+		switch name {
+		case SOURCE_WEBHOOK:
+			continue
+		case SOURCE_WS:
+			if config.WsUrl == "" {
+				err = fmt.Errorf("location source %s requires WS_URL to be set", name)
+				return
+			}
+			res = append(res, NewWSSource(
+				config.WsUrl,
+				time.Duration(config.WsIdleTimeoutSeconds)*time.Second,
+				time.Duration(config.WsMaxBackoffSeconds)*time.Second,
+			))
+		case SOURCE_REPLAY:
+			if config.ReplayFile == "" {
+				err = fmt.Errorf("location source %s requires REPLAY_FILE to be set", name)
+				return
+			}
+			res = append(res, NewReplaySource(config.ReplayFile, config.ReplaySpeed))
+		default:
+			err = fmt.Errorf("unknown location source: %s", name)
+			return
+		}
+	}
+	return
+}
+
+// StartLocationSources runs every source in its own goroutine until ctx is cancelled
+func (c *container) StartLocationSources(ctx context.Context, sources []interfaces.LocationSource) {
+	c.sourcesMu.Lock()
+	c.sources = append(c.sources, sources...)
+	c.sourcesMu.Unlock()
+	for _, source := range sources {
+		go func(source interfaces.LocationSource) {
+			if err := source.Run(ctx, c); err != nil {
+				log.Printf("Location source %s stopped: %v", source.Name(), err)
+			}
+		}(source)
+	}
+}
+
+func (c *container) GetLocationSourceStatuses() []dto.LocationSourceStatus {
+	c.sourcesMu.RLock()
+	defer c.sourcesMu.RUnlock()
+	res := make([]dto.LocationSourceStatus, 0, len(c.sources))
+	for _, source := range c.sources {
+		res = append(res, source.Status())
+	}
+	return res
+}
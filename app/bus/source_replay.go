@@ -0,0 +1,157 @@
+package bus
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/FreeJ1nG/bikuntracker-backend/app/dto"
+	"github.com/FreeJ1nG/bikuntracker-backend/app/interfaces"
+	"github.com/FreeJ1nG/bikuntracker-backend/app/models"
+)
+
+// replaySource feeds recorded fixes, keeping the original spacing between fixes divided by speed.
+// A speed of 0 or less feeds them as fast as the pipeline accepts them.
+type replaySource struct {
+	description string
+	speed       float64
+	// feed calls emit for every recorded fix in order and stops early when emit returns false
+	feed func(emit func(fix *models.BusCoordinate) bool) error
+
+	mu     sync.RWMutex
+	status dto.LocationSourceStatus
+}
+
+// NewReplaySource replays a JSONL file holding one BusCoordinate per line
+func NewReplaySource(filePath string, speed float64) *replaySource {
+	return newReplaySource(filePath, speed, func(emit func(fix *models.BusCoordinate) bool) error {
+		file, err := os.Open(filepath.Clean(filePath))
+		if err != nil {
+			return fmt.Errorf("unable to open replay file: %w", err)
+		}
+		defer func() {
+			_ = file.Close()
+		}()
+
+		scanner := bufio.NewScanner(file)
+		scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+		line := 0
+		for scanner.Scan() {
+			line++
+			if len(scanner.Bytes()) == 0 {
+				continue
+			}
+			var fix models.BusCoordinate
+			if err := json.Unmarshal(scanner.Bytes(), &fix); err != nil {
+				log.Printf("Skipping invalid replay line %d: %v", line, err)
+				continue
+			}
+			if !emit(&fix) {
+				return nil
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			return fmt.Errorf("unable to read replay file: %w", err)
+		}
+		return nil
+	})
+}
+
+// NewPositionReplaySource replays positions loaded from the bus_position table
+func NewPositionReplaySource(description string, positions []models.BusPosition, speed float64) *replaySource {
+	return newReplaySource(description, speed, func(emit func(fix *models.BusCoordinate) bool) error {
+		for _, position := range positions {
+			if !emit(positionToCoordinate(position)) {
+				return nil
+			}
+		}
+		return nil
+	})
+}
+
+func newReplaySource(description string, speed float64, feed func(emit func(fix *models.BusCoordinate) bool) error) *replaySource {
+	return &replaySource{
+		description: description,
+		speed:       speed,
+		feed:        feed,
+		status: dto.LocationSourceStatus{
+			Name: SOURCE_REPLAY,
+		},
+	}
+}
+
+func (s *replaySource) Name() string {
+	return SOURCE_REPLAY
+}
+
+func (s *replaySource) Status() dto.LocationSourceStatus {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.status
+}
+
+func (s *replaySource) Run(ctx context.Context, sink interfaces.LocationSink) error {
+	log.Printf("Replaying recorded fixes from %s at %.1fx speed", s.description, s.speed)
+	startedAt := time.Now()
+	s.mu.Lock()
+	s.status.Connected = true
+	s.status.ConnectedSince = &startedAt
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		s.status.Connected = false
+		s.mu.Unlock()
+	}()
+
+	var previous time.Time
+	err := s.feed(func(fix *models.BusCoordinate) bool {
+		if !previous.IsZero() && s.speed > 0 && fix.GpsTime.After(previous) {
+			wait := time.Duration(float64(fix.GpsTime.Sub(previous)) / s.speed)
+			select {
+			case <-ctx.Done():
+				return false
+			case <-time.After(wait):
+			}
+		}
+		if ctx.Err() != nil {
+			return false
+		}
+		previous = fix.GpsTime
+
+		fix.ReceivedAt = time.Time{}
+		readAt := time.Now()
+		s.mu.Lock()
+		s.status.LastMessageAt = &readAt
+		s.mu.Unlock()
+		sink.ApplyExternalCoordinates([]*models.BusCoordinate{fix})
+		return true
+	})
+	if err != nil {
+		s.mu.Lock()
+		s.status.LastError = err.Error()
+		s.mu.Unlock()
+		return err
+	}
+	log.Printf("Finished replaying %s", s.description)
+	return nil
+}
+
+func positionToCoordinate(position models.BusPosition) *models.BusCoordinate {
+	return &models.BusCoordinate{
+		Imei:       position.IMEI,
+		Latitude:   position.Latitude,
+		Longitude:  position.Longitude,
+		Speed:      position.Speed,
+		Direction:  position.Direction,
+		EngineOn:   position.EngineOn,
+		Driver:     position.Driver,
+		GpsTime:    position.DeviceTime,
+		ReceivedAt: position.ReceivedAt,
+	}
+}
@@ -0,0 +1,218 @@
+package bus
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"math/rand"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/FreeJ1nG/bikuntracker-backend/app/dto"
+	"github.com/FreeJ1nG/bikuntracker-backend/app/interfaces"
+	"github.com/FreeJ1nG/bikuntracker-backend/app/models"
+	"github.com/coder/websocket"
+)
+
+const (
+	wsBaseBackoff         = 1 * time.Second
+	defaultWsMaxBackoff   = 60 * time.Second
+	defaultWsIdleTimeout  = 60 * time.Second
+	wsStableConnectionAge = 30 * time.Second
+)
+
+var errWSIdle = errors.New("no message received within the idle timeout")
+
+// wsSource consumes the upstream GPS WebSocket feed, reconnecting with exponential
+// backoff and forcing a reconnect when an open connection goes silent
+type wsSource struct {
+	url         string
+	idleTimeout time.Duration
+	maxBackoff  time.Duration
+
+	mu     sync.RWMutex
+	status dto.LocationSourceStatus
+}
+
+func NewWSSource(url string, idleTimeout time.Duration, maxBackoff time.Duration) *wsSource {
+	if idleTimeout <= 0 {
+		idleTimeout = defaultWsIdleTimeout
+	}
+	if maxBackoff <= 0 {
+		maxBackoff = defaultWsMaxBackoff
+	}
+	return &wsSource{
+		url:         url,
+		idleTimeout: idleTimeout,
+		maxBackoff:  maxBackoff,
+		status: dto.LocationSourceStatus{
+			Name: SOURCE_WS,
+		},
+	}
+}
+
+func (s *wsSource) Name() string {
+	return SOURCE_WS
+}
+
+func (s *wsSource) Status() dto.LocationSourceStatus {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.status
+}
+
+func (s *wsSource) Run(ctx context.Context, sink interfaces.LocationSink) error {
+	log.Printf("Starting WebSocket location source - URL: %s", s.url)
+	attempt := 0
+	for {
+		connectedFor, err := s.connectAndConsume(ctx, sink)
+		if ctx.Err() != nil {
+			log.Printf("WebSocket location source stopped")
+			return nil
+		}
+		if err != nil {
+			log.Printf("WebSocket connection lost: %v", err)
+		}
+
+		// A connection that stayed up for a while means upstream is healthy again
+		if connectedFor >= wsStableConnectionAge {
+			attempt = 0
+		}
+		wait := s.backoff(attempt)
+		attempt++
+
+		s.mu.Lock()
+		s.status.ReconnectCount++
+		s.mu.Unlock()
+
+		log.Printf("Reconnecting to WebSocket in %s", wait.Round(time.Millisecond))
+		select {
+		case <-ctx.Done():
+			log.Printf("WebSocket location source stopped")
+			return nil
+		case <-time.After(wait):
+		}
+	}
+}
+
+// backoff returns a random wait in [0, min(maxBackoff, base * 2^attempt)] ("full jitter")
+func (s *wsSource) backoff(attempt int) time.Duration {
+	ceiling := s.maxBackoff
+	if attempt < 16 {
+		if exp := wsBaseBackoff << attempt; exp < ceiling {
+			ceiling = exp
+		}
+	}
+	return time.Duration(rand.Int63n(int64(ceiling) + 1))
+}
+
+func (s *wsSource) connectAndConsume(ctx context.Context, sink interfaces.LocationSink) (connectedFor time.Duration, err error) {
+	log.Printf("Connecting to WebSocket: %s", s.url)
+	dialCtx, cancelDial := context.WithTimeout(ctx, s.idleTimeout)
+	conn, _, err := websocket.Dial(dialCtx, s.url, nil)
+	cancelDial()
+	if err != nil {
+		s.setDisconnected(err)
+		return
+	}
+	defer conn.Close(websocket.StatusNormalClosure, "done")
+
+	connectedAt := time.Now()
+	s.mu.Lock()
+	s.status.Connected = true
+	s.status.ConnectedSince = &connectedAt
+	s.status.LastError = ""
+	s.mu.Unlock()
+
+	for {
+		readCtx, cancelRead := context.WithTimeout(ctx, s.idleTimeout)
+		_, data, readErr := conn.Read(readCtx)
+		idle := errors.Is(readCtx.Err(), context.DeadlineExceeded)
+		cancelRead()
+		if readErr != nil {
+			if idle && ctx.Err() == nil {
+				readErr = errWSIdle
+			}
+			s.setDisconnected(readErr)
+			return time.Since(connectedAt), readErr
+		}
+
+		receivedAt := time.Now()
+		s.mu.Lock()
+		s.status.LastMessageAt = &receivedAt
+		s.mu.Unlock()
+
+		fixes := parseWSData(data)
+		if len(fixes) > 0 {
+			sink.ApplyExternalCoordinates(fixes)
+		}
+	}
+}
+
+func (s *wsSource) setDisconnected(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.status.Connected = false
+	s.status.ConnectedSince = nil
+	if err != nil {
+		s.status.LastError = err.Error()
+	}
+}
+
+// parseWSData normalizes an upstream message, halte and bus metadata are derived by the container
+func parseWSData(data []byte) []*models.BusCoordinate {
+	var wsResp struct {
+		Message string                   `json:"message"`
+		Data    []map[string]interface{} `json:"data"`
+	}
+	err := json.Unmarshal(data, &wsResp)
+	if err != nil {
+		log.Printf("WebSocket JSON unmarshal error: %v", err)
+		return nil
+	}
+	fixes := make([]*models.BusCoordinate, 0, len(wsResp.Data))
+	for _, d := range wsResp.Data {
+		imei, _ := d["imei"].(string)
+		if imei == "" {
+			continue
+		}
+		lat, _ := d["latitude"].(float64)
+		lng, _ := d["longitude"].(float64)
+		speed, _ := d["speed"].(float64)
+		hullNo, _ := d["hullNo"].(string)
+		driver, _ := d["driver"].(string)
+		direction, _ := d["direction"].(float64)
+		engineOn, _ := d["engineOn"].(bool)
+		receivedAt := time.Now()
+		gpsTime := receivedAt
+		for _, key := range []string{"gpsTime", "lastPacket", "gps_time", "last_packet"} {
+			var value string
+			switch v := d[key].(type) {
+			case string:
+				value = v
+			case float64:
+				value = strconv.FormatInt(int64(v), 10)
+			}
+			if t, ok := parseDeviceTime(value); ok {
+				gpsTime = t
+				break
+			}
+		}
+		fixes = append(fixes, &models.BusCoordinate{
+			Imei:        imei,
+			Latitude:    lat,
+			Longitude:   lng,
+			Speed:       int(speed),
+			Direction:   direction,
+			EngineOn:    engineOn,
+			GpsTime:     gpsTime,
+			ReceivedAt:  receivedAt,
+			PlateNumber: hullNo,
+			Driver:      strings.TrimSpace(driver),
+		})
+	}
+	return fixes
+}
@@ -0,0 +1,312 @@
+package bus
+
+import (
+	"sync"
+	"time"
+
+	"github.com/FreeJ1nG/bikuntracker-backend/app/models"
+	"github.com/gammazero/deque"
+)
+
+// stateStore holds the runtime state shared between the ingestion pipeline and the
+// broadcast readers. Every read returns a copy so callers never hold on to memory
+// that a concurrent update may mutate.
+type stateStore struct {
+	mu             sync.RWMutex
+	busCoordinates map[string]*models.BusCoordinate
+	storedBuses    map[string]*dqStore
+	previousHalte  map[string]string               // imei -> previous halte name
+	stopVisits     map[string]stopVisit            // imei -> stop the bus is inside of
+	stopSequences  map[string][]string             // imei -> last stops the bus arrived at, oldest first
+	lastDepartures map[string]models.LapHalteVisit // imei -> last stop the bus departed from
+	activeLaps     map[string]bool                 // imei -> whether bus has active lap
+	lapStops       map[string]int                  // imei -> stops visited by the active lap
+	currentPlates  map[string]string               // imei -> current plate number
+	currentDrivers map[string]string               // imei -> last reported driver
+	lastFixTimes   map[string]time.Time            // imei -> device time of the newest accepted fix
+	buses          map[string]models.Bus           // imei -> cached bus row
+}
+
+func newStateStore() *stateStore {
+	return &stateStore{
+		busCoordinates: make(map[string]*models.BusCoordinate),
+		storedBuses:    make(map[string]*dqStore),
+		previousHalte:  make(map[string]string),
+		stopVisits:     make(map[string]stopVisit),
+		stopSequences:  make(map[string][]string),
+		lastDepartures: make(map[string]models.LapHalteVisit),
+		activeLaps:     make(map[string]bool),
+		lapStops:       make(map[string]int),
+		currentPlates:  make(map[string]string),
+		currentDrivers: make(map[string]string),
+		lastFixTimes:   make(map[string]time.Time),
+		buses:          make(map[string]models.Bus),
+	}
+}
+
+// Coordinates returns a snapshot of the latest coordinate of every bus
+func (s *stateStore) Coordinates() []models.BusCoordinate {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	res := make([]models.BusCoordinate, 0, len(s.busCoordinates))
+	for _, coord := range s.busCoordinates {
+		res = append(res, *coord)
+	}
+	return res
+}
+
+// CoordinatesMap returns a snapshot of the latest coordinates keyed by imei
+func (s *stateStore) CoordinatesMap() map[string]*models.BusCoordinate {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	res := make(map[string]*models.BusCoordinate, len(s.busCoordinates))
+	for imei, coord := range s.busCoordinates {
+		copied := *coord
+		res[imei] = &copied
+	}
+	return res
+}
+
+// Coordinate returns a copy of the latest coordinate of a single bus
+func (s *stateStore) Coordinate(imei string) (models.BusCoordinate, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	coord, ok := s.busCoordinates[imei]
+	if !ok {
+		return models.BusCoordinate{}, false
+	}
+	return *coord, true
+}
+
+// MergeCoordinates stores the given coordinates, keeping the last known position of buses not present
+func (s *stateStore) MergeCoordinates(coords map[string]*models.BusCoordinate) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for imei, coord := range coords {
+		copied := *coord
+		s.busCoordinates[imei] = &copied
+	}
+}
+
+// UpdateCoordinate atomically mutates the stored coordinate of a bus, returns false if the bus is unknown
+func (s *stateStore) UpdateCoordinate(imei string, update func(coord *models.BusCoordinate)) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	coord, ok := s.busCoordinates[imei]
+	if !ok {
+		return false
+	}
+	update(coord)
+	return true
+}
+
+func (s *stateStore) PreviousHalte(imei string) string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.previousHalte[imei]
+}
+
+func (s *stateStore) SetPreviousHalte(imei string, halte string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.previousHalte[imei] = halte
+}
+
+// StopVisit returns the stop a bus is currently inside of
+func (s *stateStore) StopVisit(imei string) (stopVisit, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	visit, ok := s.stopVisits[imei]
+	return visit, ok
+}
+
+func (s *stateStore) SetStopVisit(imei string, visit stopVisit) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.stopVisits[imei] = visit
+}
+
+func (s *stateStore) ClearStopVisit(imei string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.stopVisits, imei)
+}
+
+// StopSequence returns a copy of the last stops a bus arrived at, oldest first
+func (s *stateStore) StopSequence(imei string) []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return append([]string(nil), s.stopSequences[imei]...)
+}
+
+// AppendStopSequence records an arrival, keeping at most limit stops. Arriving again at the last stop is ignored.
+func (s *stateStore) AppendStopSequence(imei string, halte string, limit int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sequence := s.stopSequences[imei]
+	if len(sequence) > 0 && sequence[len(sequence)-1] == halte {
+		return
+	}
+	sequence = append(sequence, halte)
+	if len(sequence) > limit {
+		sequence = sequence[len(sequence)-limit:]
+	}
+	s.stopSequences[imei] = sequence
+}
+
+// LastDeparture returns the last stop a bus has arrived at and departed from
+func (s *stateStore) LastDeparture(imei string) (models.LapHalteVisit, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	visit, ok := s.lastDepartures[imei]
+	return visit, ok
+}
+
+func (s *stateStore) SetLastDeparture(imei string, visit models.LapHalteVisit) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lastDepartures[imei] = visit
+}
+
+func (s *stateStore) HasActiveLap(imei string) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.activeLaps[imei]
+}
+
+func (s *stateStore) SetActiveLap(imei string, active bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.activeLaps[imei] = active
+}
+
+// LapStops returns the number of stops visited by the active lap of a bus
+func (s *stateStore) LapStops(imei string) int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.lapStops[imei]
+}
+
+func (s *stateStore) SetLapStops(imei string, stops int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lapStops[imei] = stops
+}
+
+func (s *stateStore) CurrentPlate(imei string) string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.currentPlates[imei]
+}
+
+func (s *stateStore) SetCurrentPlate(imei string, plate string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.currentPlates[imei] = plate
+}
+
+func (s *stateStore) CurrentDriver(imei string) string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.currentDrivers[imei]
+}
+
+func (s *stateStore) SetCurrentDriver(imei string, driver string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.currentDrivers[imei] = driver
+}
+
+func (s *stateStore) BusMetadata(imei string) (models.Bus, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	bus, ok := s.buses[imei]
+	return bus, ok
+}
+
+func (s *stateStore) SetBusMetadata(buses []models.Bus) {
+	next := make(map[string]models.Bus, len(buses))
+	for _, bus := range buses {
+		next[bus.Imei] = bus
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.buses = next
+}
+
+// SetBusColor updates the cached color of a bus and of its latest coordinate
+func (s *stateStore) SetBusColor(imei string, color string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if bus, ok := s.buses[imei]; ok {
+		bus.Color = color
+		s.buses[imei] = bus
+	}
+	if coord, ok := s.busCoordinates[imei]; ok {
+		coord.Color = color
+	}
+}
+
+// AcceptFixTime records the device time of a new fix if it is newer than the last accepted one
+func (s *stateStore) AcceptFixTime(imei string, deviceTime time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	last, ok := s.lastFixTimes[imei]
+	if ok {
+		if deviceTime.Equal(last) {
+			return ErrDuplicateFix
+		}
+		if deviceTime.Before(last) {
+			return ErrOutOfOrderFix
+		}
+	}
+	s.lastFixTimes[imei] = deviceTime
+	return nil
+}
+
+// PushWindow appends a coordinate to the rolling window of a bus used for lane detection
+func (s *stateStore) PushWindow(imei string, bus *models.BusCoordinate) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	store, ok := s.storedBuses[imei]
+	if !ok {
+		store = &dqStore{
+			dq:      deque.New[*models.BusCoordinate](),
+			counter: 0,
+		}
+		s.storedBuses[imei] = store
+	}
+	if store.dq.Len() > 0 {
+		back := store.dq.Back()
+		if bus.Latitude == back.Latitude && bus.Longitude == back.Longitude {
+			return
+		}
+	}
+	copied := *bus
+	store.counter++
+	store.counter %= DQ_SIZE
+	if store.dq.Len() < DQ_SIZE {
+		store.dq.PushBack(&copied)
+	} else {
+		store.dq.PopFront()
+		store.dq.PushBack(&copied)
+	}
+}
+
+// FullWindows returns a copy of every rolling window that just completed a full cycle
+func (s *stateStore) FullWindows() map[string][]*models.BusCoordinate {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	res := make(map[string][]*models.BusCoordinate)
+	for imei, store := range s.storedBuses {
+		if store.counter == 0 && store.dq.Len() == DQ_SIZE {
+			points := make([]*models.BusCoordinate, 0, store.dq.Len())
+			for i := 0; i < store.dq.Len(); i++ {
+				copied := *store.dq.At(i)
+				points = append(points, &copied)
+			}
+			res[imei] = points
+		}
+	}
+	return res
+}
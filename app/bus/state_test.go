@@ -0,0 +1,232 @@
+package bus
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/FreeJ1nG/bikuntracker-backend/app/dto"
+	"github.com/FreeJ1nG/bikuntracker-backend/app/halte"
+	"github.com/FreeJ1nG/bikuntracker-backend/app/interfaces"
+	"github.com/FreeJ1nG/bikuntracker-backend/app/models"
+	"github.com/FreeJ1nG/bikuntracker-backend/app/route"
+)
+
+// stubBusService keeps laps in memory. Methods the ingestion pipeline does not call are left to the embedded interface.
+type stubBusService struct {
+	interfaces.BusService
+	mu     sync.Mutex
+	buses  []models.Bus
+	laps   map[string]*models.BusLapHistory
+	nextId int
+}
+
+func newStubBusService(buses []models.Bus) *stubBusService {
+	return &stubBusService{buses: buses, laps: make(map[string]*models.BusLapHistory)}
+}
+
+func (s *stubBusService) GetAllBuses(ctx context.Context) ([]models.Bus, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]models.Bus(nil), s.buses...), nil
+}
+
+func (s *stubBusService) UpdateBusColorByImei(ctx context.Context, imei string, newColor string) (*models.Bus, error) {
+	return &models.Bus{Imei: imei, Color: newColor}, nil
+}
+
+func (s *stubBusService) UpdateBusPlateNumberByImei(ctx context.Context, imei string, plateNumber string) (*models.Bus, error) {
+	return &models.Bus{Imei: imei, PlateNumber: plateNumber}, nil
+}
+
+func (s *stubBusService) UpdateCurrentHalteByImei(ctx context.Context, imei string, newHalte string) (*models.Bus, error) {
+	return &models.Bus{Imei: imei}, nil
+}
+
+func (s *stubBusService) RecordDriverChange(ctx context.Context, imei string, previousDriver string, driver string, changedAt time.Time) error {
+	return nil
+}
+
+func (s *stubBusService) GetCurrentDrivers(ctx context.Context) (map[string]string, error) {
+	return map[string]string{}, nil
+}
+
+func (s *stubBusService) GetActiveLap(ctx context.Context, imei string) (*models.BusLapHistory, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	lap, ok := s.laps[imei]
+	if !ok {
+		return nil, nil
+	}
+	copied := *lap
+	return &copied, nil
+}
+
+func (s *stubBusService) StartLap(ctx context.Context, imei string, routeColor string, driver string, firstVisit models.LapHalteVisit) (*models.BusLapHistory, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.nextId++
+	lap := &models.BusLapHistory{
+		ID:          s.nextId,
+		IMEI:        imei,
+		StartTime:   firstVisit.ArrivedAt,
+		RouteColor:  routeColor,
+		Driver:      driver,
+		HalteVisits: []models.LapHalteVisit{firstVisit},
+	}
+	s.laps[imei] = lap
+	copied := *lap
+	return &copied, nil
+}
+
+func (s *stubBusService) EndLapAt(ctx context.Context, imei string, endTime time.Time, routeColor string, closureReason string) (*models.BusLapHistory, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	lap, ok := s.laps[imei]
+	if !ok {
+		return nil, nil
+	}
+	delete(s.laps, imei)
+	lap.EndTime = &endTime
+	lap.ClosureReason = closureReason
+	return lap, nil
+}
+
+func (s *stubBusService) SetLapAnomalies(ctx context.Context, lapId int, anomalies []string) error {
+	return nil
+}
+
+func (s *stubBusService) AddHalteVisitToActiveLap(ctx context.Context, imei string, halteName string, arrivedAt time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if lap, ok := s.laps[imei]; ok {
+		lap.HalteVisits = append(lap.HalteVisits, models.LapHalteVisit{Sequence: len(lap.HalteVisits) + 1, Halte: halteName, ArrivedAt: arrivedAt})
+	}
+	return nil
+}
+
+func (s *stubBusService) SetHalteDepartureOnActiveLap(ctx context.Context, imei string, halteName string, departedAt time.Time) error {
+	return nil
+}
+
+type stubRMService struct{}
+
+func (stubRMService) DetectLane(imei string, data []*models.BusCoordinate) (dto.DetectRouteResponse, error) {
+	return dto.DetectRouteResponse{}, nil
+}
+
+// newTestContainer builds a container on the built-in haltes and routes with an in-memory bus service
+func newTestContainer(t *testing.T, buses []models.Bus) *container {
+	t.Helper()
+	log.SetOutput(io.Discard)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+
+	halteCatalog := halte.NewCatalog(nil)
+	c := NewContainer(&models.Config{}, stubRMService{}, nil, newStubBusService(buses), halteCatalog, route.NewCatalog(nil, halteCatalog), nil)
+	c.InitRuntimeState()
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	go c.RunPersister(ctx)
+	return c
+}
+
+func TestApplyExternalCoordinatesConcurrentReaders(t *testing.T) {
+	const busCount = 8
+	const fixesPerBus = 40
+
+	buses := make([]models.Bus, busCount)
+	for i := range buses {
+		buses[i] = models.Bus{Id: i + 1, Imei: fmt.Sprintf("86000000000000%d", i), Color: "grey"}
+	}
+	c := newTestContainer(t, buses)
+
+	asrama, _ := c.halteCatalog.Halte("Asrama UI")
+	menwa, _ := c.halteCatalog.Halte("Menwa")
+	base := time.Now().Add(-2 * time.Hour)
+
+	done := make(chan struct{})
+	var readers sync.WaitGroup
+	for r := 0; r < 4; r++ {
+		readers.Add(1)
+		go func() {
+			defer readers.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				// Snapshots belong to the caller, writing to them must not race with the pipeline
+				for _, coord := range c.GetBusCoordinates() {
+					coord.Status = ""
+				}
+				for _, coord := range c.GetBusCoordinatesMap() {
+					coord.Latitude = 0
+				}
+				_ = c.GetPreviousHalte(buses[0].Imei)
+				_ = c.GetIngestStats()
+			}
+		}()
+	}
+
+	var writers sync.WaitGroup
+	for _, b := range buses {
+		writers.Add(1)
+		go func(imei string) {
+			defer writers.Done()
+			// Back and forth between Asrama UI and Menwa so every bus starts and ends laps
+			for i := 0; i < fixesPerBus; i++ {
+				stop := asrama
+				if i%2 == 1 {
+					stop = menwa
+				}
+				errs := c.ApplyExternalCoordinates([]*models.BusCoordinate{{
+					Imei:      imei,
+					Latitude:  stop.Latitude,
+					Longitude: stop.Longitude,
+					GpsTime:   base.Add(time.Duration(i) * time.Minute),
+				}})
+				if errs[0] != nil {
+					t.Errorf("fix %d of bus %s rejected: %v", i, imei, errs[0])
+				}
+			}
+		}(b.Imei)
+	}
+	writers.Wait()
+	close(done)
+	readers.Wait()
+
+	coords := c.GetBusCoordinatesMap()
+	if len(coords) != busCount {
+		t.Fatalf("got %d buses, want %d", len(coords), busCount)
+	}
+	lastTime := base.Add((fixesPerBus - 1) * time.Minute)
+	for _, b := range buses {
+		coord := coords[b.Imei]
+		if !coord.GpsTime.Equal(lastTime) {
+			t.Errorf("bus %s last fix at %s, want %s", b.Imei, coord.GpsTime, lastTime)
+		}
+		if coord.Latitude != menwa.Latitude {
+			t.Errorf("bus %s at latitude %f, want Menwa %f", b.Imei, coord.Latitude, menwa.Latitude)
+		}
+		// The last move was Asrama UI to Menwa, which starts a lap under the default rule
+		if !c.state.HasActiveLap(b.Imei) {
+			t.Errorf("bus %s has no active lap", b.Imei)
+		}
+	}
+	// The queued writes of every bus ran in order, so its last lap is still open
+	c.FlushPersister()
+	for _, b := range buses {
+		if lap, _ := c.busService.GetActiveLap(context.Background(), b.Imei); lap == nil {
+			t.Errorf("bus %s has no open lap in the database", b.Imei)
+		}
+	}
+	if stats := c.GetIngestStats(); stats.Accepted != busCount*fixesPerBus {
+		t.Errorf("accepted %d fixes, want %d", stats.Accepted, busCount*fixesPerBus)
+	}
+}
@@ -0,0 +1,134 @@
+package bus
+
+import (
+	"context"
+	"log"
+	"sync/atomic"
+	"time"
+
+	"github.com/FreeJ1nG/bikuntracker-backend/app/dto"
+	"github.com/FreeJ1nG/bikuntracker-backend/app/interfaces"
+	"github.com/FreeJ1nG/bikuntracker-backend/app/models"
+)
+
+const (
+	defaultTelemetryQueueSize     = 10000
+	defaultTelemetryBatchSize     = 500
+	defaultTelemetryFlushInterval = time.Second
+	telemetryWriteTimeout         = 10 * time.Second
+)
+
+// telemetryWriter persists accepted fixes to bus_position in batches from a background goroutine,
+// ingestion only enqueues and never waits for Postgres
+type telemetryWriter struct {
+	repo          interfaces.BusRepository
+	queue         chan models.BusPosition
+	batchSize     int
+	flushInterval time.Duration
+	written       atomic.Int64
+	dropped       atomic.Int64
+	failed        atomic.Int64
+}
+
+func NewTelemetryWriter(repo interfaces.BusRepository, config *models.Config) *telemetryWriter {
+	queueSize := config.TelemetryQueueSize
+	if queueSize <= 0 {
+		queueSize = defaultTelemetryQueueSize
+	}
+	batchSize := config.TelemetryBatchSize
+	if batchSize <= 0 {
+		batchSize = defaultTelemetryBatchSize
+	}
+	flushInterval := time.Duration(config.TelemetryFlushIntervalMs) * time.Millisecond
+	if flushInterval <= 0 {
+		flushInterval = defaultTelemetryFlushInterval
+	}
+	return &telemetryWriter{
+		repo:          repo,
+		queue:         make(chan models.BusPosition, queueSize),
+		batchSize:     batchSize,
+		flushInterval: flushInterval,
+	}
+}
+
+// Enqueue queues a position for writing, it is dropped if the queue is full
+func (t *telemetryWriter) Enqueue(position models.BusPosition) {
+	select {
+	case t.queue <- position:
+	default:
+		if t.dropped.Add(1)%1000 == 1 {
+			log.Printf("Telemetry queue is full, dropped %d positions so far", t.dropped.Load())
+		}
+	}
+}
+
+func (t *telemetryWriter) Stats() dto.TelemetryStats {
+	return dto.TelemetryStats{
+		Queued:  int64(len(t.queue)),
+		Written: t.written.Load(),
+		Dropped: t.dropped.Load(),
+		Failed:  t.failed.Load(),
+	}
+}
+
+// Run flushes queued positions every flush interval or whenever a batch fills up,
+// and drains the queue once ctx is cancelled
+func (t *telemetryWriter) Run(ctx context.Context) {
+	ticker := time.NewTicker(t.flushInterval)
+	defer ticker.Stop()
+
+	batch := make([]models.BusPosition, 0, t.batchSize)
+	for {
+		select {
+		case <-ctx.Done():
+			for {
+				select {
+				case position := <-t.queue:
+					batch = append(batch, position)
+					if len(batch) >= t.batchSize {
+						batch = t.flush(batch)
+					}
+				default:
+					t.flush(batch)
+					return
+				}
+			}
+		case position := <-t.queue:
+			batch = append(batch, position)
+			if len(batch) >= t.batchSize {
+				batch = t.flush(batch)
+			}
+		case <-ticker.C:
+			batch = t.flush(batch)
+		}
+	}
+}
+
+func (t *telemetryWriter) flush(batch []models.BusPosition) []models.BusPosition {
+	if len(batch) == 0 {
+		return batch
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), telemetryWriteTimeout)
+	defer cancel()
+	if err := t.repo.InsertBusPositions(ctx, batch); err != nil {
+		t.failed.Add(int64(len(batch)))
+		log.Printf("Failed to write %d telemetry positions: %v", len(batch), err)
+	} else {
+		t.written.Add(int64(len(batch)))
+	}
+	return batch[:0]
+}
+
+func coordinateToPosition(coord *models.BusCoordinate) models.BusPosition {
+	return models.BusPosition{
+		IMEI:       coord.Imei,
+		Latitude:   coord.Latitude,
+		Longitude:  coord.Longitude,
+		Speed:      coord.Speed,
+		Direction:  coord.Direction,
+		EngineOn:   coord.EngineOn,
+		Driver:     coord.Driver,
+		DeviceTime: coord.GpsTime,
+		ReceivedAt: coord.ReceivedAt,
+	}
+}
@@ -36,6 +36,8 @@ type LapEventData struct {
 	IMEI              string     `json:"imei"`
 	LapID             int        `json:"lap_id"`
 	LapNumber         int        `json:"lap_number"`
+	DailyLapNumber    int        `json:"daily_lap_number"`
+	ServiceDate       string     `json:"service_date"`
 	RouteColor        string     `json:"route_color"`
 	HalteVisitHistory string     `json:"halte_visit_history,omitempty"`
 	StartTime         time.Time  `json:"start_time"`
@@ -44,6 +46,21 @@ type LapEventData struct {
 	Timestamp         time.Time  `json:"timestamp"`
 }
 
+// BusEvent describes a transition detected by the ingestion pipeline
+type BusEvent struct {
+	Type           string    `json:"type"` // "arrived", "departed", "halte_switch", "color_change", "status_change", "lap_start" or "lap_end"
+	IMEI           string    `json:"imei"`
+	At             time.Time `json:"at"`
+	Halte          string    `json:"halte,omitempty"`
+	PreviousHalte  string    `json:"previous_halte,omitempty"`
+	Color          string    `json:"color,omitempty"`
+	PreviousColor  string    `json:"previous_color,omitempty"`
+	Status         string    `json:"status,omitempty"`
+	PreviousStatus string    `json:"previous_status,omitempty"`
+	LapNumber      int       `json:"lap_number,omitempty"`
+	DwellSeconds   float64   `json:"dwell_seconds,omitempty"` // time between arrival and departure, set on "departed"
+}
+
 // Paginated response structure
 type PaginatedResponse[T any] struct {
 	Success     bool `json:"success"`
@@ -61,11 +78,92 @@ type LapHistoryFilter struct {
 	IMEI       *string    `json:"imei,omitempty"`        // Filter by specific bus IMEI
 	BusID      *int       `json:"bus_id,omitempty"`      // Filter by bus ID
 	RouteColor *string    `json:"route_color,omitempty"` // Filter by route color (blue, red, grey, etc.)
+	Driver     *string    `json:"driver,omitempty"`      // Filter by the driver of the lap
 	FromDate   *time.Time `json:"from_date,omitempty"`   // Filter from start date
 	ToDate     *time.Time `json:"to_date,omitempty"`     // Filter to end date
 	StartTime  *string    `json:"start_time,omitempty"`  // Filter by time of day (HH:MM format)
 	EndTime    *string    `json:"end_time,omitempty"`    // Filter by time of day (HH:MM format)
-	Limit      *int       `json:"limit,omitempty"`       // Limit number of results
-	Offset     *int       `json:"offset,omitempty"`      // Offset for pagination
-	Page       *int       `json:"page,omitempty"`        // Page number (1-based)
+	// Filter by closure reason (completed, restarted, inactivity, max_duration)
+	ClosureReason *string `json:"closure_reason,omitempty"`
+	Anomalous     *bool   `json:"anomalous,omitempty"`      // Only laps with (true) or without (false) anomalies
+	Anomaly       *string `json:"anomaly,omitempty"`        // Only laps flagged with this anomaly
+	IncludeVoided bool    `json:"include_voided,omitempty"` // Also return laps voided by an admin
+	Limit         *int    `json:"limit,omitempty"`          // Limit number of results
+	Offset        *int    `json:"offset,omitempty"`         // Offset for pagination
+	Page          *int    `json:"page,omitempty"`           // Page number (1-based)
+}
+
+// LapStats aggregates the closed laps of one group, only the fields of the requested groupings are set
+type LapStats struct {
+	RouteColor            *string `json:"route_color,omitempty"`
+	BusID                 *int    `json:"bus_id,omitempty"`
+	IMEI                  *string `json:"imei,omitempty"`
+	BusNumber             *string `json:"bus_number,omitempty"`
+	ServiceDate           *string `json:"service_date,omitempty"` // Jakarta operating day, YYYY-MM-DD
+	Hour                  *int    `json:"hour,omitempty"`         // Jakarta hour of the lap start
+	LapCount              int     `json:"lap_count"`
+	CompletedCount        int     `json:"completed_count"`
+	AutoClosedCount       int     `json:"auto_closed_count"` // closed for inactivity or max duration
+	MeanDurationSeconds   float64 `json:"mean_duration_seconds"`
+	MedianDurationSeconds float64 `json:"median_duration_seconds"`
+	P90DurationSeconds    float64 `json:"p90_duration_seconds"`
+}
+
+type GetLapStatsResponse struct {
+	GroupBy []string   `json:"group_by"`
+	Groups  []LapStats `json:"groups"`
+}
+
+// SegmentTime is the median travel time between two consecutive stops of laps. Pooled buckets have no
+// Color and a nil Hour.
+type SegmentTime struct {
+	Color         string
+	FromHalte     string
+	ToHalte       string
+	Hour          *int // Jakarta hour of the arrival at FromHalte
+	MedianSeconds float64
+	Samples       int
+}
+
+// LapCorrectionRequest is an admin correction of a closed lap, the fields used depend on Action.
+// CorrectedBy is the name the admin gives for the audit trail, it is not checked against any account.
+type LapCorrectionRequest struct {
+	Action      string `json:"action"` // void, route_color, times, split or merge
+	CorrectedBy string `json:"corrected_by"`
+	Reason      string `json:"reason"`
+	// route_color: the route color the lap was actually driven on
+	RouteColor *string `json:"route_color,omitempty"`
+	// times: either or both bounds, the lap must stay on its service date
+	StartTime *time.Time `json:"start_time,omitempty"`
+	EndTime   *time.Time `json:"end_time,omitempty"`
+	// split: sequence of the halte visit that starts the new lap
+	SplitAtSequence *int `json:"split_at_sequence,omitempty"`
+	// merge: a lap of the same bus directly before or after this one
+	MergeWithLapID *int `json:"merge_with_lap_id,omitempty"`
+}
+
+// LapCorrectionChange is what an admin correction does to the laps it involves
+type LapCorrectionChange struct {
+	// After holds every lap involved as it is after the correction, with its visits. A lap with ID 0 is created.
+	After []models.BusLapHistory
+	// RelatedLapID is the other lap of a merge, nil when the correction creates a lap or involves a single one
+	RelatedLapID *int
+}
+
+// LapsBetweenFunc counts the laps of a bus that are not voided and started between two of its laps
+type LapsBetweenFunc func(earlier models.BusLapHistory, later models.BusLapHistory) (int, error)
+
+// DriverSummary is what a driver did in a date range. Hours on duty add up the stretches of fixes the driver's
+// buses reported without a long gap, laps are the closed laps started by the driver in the range.
+type DriverSummary struct {
+	Driver                 string  `json:"driver"`
+	LapCount               int     `json:"lap_count"`
+	HoursOnDuty            float64 `json:"hours_on_duty"`
+	MeanLapDurationSeconds float64 `json:"mean_lap_duration_seconds"`
+}
+
+type GetDriverSummaryResponse struct {
+	FromDate string          `json:"from_date"`
+	ToDate   string          `json:"to_date"`
+	Drivers  []DriverSummary `json:"drivers"`
 }
@@ -0,0 +1,44 @@
+package dto
+
+import "time"
+
+type CreateHalteRequestBody struct {
+	Name            string   `json:"name"`
+	Latitude        *float64 `json:"latitude"`
+	Longitude       *float64 `json:"longitude"`
+	ArrivalRadius   *float64 `json:"arrival_radius,omitempty"`
+	DepartureRadius *float64 `json:"departure_radius,omitempty"`
+	ImageUrl        string   `json:"image_url"`
+	Description     string   `json:"description"`
+}
+
+type UpdateHalteRequestBody struct {
+	Name            *string  `json:"name,omitempty"`
+	Latitude        *float64 `json:"latitude,omitempty"`
+	Longitude       *float64 `json:"longitude,omitempty"`
+	ArrivalRadius   *float64 `json:"arrival_radius,omitempty"`
+	DepartureRadius *float64 `json:"departure_radius,omitempty"`
+	ImageUrl        *string  `json:"image_url,omitempty"`
+	Description     *string  `json:"description,omitempty"`
+}
+
+// HalteArrival is a bus heading to a stop with its predicted arrival
+type HalteArrival struct {
+	Imei         string    `json:"imei"`
+	BusNumber    string    `json:"bus_number"`
+	PlateNumber  string    `json:"plate_number"`
+	Color        string    `json:"color"`
+	Latitude     float64   `json:"latitude"`
+	Longitude    float64   `json:"longitude"`
+	Status       string    `json:"status"`
+	GpsTime      time.Time `json:"gps_time"`
+	CurrentHalte string    `json:"current_halte"`
+	StopsAway    int       `json:"stops_away"` // 0 when the bus is at the stop
+	ArrivalTime  time.Time `json:"arrival_time"`
+	Seconds      int       `json:"seconds"`
+}
+
+type GetHalteArrivalsResponse struct {
+	Halte    string         `json:"halte"`
+	Arrivals []HalteArrival `json:"arrivals"`
+}
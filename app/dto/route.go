@@ -0,0 +1,33 @@
+package dto
+
+import (
+	"encoding/json"
+
+	"github.com/FreeJ1nG/bikuntracker-backend/app/models"
+)
+
+type CreateRouteRequestBody struct {
+	Name     string   `json:"name"`
+	Color    string   `json:"color"`
+	Variant  string   `json:"variant"`
+	IsActive *bool    `json:"is_active,omitempty"`
+	Stops    []string `json:"stops"`
+	// GeoJSON is an optional LineString, Feature or FeatureCollection with the path of the route
+	GeoJSON json.RawMessage `json:"geojson,omitempty"`
+	// Polyline is parsed from GeoJSON by the handler
+	Polyline [][2]float64 `json:"-"`
+	// LapRule is optional, routes without one use the built-in lap rule
+	LapRule *models.LapRule `json:"lap_rule,omitempty"`
+}
+
+// UpdateRouteRequestBody replaces the given fields, Stops replaces the whole stop sequence
+type UpdateRouteRequestBody struct {
+	Name     *string         `json:"name,omitempty"`
+	Color    *string         `json:"color,omitempty"`
+	Variant  *string         `json:"variant,omitempty"`
+	IsActive *bool           `json:"is_active,omitempty"`
+	Stops    []string        `json:"stops,omitempty"`
+	GeoJSON  json.RawMessage `json:"geojson,omitempty"`
+	Polyline [][2]float64    `json:"-"`
+	LapRule  *models.LapRule `json:"lap_rule,omitempty"`
+}
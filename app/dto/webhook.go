@@ -11,6 +11,37 @@ type WebhookPayload struct {
 	} `json:"event"`
 }
 
+// WebhookBatchPayload carries fixes of many vehicles in a single delivery
+type WebhookBatchPayload struct {
+	EventTime int64  `json:"event_time"`
+	EventID   int    `json:"event_id"`
+	EventName string `json:"event_name"`
+	EventType string `json:"event_type"`
+	Event     struct {
+		Data []WebhookData `json:"data"`
+	} `json:"event"`
+}
+
+// WebhookUpdateResponse reports whether the fix of a single delivery was accepted, Reason says why it was dropped
+type WebhookUpdateResponse struct {
+	IMEI     string `json:"imei"`
+	Accepted bool   `json:"accepted"`
+	Reason   string `json:"reason,omitempty"`
+}
+
+type WebhookBatchItemResult struct {
+	Index    int    `json:"index"`
+	IMEI     string `json:"imei"`
+	Accepted bool   `json:"accepted"`
+	Reason   string `json:"reason,omitempty"`
+}
+
+type WebhookBatchResponse struct {
+	Accepted int                      `json:"accepted"`
+	Rejected int                      `json:"rejected"`
+	Results  []WebhookBatchItemResult `json:"results"`
+}
+
 // WebhookData contains the actual location data
 type WebhookData struct {
 	LicensePlate string  `json:"license_plate"`
@@ -1,8 +1,52 @@
 package dto
 
-import "github.com/FreeJ1nG/bikuntracker-backend/app/models"
+import (
+	"time"
+
+	"github.com/FreeJ1nG/bikuntracker-backend/app/models"
+)
 
 type CoordinateBroadcastMessage struct {
 	Coordinates       []models.BusCoordinate `json:"coordinates"`
 	OperationalStatus int                    `json:"operationalStatus"`
 }
+
+// IngestStats counts fixes accepted and dropped by the ingestion pipeline since startup
+type IngestStats struct {
+	Accepted   int64 `json:"accepted"`
+	Duplicate  int64 `json:"duplicate"`
+	OutOfOrder int64 `json:"out_of_order"`
+	Future     int64 `json:"future"`
+	// Filtered counts fixes dropped as GPS noise
+	Filtered FilterStats `json:"filtered"`
+	// Telemetry is only set when positions are persisted
+	Telemetry *TelemetryStats `json:"telemetry,omitempty"`
+}
+
+type FilterStats struct {
+	ZeroPosition    int64 `json:"zero_position"`
+	OutsideArea     int64 `json:"outside_area"`
+	ImpossibleSpeed int64 `json:"impossible_speed"`
+}
+
+type TelemetryStats struct {
+	Queued  int64 `json:"queued"`
+	Written int64 `json:"written"`
+	Dropped int64 `json:"dropped"`
+	Failed  int64 `json:"failed"`
+}
+
+// LocationSourceStatus reports the health of a pull based location source
+type LocationSourceStatus struct {
+	Name           string     `json:"name"`
+	Connected      bool       `json:"connected"`
+	ConnectedSince *time.Time `json:"connected_since,omitempty"`
+	LastMessageAt  *time.Time `json:"last_message_at,omitempty"`
+	ReconnectCount int        `json:"reconnect_count"`
+	LastError      string     `json:"last_error,omitempty"`
+}
+
+type IngestStatusResponse struct {
+	Sources []LocationSourceStatus `json:"sources"`
+	Stats   IngestStats            `json:"stats"`
+}
@@ -0,0 +1,35 @@
+package eta
+
+import (
+	"github.com/FreeJ1nG/bikuntracker-backend/app/dto"
+)
+
+const (
+	// Samples longer than this are breaks between trips rather than driving time
+	maxSegmentSeconds = 20 * 60
+	// A time of day bucket is only trusted once it holds this many samples
+	minBucketSamples = 3
+	anyHour          = -1
+	anyColor         = ""
+)
+
+// segmentKey identifies the travel time between two consecutive stops, anyHour and anyColor hold the pooled samples
+type segmentKey struct {
+	color string
+	from  string
+	to    string
+	hour  int
+}
+
+// segmentsByKey indexes the segment times computed from lap history, pooled buckets are stored under anyColor and anyHour
+func segmentsByKey(rows []dto.SegmentTime) map[segmentKey]float64 {
+	res := make(map[segmentKey]float64, len(rows))
+	for _, row := range rows {
+		hour := anyHour
+		if row.Hour != nil {
+			hour = *row.Hour
+		}
+		res[segmentKey{row.Color, row.FromHalte, row.ToHalte, hour}] = row.MedianSeconds
+	}
+	return res
+}
@@ -0,0 +1,196 @@
+package eta
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/FreeJ1nG/bikuntracker-backend/app/bus"
+	"github.com/FreeJ1nG/bikuntracker-backend/app/interfaces"
+	"github.com/FreeJ1nG/bikuntracker-backend/app/models"
+	"github.com/FreeJ1nG/bikuntracker-backend/app/route"
+	"github.com/FreeJ1nG/bikuntracker-backend/utils"
+)
+
+const (
+	defaultHistoryDays = 28
+	refreshInterval    = 15 * time.Minute
+	// Segments without history are estimated from the straight line distance at a typical campus speed
+	fallbackSpeedKmh     = 15
+	fallbackDwellSeconds = 20
+)
+
+type service struct {
+	busService   interfaces.BusService
+	halteCatalog interfaces.HalteCatalog
+	routeCatalog interfaces.RouteCatalog
+	historyDays  int
+
+	mu       sync.RWMutex
+	segments map[segmentKey]float64 // median seconds
+}
+
+func NewService(
+	config *models.Config,
+	busService interfaces.BusService,
+	halteCatalog interfaces.HalteCatalog,
+	routeCatalog interfaces.RouteCatalog,
+) *service {
+	historyDays := config.EtaHistoryDays
+	if historyDays <= 0 {
+		historyDays = defaultHistoryDays
+	}
+	return &service{
+		busService:   busService,
+		halteCatalog: halteCatalog,
+		routeCatalog: routeCatalog,
+		historyDays:  historyDays,
+		segments:     make(map[segmentKey]float64),
+	}
+}
+
+// Refresh relearns the segment travel times from the laps of the last ETA_HISTORY_DAYS days,
+// the medians are computed by the database
+func (s *service) Refresh(ctx context.Context) error {
+	from := time.Now().AddDate(0, 0, -s.historyDays)
+	rows, err := s.busService.GetSegmentTimes(ctx, from, maxSegmentSeconds, minBucketSamples)
+	if err != nil {
+		return fmt.Errorf("unable to load segment times: %w", err)
+	}
+	segments := segmentsByKey(rows)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.segments = segments
+	log.Printf("Learned %d segment travel times", len(segments))
+	return nil
+}
+
+// RunRefresher relearns the segment travel times periodically until ctx is cancelled
+func (s *service) RunRefresher(ctx context.Context) {
+	ticker := time.NewTicker(refreshInterval)
+	defer ticker.Stop()
+	for {
+		if err := s.Refresh(ctx); err != nil {
+			log.Printf("Failed to refresh ETA segment times: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// segmentSeconds returns the travel time between consecutive stops, preferring the route color and hour of day
+// and falling back to the pooled samples, then to the distance between both stops
+func (s *service) segmentSeconds(color, from, to string, hour int) float64 {
+	s.mu.RLock()
+	for _, key := range []segmentKey{
+		{color, from, to, hour},
+		{anyColor, from, to, hour},
+		{color, from, to, anyHour},
+		{anyColor, from, to, anyHour},
+	} {
+		if seconds, ok := s.segments[key]; ok {
+			s.mu.RUnlock()
+			return seconds
+		}
+	}
+	s.mu.RUnlock()
+
+	fromHalte, okFrom := s.halteCatalog.Halte(from)
+	toHalte, okTo := s.halteCatalog.Halte(to)
+	if !okFrom || !okTo {
+		return fallbackDwellSeconds
+	}
+	dist := utils.DistanceMeters(fromHalte.Latitude, fromHalte.Longitude, toHalte.Latitude, toHalte.Longitude)
+	return dist/(fallbackSpeedKmh/3.6) + fallbackDwellSeconds
+}
+
+// remainingFraction estimates how much of the leg from one stop to the next a bus still has to drive
+func (s *service) remainingFraction(coord models.BusCoordinate, from, to string) float64 {
+	if coord.AtHalte == from {
+		return 1
+	}
+	if coord.RouteProgress != nil && coord.RouteProgress.FromHalte == from && coord.RouteProgress.ToHalte == to {
+		return 1 - coord.RouteProgress.SegmentProgress
+	}
+	fromHalte, okFrom := s.halteCatalog.Halte(from)
+	toHalte, okTo := s.halteCatalog.Halte(to)
+	if !okFrom || !okTo {
+		return 1
+	}
+	driven := utils.DistanceMeters(fromHalte.Latitude, fromHalte.Longitude, coord.Latitude, coord.Longitude)
+	left := utils.DistanceMeters(coord.Latitude, coord.Longitude, toHalte.Latitude, toHalte.Longitude)
+	if driven+left == 0 {
+		return 1
+	}
+	return left / (driven + left)
+}
+
+// Predict walks the route of a bus from its current stop and adds up the learned segment times.
+// Offline buses, buses without a detected route and buses off their route get no prediction.
+func (s *service) Predict(coord models.BusCoordinate, now time.Time) []models.HalteEta {
+	if coord.Status == models.BUS_STATUS_OFFLINE || coord.CurrentHalte == "" {
+		return nil
+	}
+	r, ok := s.routeCatalog.Route(route.CoordinateRoute(coord))
+	if !ok {
+		return nil
+	}
+	// Stops passed twice are disambiguated by the next halte derived by the pipeline
+	n := len(r.Stops)
+	current := -1
+	for i, stop := range r.Stops {
+		if stop != coord.CurrentHalte {
+			continue
+		}
+		if current < 0 || r.Stops[(i+1)%n] == coord.NextHalte {
+			current = i
+		}
+		if r.Stops[(i+1)%n] == coord.NextHalte {
+			break
+		}
+	}
+	if current < 0 || n < 2 {
+		return nil
+	}
+
+	// Segment times are learned per lap route color, which holds the variant
+	lapColor := route.BusColor(r.Color, r.Variant)
+	res := make([]models.HalteEta, 0, n-1)
+	at := coord.GpsTime
+	for k := 1; k < n; k++ {
+		from, to := r.Stops[(current+k-1)%n], r.Stops[(current+k)%n]
+		seconds := s.segmentSeconds(lapColor, from, to, at.In(bus.Jakarta).Hour())
+		if k == 1 {
+			seconds *= s.remainingFraction(coord, from, to)
+		}
+		at = at.Add(time.Duration(seconds * float64(time.Second)))
+		res = append(res, models.HalteEta{Halte: to, ArrivalTime: at})
+	}
+
+	// A bus running late pushes every arrival back instead of predicting arrivals in the past
+	if delay := now.Sub(res[0].ArrivalTime); delay > 0 {
+		for i := range res {
+			res[i].ArrivalTime = res[i].ArrivalTime.Add(delay)
+		}
+	}
+	for i := range res {
+		res[i].ArrivalTime = res[i].ArrivalTime.Truncate(time.Second)
+		res[i].Seconds = int(res[i].ArrivalTime.Sub(now).Seconds())
+		if res[i].Seconds < 0 {
+			res[i].Seconds = 0
+		}
+	}
+	return res
+}
+
+func (s *service) Annotate(coords []models.BusCoordinate, now time.Time) {
+	for i := range coords {
+		coords[i].Etas = s.Predict(coords[i], now)
+	}
+}
@@ -0,0 +1,91 @@
+package halte
+
+import (
+	"context"
+	"log"
+	"sync"
+
+	"github.com/FreeJ1nG/bikuntracker-backend/app/interfaces"
+	"github.com/FreeJ1nG/bikuntracker-backend/app/models"
+)
+
+const (
+	DEFAULT_ARRIVAL_RADIUS   = 45 // meters
+	DEFAULT_DEPARTURE_RADIUS = 70 // meters
+)
+
+// catalog keeps the stops of the bus_stop table in memory. It starts with the built-in stops and
+// keeps them whenever the table holds no stop with coordinates, so detection never runs without stops.
+type catalog struct {
+	repo interfaces.HalteRepository
+
+	mu     sync.RWMutex
+	haltes []models.Halte
+	byName map[string]models.Halte
+}
+
+// NewCatalog creates a catalog backed by repo, a nil repo only serves the built-in stops
+func NewCatalog(repo interfaces.HalteRepository) *catalog {
+	c := &catalog{repo: repo}
+	c.set(defaultHaltes)
+	return c
+}
+
+func (c *catalog) set(haltes []models.Halte) {
+	byName := make(map[string]models.Halte, len(haltes))
+	for _, halte := range haltes {
+		byName[halte.Name] = halte
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.haltes = haltes
+	c.byName = byName
+}
+
+// Haltes returns a copy of the stops, callers may modify it freely
+func (c *catalog) Haltes() []models.Halte {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	res := make([]models.Halte, len(c.haltes))
+	copy(res, c.haltes)
+	return res
+}
+
+func (c *catalog) Halte(name string) (models.Halte, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	halte, ok := c.byName[name]
+	return halte, ok
+}
+
+// Reload replaces the stops with the located rows of the bus_stop table
+func (c *catalog) Reload(ctx context.Context) error {
+	if c.repo == nil {
+		return nil
+	}
+	rows, err := c.repo.GetHaltes(ctx)
+	if err != nil {
+		return err
+	}
+	haltes := make([]models.Halte, 0, len(rows))
+	for _, halte := range rows {
+		if halte.Latitude == 0 && halte.Longitude == 0 {
+			continue
+		}
+		if halte.ArrivalRadius <= 0 {
+			halte.ArrivalRadius = DEFAULT_ARRIVAL_RADIUS
+		}
+		if halte.DepartureRadius < halte.ArrivalRadius {
+			halte.DepartureRadius = halte.ArrivalRadius
+		}
+		haltes = append(haltes, halte)
+	}
+	if len(haltes) == 0 {
+		log.Println("bus_stop has no stops with coordinates, keeping the built-in halte list")
+		c.set(defaultHaltes)
+		return nil
+	}
+	c.set(haltes)
+	log.Printf("Loaded %d haltes from bus_stop", len(haltes))
+	return nil
+}
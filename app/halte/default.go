@@ -0,0 +1,29 @@
+package halte
+
+import "github.com/FreeJ1nG/bikuntracker-backend/app/models"
+
+// defaultHaltes are the stops seeded by migrations 000011 and 000014, used until bus_stop holds located stops
+var defaultHaltes = []models.Halte{
+	{Name: "Asrama UI", Latitude: -6.348351370044594, Longitude: 106.82976588606834, ArrivalRadius: DEFAULT_ARRIVAL_RADIUS, DepartureRadius: DEFAULT_DEPARTURE_RADIUS},
+	{Name: "Menwa", Latitude: -6.353471269466313, Longitude: 106.83177955448627, ArrivalRadius: DEFAULT_ARRIVAL_RADIUS, DepartureRadius: DEFAULT_DEPARTURE_RADIUS},
+	{Name: "Stasiun UI", Latitude: -6.361052900888018, Longitude: 106.83170076459645, ArrivalRadius: DEFAULT_ARRIVAL_RADIUS, DepartureRadius: DEFAULT_DEPARTURE_RADIUS},
+	{Name: "Fakultas Psikologi", Latitude: -6.36255935735158, Longitude: 106.83111906051636, ArrivalRadius: DEFAULT_ARRIVAL_RADIUS, DepartureRadius: DEFAULT_DEPARTURE_RADIUS},
+	{Name: "FISIP", Latitude: -6.361574, Longitude: 106.830172, ArrivalRadius: 25, DepartureRadius: 40},
+	{Name: "Fakultas Ilmu Pengetahuan Budaya", Latitude: -6.361254501381427, Longitude: 106.82978868484497, ArrivalRadius: 25, DepartureRadius: 40},
+	{Name: "Fakultas Ekonomi dan Bisnis", Latitude: -6.35946048561971, Longitude: 106.82582974433899, ArrivalRadius: DEFAULT_ARRIVAL_RADIUS, DepartureRadius: DEFAULT_DEPARTURE_RADIUS},
+	{Name: "Fakultas Teknik", Latitude: -6.361043911445512, Longitude: 106.82325214147568, ArrivalRadius: DEFAULT_ARRIVAL_RADIUS, DepartureRadius: DEFAULT_DEPARTURE_RADIUS},
+	{Name: "Vokasi", Latitude: -6.366036735678631, Longitude: 106.8216535449028, ArrivalRadius: DEFAULT_ARRIVAL_RADIUS, DepartureRadius: DEFAULT_DEPARTURE_RADIUS},
+	{Name: "SOR", Latitude: -6.366915739619239, Longitude: 106.82448193430899, ArrivalRadius: DEFAULT_ARRIVAL_RADIUS, DepartureRadius: DEFAULT_DEPARTURE_RADIUS},
+	{Name: "FMIPA", Latitude: -6.369828304090281, Longitude: 106.8257811293006, ArrivalRadius: DEFAULT_ARRIVAL_RADIUS, DepartureRadius: DEFAULT_DEPARTURE_RADIUS},
+	{Name: "Fakultas Ilmu Keperawatan", Latitude: -6.371008186217929, Longitude: 106.8268945813179, ArrivalRadius: DEFAULT_ARRIVAL_RADIUS, DepartureRadius: DEFAULT_DEPARTURE_RADIUS},
+	{Name: "Fakultas Kesehatan Masyarakat", Latitude: -6.371677262480034, Longitude: 106.8293622136116, ArrivalRadius: DEFAULT_ARRIVAL_RADIUS, DepartureRadius: DEFAULT_DEPARTURE_RADIUS},
+	{Name: "RIK", Latitude: -6.36987795182555, Longitude: 106.8310546875, ArrivalRadius: DEFAULT_ARRIVAL_RADIUS, DepartureRadius: DEFAULT_DEPARTURE_RADIUS},
+	{Name: "Stasiun Pondok Cina", Latitude: -6.368212251024606, Longitude: 106.83178257197142, ArrivalRadius: DEFAULT_ARRIVAL_RADIUS, DepartureRadius: DEFAULT_DEPARTURE_RADIUS},
+	{Name: "MUI/Perpus UI", Latitude: -6.3655942342627565, Longitude: 106.83204710483551, ArrivalRadius: 35, DepartureRadius: 50},
+	{Name: "Fakultas Hukum", Latitude: -6.364901492199248, Longitude: 106.83221206068993, ArrivalRadius: 35, DepartureRadius: 50},
+	{Name: "Parking", Latitude: -6.348922, Longitude: 106.826476, ArrivalRadius: DEFAULT_ARRIVAL_RADIUS, DepartureRadius: DEFAULT_DEPARTURE_RADIUS},
+	{Name: "Balai Sidang", Latitude: -6.369147, Longitude: 106.828450, ArrivalRadius: DEFAULT_ARRIVAL_RADIUS, DepartureRadius: DEFAULT_DEPARTURE_RADIUS},
+	{Name: "Balairung", Latitude: -6.36913, Longitude: 106.82963, ArrivalRadius: DEFAULT_ARRIVAL_RADIUS, DepartureRadius: DEFAULT_DEPARTURE_RADIUS},
+	{Name: "Fakultas Farmasi", Latitude: -6.36813, Longitude: 106.82731, ArrivalRadius: DEFAULT_ARRIVAL_RADIUS, DepartureRadius: DEFAULT_DEPARTURE_RADIUS},
+	{Name: "RSUI", Latitude: -6.37285, Longitude: 106.82869, ArrivalRadius: DEFAULT_ARRIVAL_RADIUS, DepartureRadius: DEFAULT_DEPARTURE_RADIUS},
+}
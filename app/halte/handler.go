@@ -0,0 +1,235 @@
+package halte
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/FreeJ1nG/bikuntracker-backend/app/dto"
+	"github.com/FreeJ1nG/bikuntracker-backend/app/interfaces"
+	"github.com/FreeJ1nG/bikuntracker-backend/app/models"
+	"github.com/FreeJ1nG/bikuntracker-backend/utils"
+	"github.com/FreeJ1nG/bikuntracker-backend/utils/middleware"
+)
+
+type handler struct {
+	repo         interfaces.HalteRepository
+	catalog      interfaces.HalteCatalog
+	busContainer interfaces.BusContainer
+	etaService   interfaces.EtaService
+}
+
+func NewHandler(
+	repo interfaces.HalteRepository,
+	catalog interfaces.HalteCatalog,
+	busContainer interfaces.BusContainer,
+	etaService interfaces.EtaService,
+) *handler {
+	return &handler{
+		repo:         repo,
+		catalog:      catalog,
+		busContainer: busContainer,
+		etaService:   etaService,
+	}
+}
+
+func validateLocation(latitude, longitude, arrivalRadius, departureRadius *float64) error {
+	if latitude != nil && (*latitude < -90 || *latitude > 90 || *latitude == 0) {
+		return fmt.Errorf("latitude must be a non-zero value between -90 and 90")
+	}
+	if longitude != nil && (*longitude < -180 || *longitude > 180 || *longitude == 0) {
+		return fmt.Errorf("longitude must be a non-zero value between -180 and 180")
+	}
+	if arrivalRadius != nil && *arrivalRadius <= 0 {
+		return fmt.Errorf("arrival_radius must be greater than 0")
+	}
+	if departureRadius != nil && *departureRadius <= 0 {
+		return fmt.Errorf("departure_radius must be greater than 0")
+	}
+	if arrivalRadius != nil && departureRadius != nil && *departureRadius < *arrivalRadius {
+		return ErrDepartureRadius
+	}
+	return nil
+}
+
+// reloadCatalog applies a change right away on this instance, other instances pick it up through catalog_changed
+func (h *handler) reloadCatalog(ctx context.Context) {
+	if err := h.catalog.Reload(ctx); err != nil {
+		log.Printf("Failed to reload halte catalog: %v", err)
+	}
+}
+
+func (h *handler) GetHaltes(w http.ResponseWriter, r *http.Request) {
+	ctx := context.Background()
+
+	res, err := h.repo.GetHaltes(ctx)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	utils.EncodeSuccessResponse[[]models.Halte](w, res)
+}
+
+func (h *handler) CreateHalte(w http.ResponseWriter, r *http.Request) {
+	ctx := context.Background()
+
+	body, err := utils.ParseRequestBody[dto.CreateHalteRequestBody](r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	body.Name = strings.TrimSpace(body.Name)
+	if body.Name == "" {
+		http.Error(w, "name is required", http.StatusBadRequest)
+		return
+	}
+	if body.Latitude == nil || body.Longitude == nil {
+		http.Error(w, "latitude and longitude are required", http.StatusBadRequest)
+		return
+	}
+	if body.ArrivalRadius == nil {
+		radius := float64(DEFAULT_ARRIVAL_RADIUS)
+		body.ArrivalRadius = &radius
+	}
+	if body.DepartureRadius == nil {
+		// Keep the default gap between both radii when only the arrival radius is given
+		radius := *body.ArrivalRadius + DEFAULT_DEPARTURE_RADIUS - DEFAULT_ARRIVAL_RADIUS
+		body.DepartureRadius = &radius
+	}
+	if err := validateLocation(body.Latitude, body.Longitude, body.ArrivalRadius, body.DepartureRadius); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	res, err := h.repo.CreateHalte(ctx, body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	h.reloadCatalog(ctx)
+
+	utils.EncodeSuccessResponse[models.Halte](w, *res)
+}
+
+func (h *handler) UpdateHalte(w http.ResponseWriter, r *http.Request) {
+	ctx := context.Background()
+
+	body, err := utils.ParseRequestBody[dto.UpdateHalteRequestBody](r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if body == (dto.UpdateHalteRequestBody{}) {
+		http.Error(w, "no field to update", http.StatusBadRequest)
+		return
+	}
+	if body.Name != nil {
+		name := strings.TrimSpace(*body.Name)
+		if name == "" {
+			http.Error(w, "name cannot be empty", http.StatusBadRequest)
+			return
+		}
+		body.Name = &name
+	}
+	if err := validateLocation(body.Latitude, body.Longitude, body.ArrivalRadius, body.DepartureRadius); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	id, status, err := middleware.GetRouteParam(r, "id")
+	if err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+
+	res, err := h.repo.UpdateHalte(ctx, &models.WhereData{FieldName: "id", Value: id}, body)
+	if err != nil {
+		if errors.Is(err, ErrDepartureRadius) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	h.reloadCatalog(ctx)
+
+	utils.EncodeSuccessResponse[models.Halte](w, *res)
+}
+
+func (h *handler) DeleteHalte(w http.ResponseWriter, r *http.Request) {
+	ctx := context.Background()
+
+	id, status, err := middleware.GetRouteParam(r, "id")
+	if err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+
+	err = h.repo.DeleteHalte(ctx, id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	h.reloadCatalog(ctx)
+
+	utils.EncodeEmptySuccessResponse(w)
+}
+
+// GetHalteArrivals lists the buses heading to a stop, soonest first. A bus at the stop is listed with 0 stops away,
+// other buses are listed when the stop is one of the remaining stops of their route.
+func (h *handler) GetHalteArrivals(w http.ResponseWriter, r *http.Request) {
+	name, status, err := middleware.GetRouteParam(r, "name")
+	if err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+	if _, ok := h.catalog.Halte(name); !ok {
+		http.Error(w, fmt.Sprintf("no halte found with name %q", name), http.StatusNotFound)
+		return
+	}
+
+	now := time.Now()
+	arrivals := make([]dto.HalteArrival, 0)
+	for _, coord := range h.busContainer.GetBusCoordinates() {
+		arrival := dto.HalteArrival{
+			Imei:         coord.Imei,
+			BusNumber:    coord.BusNumber,
+			PlateNumber:  coord.PlateNumber,
+			Color:        coord.Color,
+			Latitude:     coord.Latitude,
+			Longitude:    coord.Longitude,
+			Status:       coord.Status,
+			GpsTime:      coord.GpsTime,
+			CurrentHalte: coord.CurrentHalte,
+		}
+		if coord.AtHalte == name && coord.Status != models.BUS_STATUS_OFFLINE {
+			arrival.ArrivalTime = now.Truncate(time.Second)
+			arrivals = append(arrivals, arrival)
+			continue
+		}
+		for i, eta := range h.etaService.Predict(coord, now) {
+			if eta.Halte == name {
+				arrival.StopsAway = i + 1
+				arrival.ArrivalTime = eta.ArrivalTime
+				arrival.Seconds = eta.Seconds
+				arrivals = append(arrivals, arrival)
+				break
+			}
+		}
+	}
+	sort.SliceStable(arrivals, func(i, j int) bool {
+		return arrivals[i].ArrivalTime.Before(arrivals[j].ArrivalTime)
+	})
+
+	utils.EncodeSuccessResponse[dto.GetHalteArrivalsResponse](w, dto.GetHalteArrivalsResponse{
+		Halte:    name,
+		Arrivals: arrivals,
+	})
+}
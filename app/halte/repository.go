@@ -0,0 +1,119 @@
+package halte
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+
+	"github.com/FreeJ1nG/bikuntracker-backend/app/dto"
+	"github.com/FreeJ1nG/bikuntracker-backend/app/models"
+	"github.com/FreeJ1nG/bikuntracker-backend/utils"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+const halteColumns = "id, name, latitude, longitude, arrival_radius, departure_radius, image_url, description, created_at, updated_at"
+
+var ErrDepartureRadius = errors.New("departure_radius must be at least arrival_radius")
+
+type repository struct {
+	db *pgxpool.Pool
+}
+
+func NewRepository(db *pgxpool.Pool) *repository {
+	return &repository{
+		db: db,
+	}
+}
+
+func scanHalte(row pgx.Row) (res models.Halte, err error) {
+	var latitude, longitude sql.NullFloat64
+	err = row.Scan(
+		&res.Id,
+		&res.Name,
+		&latitude,
+		&longitude,
+		&res.ArrivalRadius,
+		&res.DepartureRadius,
+		&res.ImageUrl,
+		&res.Description,
+		&res.CreatedAt,
+		&res.UpdatedAt,
+	)
+	// Stops created before coordinates existed are kept at (0,0), the catalog skips them
+	res.Latitude = latitude.Float64
+	res.Longitude = longitude.Float64
+	return
+}
+
+func (r *repository) GetHaltes(ctx context.Context) (res []models.Halte, err error) {
+	rows, err := r.db.Query(ctx, `SELECT `+halteColumns+` FROM bus_stop ORDER BY id;`)
+	if err != nil {
+		err = fmt.Errorf("unable to execute SQL query to get haltes: %w", err)
+		return
+	}
+	defer rows.Close()
+
+	res = make([]models.Halte, 0)
+	for rows.Next() {
+		halte, scanErr := scanHalte(rows)
+		if scanErr != nil {
+			err = fmt.Errorf("unable to scan halte: %w", scanErr)
+			return
+		}
+		res = append(res, halte)
+	}
+	return
+}
+
+func (r *repository) CreateHalte(ctx context.Context, data dto.CreateHalteRequestBody) (res *models.Halte, err error) {
+	row := r.db.QueryRow(
+		ctx,
+		`INSERT INTO bus_stop (name, latitude, longitude, arrival_radius, departure_radius, image_url, description) VALUES ($1, $2, $3, $4, $5, $6, $7) RETURNING `+halteColumns+`;`,
+		data.Name,
+		data.Latitude,
+		data.Longitude,
+		data.ArrivalRadius,
+		data.DepartureRadius,
+		data.ImageUrl,
+		data.Description,
+	)
+	created, err := scanHalte(row)
+	if err != nil {
+		err = fmt.Errorf("unable to execute create halte SQL: %w", err)
+		return
+	}
+	res = &created
+	return
+}
+
+func (r *repository) UpdateHalte(ctx context.Context, whereData *models.WhereData, data dto.UpdateHalteRequestBody) (res *models.Halte, err error) {
+	sqlStr, params, err := utils.GetPartialUpdateSQL("bus_stop", data, whereData)
+	if err != nil {
+		return
+	}
+	row := r.db.QueryRow(ctx, sqlStr+" RETURNING "+halteColumns, params...)
+	updated, err := scanHalte(row)
+	if err != nil {
+		if err == pgx.ErrNoRows {
+			err = fmt.Errorf("no halte found with %s = %v", whereData.FieldName, whereData.Value)
+			return
+		}
+		var pgErr *pgconn.PgError
+		if errors.As(err, &pgErr) && pgErr.ConstraintName == "bus_stop_departure_radius_check" {
+			err = ErrDepartureRadius
+			return
+		}
+		err = fmt.Errorf("unable to execute update halte SQL: %w", err)
+		return
+	}
+	res = &updated
+	return
+}
+
+func (r *repository) DeleteHalte(ctx context.Context, id string) (err error) {
+	_, err = r.db.Exec(ctx, "DELETE FROM bus_stop WHERE id = $1", id)
+	return
+}
@@ -2,6 +2,7 @@ package interfaces
 
 import (
 	"context"
+	"time"
 
 	"github.com/FreeJ1nG/bikuntracker-backend/app/dto"
 	"github.com/FreeJ1nG/bikuntracker-backend/app/models"
@@ -10,6 +11,35 @@ import (
 type BusContainer interface {
 	RunCron() (err error)
 	UpdateRuntimeBusColor(imei string, newColor string) error
+	// Runtime state accessors, every read returns a snapshot that is safe to use concurrently
+	GetBusCoordinates() []models.BusCoordinate
+	GetBusCoordinatesMap() map[string]*models.BusCoordinate
+	GetPreviousHalte(imei string) string
+	GetIngestStats() dto.IngestStats
+	GetLocationSourceStatuses() []dto.LocationSourceStatus
+	RefreshBusMetadata(ctx context.Context)
+	ApplyExternalCoordinates(fixes []*models.BusCoordinate) []error
+	// LapAnomalies lists what looks wrong about a closed lap under the lap rule of its route
+	LapAnomalies(lap models.BusLapHistory) []string
+}
+
+// LocationSink receives normalized fixes, implemented by the bus container
+type LocationSink interface {
+	ApplyExternalCoordinates(fixes []*models.BusCoordinate) []error
+}
+
+// LocationSource turns a location feed into normalized BusCoordinate fixes and pushes them into a sink
+type LocationSource interface {
+	Name() string
+	// Run consumes the feed until ctx is cancelled
+	Run(ctx context.Context, sink LocationSink) error
+	Status() dto.LocationSourceStatus
+}
+
+// TelemetryWriter persists accepted fixes without blocking the caller
+type TelemetryWriter interface {
+	Enqueue(position models.BusPosition)
+	Stats() dto.TelemetryStats
 }
 
 type BusService interface {
@@ -17,13 +47,31 @@ type BusService interface {
 	UpdateBusPlateNumberByImei(ctx context.Context, imei string, plateNumber string) (*models.Bus, error)
 	UpdateCurrentHalteByImei(ctx context.Context, imei string, newHalte string) (*models.Bus, error)
 	GetAllBuses(ctx context.Context) ([]models.Bus, error)
+	// Driver methods
+	RecordDriverChange(ctx context.Context, imei string, previousDriver string, driver string, changedAt time.Time) error
+	GetCurrentDrivers(ctx context.Context) (map[string]string, error)
 	// Lap history methods
-	StartLap(ctx context.Context, imei string, routeColor string) (*models.BusLapHistory, error)
+	StartLap(ctx context.Context, imei string, routeColor string, driver string, firstVisit models.LapHalteVisit) (*models.BusLapHistory, error)
 	EndLap(ctx context.Context, imei string) (*models.BusLapHistory, error)
+	EndLapAt(ctx context.Context, imei string, endTime time.Time, routeColor string, closureReason string) (*models.BusLapHistory, error)
+	// CloseLap closes any open lap, keeping its route color
+	CloseLap(ctx context.Context, lap models.BusLapHistory, endTime time.Time, closureReason string) (*models.BusLapHistory, error)
+	SetLapAnomalies(ctx context.Context, lapId int, anomalies []string) error
+	GetOpenLaps(ctx context.Context) ([]models.BusLapHistory, error)
 	GetActiveLap(ctx context.Context, imei string) (*models.BusLapHistory, error)
-	AddHalteVisitToActiveLap(ctx context.Context, imei string, halteName string) error
+	AddHalteVisitToActiveLap(ctx context.Context, imei string, halteName string, arrivedAt time.Time) error
+	SetHalteDepartureOnActiveLap(ctx context.Context, imei string, halteName string, departedAt time.Time) error
 	GetFilteredLapHistory(ctx context.Context, filter dto.LapHistoryFilter) ([]models.BusLapHistory, error)
 	GetFilteredLapHistoryCount(ctx context.Context, filter dto.LapHistoryFilter) (int, error)
+	// StreamFilteredLapHistory calls fn with every lap matching filter, newest first, without holding them all in memory
+	StreamFilteredLapHistory(ctx context.Context, filter dto.LapHistoryFilter, fn func(lap models.BusLapHistory) error) error
+	// CorrectLap applies an admin correction to a closed lap, recomputing anomalies with anomalies
+	CorrectLap(ctx context.Context, lapId int, req dto.LapCorrectionRequest, anomalies func(lap models.BusLapHistory) []string) (*models.LapCorrection, error)
+	GetLapCorrections(ctx context.Context, lapId int) ([]models.LapCorrection, error)
+	// GetLapStats aggregates the closed laps matching filter, grouped by route_color, bus, day and hour in the given order
+	GetLapStats(ctx context.Context, filter dto.LapHistoryFilter, groupBy []string) ([]dto.LapStats, error)
+	// GetSegmentTimes returns the median travel times between consecutive stops of recent laps
+	GetSegmentTimes(ctx context.Context, from time.Time, maxSeconds float64, minHourSamples int) ([]dto.SegmentTime, error)
 }
 
 type BusRepository interface {
@@ -32,15 +80,31 @@ type BusRepository interface {
 	UpdateBus(ctx context.Context, whereData *models.WhereData, data dto.UpdateBusRequestBody) (res *models.Bus, err error)
 	DeleteBus(ctx context.Context, id string) (err error)
 	InsertBuses(ctx context.Context, data []models.Bus) (err error)
+	// Telemetry methods
+	InsertBusPositions(ctx context.Context, positions []models.BusPosition) (err error)
+	GetBusPositions(ctx context.Context, imei string, from time.Time, to time.Time) (res []models.BusPosition, err error)
+	// Driver methods
+	RecordDriverChange(ctx context.Context, imei string, previousDriver string, driver string, changedAt time.Time) error
+	GetCurrentDrivers(ctx context.Context) (map[string]string, error)
+	GetDriverSummaries(ctx context.Context, from time.Time, to time.Time, dutyGap time.Duration) ([]dto.DriverSummary, error)
 	// Lap history methods
 	CreateLapHistory(ctx context.Context, lapHistory *models.BusLapHistory) (*models.BusLapHistory, error)
 	UpdateLapHistory(ctx context.Context, id int, endTime interface{}) (*models.BusLapHistory, error)
-	UpdateLapHistoryWithColor(ctx context.Context, id int, endTime interface{}, routeColor string) (*models.BusLapHistory, error)
-	UpdateLapHistoryHalteVisits(ctx context.Context, id int, halteVisitHistory string) error
+	CloseLapHistory(ctx context.Context, id int, endTime time.Time, routeColor string, closureReason string) (*models.BusLapHistory, error)
+	SetLapAnomalies(ctx context.Context, id int, anomalies []string) error
+	GetOpenLaps(ctx context.Context) ([]models.BusLapHistory, error)
+	AddHalteVisitToActiveLap(ctx context.Context, imei string, halteName string, arrivedAt time.Time) error
+	SetLapHalteVisitDeparture(ctx context.Context, lapId int, halteName string, departedAt time.Time) error
 	GetActiveLapByImei(ctx context.Context, imei string) (*models.BusLapHistory, error)
 	GetLapHistoryByImei(ctx context.Context, imei string) ([]models.BusLapHistory, error)
 	GetFilteredLapHistory(ctx context.Context, filter dto.LapHistoryFilter) ([]models.BusLapHistory, error)
 	GetFilteredLapHistoryCount(ctx context.Context, filter dto.LapHistoryFilter) (int, error)
+	StreamFilteredLapHistory(ctx context.Context, filter dto.LapHistoryFilter, fn func(lap models.BusLapHistory) error) error
+	// CorrectLaps applies a lap correction worked out by correct from the locked laps in one transaction
+	CorrectLaps(ctx context.Context, correction models.LapCorrection, lapIds []int, correct func(laps []models.BusLapHistory, lapsBetween dto.LapsBetweenFunc) (dto.LapCorrectionChange, error)) (*models.LapCorrection, error)
+	GetLapCorrections(ctx context.Context, lapId int) ([]models.LapCorrection, error)
+	GetLapStats(ctx context.Context, filter dto.LapHistoryFilter, groupBy []string) ([]dto.LapStats, error)
+	GetSegmentTimes(ctx context.Context, from time.Time, maxSeconds float64, minHourSamples int) ([]dto.SegmentTime, error)
 	// Debug methods
 	GetLapHistoryCount(ctx context.Context) (int, error)
 }
@@ -0,0 +1,17 @@
+package interfaces
+
+import (
+	"context"
+	"time"
+
+	"github.com/FreeJ1nG/bikuntracker-backend/app/models"
+)
+
+// EtaService predicts when buses reach their upcoming stops from segment times learned from lap history
+type EtaService interface {
+	// Predict returns the arrivals of a bus at its remaining stops in route order, nil when its route is unknown
+	Predict(coord models.BusCoordinate, now time.Time) []models.HalteEta
+	// Annotate sets the Etas of every coordinate
+	Annotate(coords []models.BusCoordinate, now time.Time)
+	Refresh(ctx context.Context) error
+}
@@ -0,0 +1,23 @@
+package interfaces
+
+import (
+	"context"
+
+	"github.com/FreeJ1nG/bikuntracker-backend/app/dto"
+	"github.com/FreeJ1nG/bikuntracker-backend/app/models"
+)
+
+type HalteRepository interface {
+	GetHaltes(ctx context.Context) (res []models.Halte, err error)
+	CreateHalte(ctx context.Context, data dto.CreateHalteRequestBody) (res *models.Halte, err error)
+	UpdateHalte(ctx context.Context, whereData *models.WhereData, data dto.UpdateHalteRequestBody) (res *models.Halte, err error)
+	DeleteHalte(ctx context.Context, id string) (err error)
+}
+
+// HalteCatalog is the in-memory list of stops used by halte detection
+type HalteCatalog interface {
+	// Haltes returns the current stops, the slice is shared and must not be modified
+	Haltes() []models.Halte
+	Halte(name string) (models.Halte, bool)
+	Reload(ctx context.Context) error
+}
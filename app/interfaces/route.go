@@ -0,0 +1,30 @@
+package interfaces
+
+import (
+	"context"
+
+	"github.com/FreeJ1nG/bikuntracker-backend/app/dto"
+	"github.com/FreeJ1nG/bikuntracker-backend/app/models"
+)
+
+type RouteRepository interface {
+	GetRoutes(ctx context.Context) (res []models.Route, err error)
+	GetRouteById(ctx context.Context, id string) (res *models.Route, err error)
+	CreateRoute(ctx context.Context, data dto.CreateRouteRequestBody) (res *models.Route, err error)
+	UpdateRoute(ctx context.Context, id string, data dto.UpdateRouteRequestBody) (res *models.Route, err error)
+	DeleteRoute(ctx context.Context, id string) (err error)
+}
+
+// RouteCatalog is the in-memory list of active routes used by route detection
+type RouteCatalog interface {
+	// Routes returns the active routes, the slice is shared and must not be modified
+	Routes() []models.Route
+	Route(color string, variant string) (models.Route, bool)
+	// Transitions maps the name of every route driving from previousHalte to currentHalte to the number of stops
+	// moved forward, 1 when currentHalte directly follows previousHalte and 2 when one stop lies in between.
+	// The map is shared and must not be modified.
+	Transitions(previousHalte string, currentHalte string) map[string]int
+	// Progress snaps a position to the polyline of a route on the leg starting at its stopIndex-th stop
+	Progress(routeName string, stopIndex int, lat float64, lng float64) (models.RouteProgress, bool)
+	Reload(ctx context.Context) error
+}
@@ -2,22 +2,43 @@ package models
 
 import "time"
 
+// Status of a bus derived from the time since its last fix
+const (
+	BUS_STATUS_ONLINE  = "online"
+	BUS_STATUS_STALE   = "stale"
+	BUS_STATUS_OFFLINE = "offline"
+)
+
 type BusCoordinate struct {
-	Id            int       `json:"id"`
-	Color         string    `json:"color"`
-	Imei          string    `json:"imei"`
-	VehicleName   string    `json:"vehicle_name"`
-	BusNumber     string    `json:"bus_number"`
-	PlateNumber   string    `json:"plate_number"`
-	Longitude     float64   `json:"longitude"`
-	Latitude      float64   `json:"latitude"`
-	Status        string    `json:"status"`
-	Speed         int       `json:"speed"`
-	TotalMileage  float64   `json:"total_mileage"`
-	GpsTime       time.Time `json:"gps_time"`
-	CurrentHalte  string    `json:"current_halte"`
-	StatusMessage string    `json:"message"`
-	NextHalte     string    `json:"next_halte"`
+	Id           int       `json:"id"`
+	Color        string    `json:"color"`
+	Imei         string    `json:"imei"`
+	VehicleName  string    `json:"vehicle_name"`
+	BusNumber    string    `json:"bus_number"`
+	PlateNumber  string    `json:"plate_number"`
+	Driver       string    `json:"driver,omitempty"` // Last driver reported by the vendor
+	Longitude    float64   `json:"longitude"`
+	Latitude     float64   `json:"latitude"`
+	Status       string    `json:"status"`
+	Speed        int       `json:"speed"`
+	Direction    float64   `json:"direction"`
+	EngineOn     bool      `json:"engine_on"`
+	TotalMileage float64   `json:"total_mileage"`
+	GpsTime      time.Time `json:"gps_time"`
+	ReceivedAt   time.Time `json:"received_at"`
+	CurrentHalte string    `json:"current_halte"`
+	// AtHalte is the stop the bus is inside of, empty between stops
+	AtHalte       string `json:"at_halte,omitempty"`
+	StatusMessage string `json:"message"`
+	NextHalte     string `json:"next_halte"`
+	// RouteVariant and RouteConfidence describe the route detected from the recent stops, the confidence
+	// is the share of them the variant explains, 0 when the route is only known from earlier
+	RouteVariant    string  `json:"route_variant,omitempty"`
+	RouteConfidence float64 `json:"route_confidence"`
+	// RouteProgress is only set when the detected route has a polyline
+	RouteProgress *RouteProgress `json:"route_progress,omitempty"`
+	// Etas are the predicted arrivals at the remaining stops, only set on the /ws broadcast
+	Etas []HalteEta `json:"etas,omitempty"`
 }
 
 type Bus struct {
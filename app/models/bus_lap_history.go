@@ -2,17 +2,42 @@ package models
 
 import "time"
 
+// Why a lap was closed
+const (
+	LAP_CLOSURE_COMPLETED    = "completed"    // the bus followed an end transition of its lap rule
+	LAP_CLOSURE_RESTARTED    = "restarted"    // the bus followed the start transition before reaching an end
+	LAP_CLOSURE_INACTIVITY   = "inactivity"   // no fix or stop for LAP_AUTO_CLOSE_AFTER_SECONDS
+	LAP_CLOSURE_MAX_DURATION = "max_duration" // the lap was open for longer than LAP_MAX_DURATION_SECONDS
+)
+
+// Anomalies flagged on closed laps
+const (
+	LAP_ANOMALY_TOO_FEW_STOPS           = "too_few_stops"
+	LAP_ANOMALY_SKIPPED_MANDATORY_STOPS = "skipped_mandatory_stops"
+	LAP_ANOMALY_TOO_SHORT               = "too_short"
+	LAP_ANOMALY_TOO_LONG                = "too_long"
+)
+
 type BusLapHistory struct {
-	ID                int        `json:"id"`
-	BusID             int        `json:"bus_id"`
-	IMEI              string     `json:"imei"`
-	LapNumber         int        `json:"lap_number"`
-	StartTime         time.Time  `json:"start_time"`
-	EndTime           *time.Time `json:"end_time,omitempty"`
-	RouteColor        string     `json:"route_color"`
-	HalteVisitHistory string     `json:"halte_visit_history,omitempty"`
-	CreatedAt         time.Time  `json:"created_at"`
-	UpdatedAt         time.Time  `json:"updated_at"`
+	ID                int             `json:"id"`
+	BusID             int             `json:"bus_id"`
+	IMEI              string          `json:"imei"`
+	LapNumber         int             `json:"lap_number"`       // Counts every lap of the bus
+	DailyLapNumber    int             `json:"daily_lap_number"` // Counts the laps of the bus on ServiceDate
+	ServiceDate       string          `json:"service_date"`     // Operating day in Jakarta time, YYYY-MM-DD
+	StartTime         time.Time       `json:"start_time"`
+	EndTime           *time.Time      `json:"end_time,omitempty"`
+	RouteColor        string          `json:"route_color"`
+	Driver            string          `json:"driver,omitempty"`              // Driver of the bus when the lap started
+	HalteVisitHistory string          `json:"halte_visit_history,omitempty"` // Kept for compatibility, mirrors HalteVisits
+	HalteVisits       []LapHalteVisit `json:"halte_visits"`
+	ClosureReason     string          `json:"closure_reason,omitempty"` // Empty while the lap is open
+	Anomalies         []string        `json:"anomalies"`
+	Corrected         bool            `json:"corrected"`              // An admin corrected the lap, see its lap corrections
+	CorrectedAt       *time.Time      `json:"corrected_at,omitempty"` // Time of the latest correction
+	VoidedAt          *time.Time      `json:"voided_at,omitempty"`    // Voided laps are hidden from lap history by default
+	CreatedAt         time.Time       `json:"created_at"`
+	UpdatedAt         time.Time       `json:"updated_at"`
 	// Bus information
 	VehicleNo   string `json:"vehicle_no,omitempty"`
 	BusNumber   string `json:"bus_number,omitempty"`
@@ -20,3 +45,34 @@ type BusLapHistory struct {
 	IsActive    bool   `json:"is_active,omitempty"`
 	Color       string `json:"color,omitempty"`
 }
+
+// LapHalteVisit is a stop reached during a lap, DepartedAt is nil while the bus is still at the stop
+type LapHalteVisit struct {
+	Sequence   int        `json:"sequence"`
+	Halte      string     `json:"halte"`
+	ArrivedAt  time.Time  `json:"arrived_at"`
+	DepartedAt *time.Time `json:"departed_at,omitempty"`
+}
+
+// Admin corrections of a closed lap
+const (
+	LAP_CORRECTION_VOID        = "void"
+	LAP_CORRECTION_ROUTE_COLOR = "route_color"
+	LAP_CORRECTION_TIMES       = "times"
+	LAP_CORRECTION_SPLIT       = "split"
+	LAP_CORRECTION_MERGE       = "merge"
+)
+
+// LapCorrection is the audit entry of an admin correction, Before and After snapshot every lap involved.
+// RelatedLapID is the lap merged with LapID or split off from it.
+type LapCorrection struct {
+	ID           int             `json:"id"`
+	LapID        int             `json:"lap_id"`
+	RelatedLapID *int            `json:"related_lap_id,omitempty"`
+	Action       string          `json:"action"`
+	CorrectedBy  string          `json:"corrected_by"`
+	Reason       string          `json:"reason"`
+	Before       []BusLapHistory `json:"before"`
+	After        []BusLapHistory `json:"after"`
+	CreatedAt    time.Time       `json:"created_at"`
+}
@@ -0,0 +1,16 @@
+package models
+
+import "time"
+
+type BusPosition struct {
+	ID         int64     `json:"id"`
+	IMEI       string    `json:"imei"`
+	Latitude   float64   `json:"latitude"`
+	Longitude  float64   `json:"longitude"`
+	Speed      int       `json:"speed"`
+	Direction  float64   `json:"direction"`
+	EngineOn   bool      `json:"engine_on"`
+	Driver     string    `json:"driver,omitempty"`
+	DeviceTime time.Time `json:"device_time"`
+	ReceivedAt time.Time `json:"received_at"`
+}
@@ -17,12 +17,38 @@ type Config struct {
 	WsUpgradeWhitelist string `mapstructure:"WS_UPGRADE_WHITELIST"`
 	WsUrl              string `mapstructure:"WS_URL"`
 
+	WsIdleTimeoutSeconds int `mapstructure:"WS_IDLE_TIMEOUT_SECONDS"`
+	WsMaxBackoffSeconds  int `mapstructure:"WS_MAX_BACKOFF_SECONDS"`
+
+	LocationSources string  `mapstructure:"LOCATION_SOURCES"`
+	ReplayFile      string  `mapstructure:"REPLAY_FILE"`
+	ReplaySpeed     float64 `mapstructure:"REPLAY_SPEED"`
+
+	CampusPolygon  string  `mapstructure:"CAMPUS_POLYGON"`
+	MaxFixSpeedKmh float64 `mapstructure:"MAX_FIX_SPEED_KMH"`
+
+	BusStaleAfterSeconds     int `mapstructure:"BUS_STALE_AFTER_SECONDS"`
+	BusOfflineAfterSeconds   int `mapstructure:"BUS_OFFLINE_AFTER_SECONDS"`
+	LapAutoCloseAfterSeconds int `mapstructure:"LAP_AUTO_CLOSE_AFTER_SECONDS"`
+	LapMaxDurationSeconds    int `mapstructure:"LAP_MAX_DURATION_SECONDS"`
+	LapMinDurationSeconds    int `mapstructure:"LAP_MIN_DURATION_SECONDS"`
+
+	EtaHistoryDays int `mapstructure:"ETA_HISTORY_DAYS"`
+
 	JwtExpiryInDays        int    `mapstructure:"JWT_EXPIRY_IN_DAYS"`
 	JwtRefreshExpiryInDays int    `mapstructure:"JWT_REFRESH_EXPIRY_IN_DAYS"`
 	JwtSecretKey           string `mapstructure:"JWT_SECRET_KEY"`
 
 	AdminApiKey string `mapstructure:"ADMIN_API_KEY"`
 
+	TelemetryQueueSize       int `mapstructure:"TELEMETRY_QUEUE_SIZE"`
+	TelemetryBatchSize       int `mapstructure:"TELEMETRY_BATCH_SIZE"`
+	TelemetryFlushIntervalMs int `mapstructure:"TELEMETRY_FLUSH_INTERVAL_MS"`
+
+	WebhookSecret              string `mapstructure:"WEBHOOK_SECRET"`
+	WebhookMaxAgeSeconds       int    `mapstructure:"WEBHOOK_MAX_AGE_SECONDS"`
+	WebhookReplayWindowSeconds int    `mapstructure:"WEBHOOK_REPLAY_WINDOW_SECONDS"`
+
 	Token string
 	DBUrl string
 	DBDsn string
@@ -0,0 +1,10 @@
+package models
+
+import "time"
+
+// HalteEta is the predicted arrival of a bus at one of its upcoming stops
+type HalteEta struct {
+	Halte       string    `json:"halte"`
+	ArrivalTime time.Time `json:"arrival_time"`
+	Seconds     int       `json:"seconds"` // from the time of the prediction
+}
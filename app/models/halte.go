@@ -0,0 +1,16 @@
+package models
+
+// Halte is a bus stop row of the bus_stop table
+type Halte struct {
+	Id            int     `json:"id"`
+	Name          string  `json:"name"`
+	Latitude      float64 `json:"latitude"`
+	Longitude     float64 `json:"longitude"`
+	ArrivalRadius float64 `json:"arrival_radius"` // in meters, a bus closer than this has arrived
+	// DepartureRadius is at least ArrivalRadius, a bus that arrived only departs once it is farther than this
+	DepartureRadius float64 `json:"departure_radius"`
+	ImageUrl        string  `json:"image_url"`
+	Description     string  `json:"description"`
+	CreatedAt       int64   `json:"created_at"`
+	UpdatedAt       int64   `json:"updated_at"`
+}
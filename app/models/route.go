@@ -0,0 +1,48 @@
+package models
+
+// Route is one variant of a colored bus line with its ordered stops
+type Route struct {
+	Id       int      `json:"id"`
+	Name     string   `json:"name"`
+	Color    string   `json:"color"`   // blue, red
+	Variant  string   `json:"variant"` // normal, morning
+	IsActive bool     `json:"is_active"`
+	Stops    []string `json:"stops"` // halte names in order, the last stop leads back to the first
+	// Polyline is the path driven from the first stop around the route, as GeoJSON [longitude, latitude] positions
+	Polyline [][2]float64 `json:"polyline,omitempty"`
+	// LapRule decides where laps of this route start and end, nil uses the built-in rule
+	LapRule   *LapRule `json:"lap_rule,omitempty"`
+	CreatedAt int64    `json:"created_at"`
+	UpdatedAt int64    `json:"updated_at"`
+}
+
+// LapTransition is a move from one stop to the next, an empty From matches any previous stop
+type LapTransition struct {
+	From string `json:"from,omitempty"`
+	To   string `json:"to"`
+}
+
+// LapRule starts a lap on the Start transition and ends it on any End transition
+// once the lap has visited at least MinStops stops. A closed lap missing one of the
+// MandatoryStops is flagged as anomalous.
+type LapRule struct {
+	Start          LapTransition   `json:"start"`
+	End            []LapTransition `json:"end"`
+	MinStops       int             `json:"min_stops"`
+	MandatoryStops []string        `json:"mandatory_stops,omitempty"`
+}
+
+// Matches reports whether a bus moving from previousHalte to currentHalte follows the transition
+func (t LapTransition) Matches(previousHalte string, currentHalte string) bool {
+	return t.To == currentHalte && (t.From == "" || t.From == previousHalte)
+}
+
+// RouteProgress places a bus on the polyline of its route
+type RouteProgress struct {
+	Route              string  `json:"route"`
+	FromHalte          string  `json:"from_halte"`
+	ToHalte            string  `json:"to_halte"`
+	SegmentProgress    float64 `json:"segment_progress"`     // 0 at FromHalte, 1 at ToHalte
+	DistanceAlongRoute float64 `json:"distance_along_route"` // meters from the start of the polyline
+	DistanceFromRoute  float64 `json:"distance_from_route"`  // meters between the fix and the polyline
+}
@@ -0,0 +1,166 @@
+package route
+
+import (
+	"context"
+	"log"
+	"strings"
+	"sync"
+
+	"github.com/FreeJ1nG/bikuntracker-backend/app/interfaces"
+	"github.com/FreeJ1nG/bikuntracker-backend/app/models"
+)
+
+const (
+	VARIANT_NORMAL  = "normal"
+	VARIANT_MORNING = "morning"
+)
+
+// Transitions also cover a stop missed by halte detection, a bus may drive past a stop without entering its geofence
+const maxTransitionSteps = 2
+
+// ColorVariant maps a bus color to the color and variant of its route, express colors run the morning variant
+func ColorVariant(busColor string) (color string, variant string) {
+	if strings.HasPrefix(busColor, "express-") {
+		return strings.TrimPrefix(busColor, "express-"), VARIANT_MORNING
+	}
+	return busColor, VARIANT_NORMAL
+}
+
+// BusColor is the inverse of ColorVariant, laps record the route they were driven on this way
+func BusColor(color string, variant string) string {
+	if variant == VARIANT_MORNING {
+		return "express-" + color
+	}
+	return color
+}
+
+// CoordinateRoute returns the color and variant of the route a bus follows, the detected route variant
+// takes precedence over the variant of its bus color
+func CoordinateRoute(coord models.BusCoordinate) (color string, variant string) {
+	color, variant = ColorVariant(coord.Color)
+	if coord.RouteVariant != "" {
+		variant = coord.RouteVariant
+	}
+	return color, variant
+}
+
+// catalog keeps the active routes in memory together with an index of the transitions between their stops.
+// It starts with the built-in routes and keeps them whenever the database holds no usable route.
+type catalog struct {
+	repo         interfaces.RouteRepository
+	halteCatalog interfaces.HalteCatalog
+
+	mu     sync.RWMutex
+	routes []models.Route
+	// transitions maps a stop pair to the routes driving from the first stop to the second one,
+	// with the number of stops moved forward
+	transitions map[[2]string]map[string]int
+	geometries  map[string]*geometry // route name -> geometry, only for routes with a polyline
+}
+
+// NewCatalog creates a catalog backed by repo, a nil repo only serves the built-in routes.
+// Stops are located through halteCatalog, reload the route catalog whenever stops move.
+func NewCatalog(repo interfaces.RouteRepository, halteCatalog interfaces.HalteCatalog) *catalog {
+	c := &catalog{repo: repo, halteCatalog: halteCatalog}
+	c.set(defaultRoutes)
+	return c
+}
+
+func (c *catalog) set(routes []models.Route) {
+	transitions := make(map[[2]string]map[string]int)
+	geometries := make(map[string]*geometry)
+	for _, route := range routes {
+		if g := newGeometry(route, c.halteCatalog.Halte); g != nil {
+			geometries[route.Name] = g
+		}
+		n := len(route.Stops)
+		for steps := 1; steps <= maxTransitionSteps; steps++ {
+			for i := 0; i < n; i++ {
+				// Routes are circular, the last stop leads back to the first one
+				pair := [2]string{route.Stops[i], route.Stops[(i+steps)%n]}
+				if pair[0] == pair[1] {
+					continue
+				}
+				if transitions[pair] == nil {
+					transitions[pair] = make(map[string]int)
+				}
+				if _, ok := transitions[pair][route.Name]; !ok {
+					transitions[pair][route.Name] = steps
+				}
+			}
+		}
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.routes = routes
+	c.transitions = transitions
+	c.geometries = geometries
+}
+
+// Routes returns a copy of the routes, the stops of every route are shared and must not be modified
+func (c *catalog) Routes() []models.Route {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	res := make([]models.Route, len(c.routes))
+	copy(res, c.routes)
+	return res
+}
+
+func (c *catalog) Route(color string, variant string) (models.Route, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	for _, route := range c.routes {
+		if route.Color == color && route.Variant == variant {
+			return route, true
+		}
+	}
+	return models.Route{}, false
+}
+
+func (c *catalog) Transitions(previousHalte string, currentHalte string) map[string]int {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.transitions[[2]string{previousHalte, currentHalte}]
+}
+
+// Progress snaps a position to the polyline of a route, on the leg starting at its stopIndex-th stop.
+// It returns false when the route has no polyline.
+func (c *catalog) Progress(routeName string, stopIndex int, lat float64, lng float64) (models.RouteProgress, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	g, ok := c.geometries[routeName]
+	if !ok {
+		return models.RouteProgress{}, false
+	}
+	for _, route := range c.routes {
+		if route.Name == routeName {
+			return g.progress(route, stopIndex, lat, lng)
+		}
+	}
+	return models.RouteProgress{}, false
+}
+
+// Reload replaces the routes with the active routes of the database
+func (c *catalog) Reload(ctx context.Context) error {
+	if c.repo == nil {
+		return nil
+	}
+	rows, err := c.repo.GetRoutes(ctx)
+	if err != nil {
+		return err
+	}
+	routes := make([]models.Route, 0, len(rows))
+	for _, route := range rows {
+		if route.IsActive && len(route.Stops) >= 2 {
+			routes = append(routes, route)
+		}
+	}
+	if len(routes) == 0 {
+		log.Println("route has no active routes with stops, keeping the built-in routes")
+		c.set(defaultRoutes)
+		return nil
+	}
+	c.set(routes)
+	log.Printf("Loaded %d routes from route", len(routes))
+	return nil
+}
@@ -0,0 +1,57 @@
+package route
+
+import "github.com/FreeJ1nG/bikuntracker-backend/app/models"
+
+// normalLapRule and morningLapRule are the lap rules seeded by migrations 000016 and 000017.
+// Migration 000017 only seeds the mandatory stops a route drives through, every built-in route drives all three.
+var (
+	normalLapRule = &models.LapRule{
+		Start:          models.LapTransition{From: "Asrama UI", To: "Menwa"},
+		End:            []models.LapTransition{{From: "Menwa", To: "Asrama UI"}, {To: "Parking"}},
+		MinStops:       8,
+		MandatoryStops: []string{"Stasiun UI", "Balairung", "Fakultas Teknik"},
+	}
+	morningLapRule = &models.LapRule{
+		Start:          models.LapTransition{From: "Asrama UI", To: "Menwa"},
+		End:            []models.LapTransition{{To: "Parking"}},
+		MinStops:       6,
+		MandatoryStops: []string{"Stasiun UI", "Balairung", "Fakultas Teknik"},
+	}
+)
+
+// defaultRoutes are the routes seeded by migration 000012, used until the route table holds active routes.
+// blue-morning used to list "FIA" between SOR and Balairung, it is left out until FIA exists as a stop.
+var defaultRoutes = []models.Route{
+	{
+		Name:     "blue-normal",
+		Color:    "blue",
+		Variant:  VARIANT_NORMAL,
+		IsActive: true,
+		Stops:    []string{"Asrama UI", "Menwa", "Stasiun UI", "Fakultas Psikologi", "FISIP", "Fakultas Ilmu Pengetahuan Budaya", "Fakultas Ekonomi dan Bisnis", "Fakultas Teknik", "Vokasi", "SOR", "Fakultas Farmasi", "Balai Sidang", "Balairung", "Stasiun Pondok Cina", "MUI/Perpus UI", "Fakultas Hukum", "Stasiun UI", "Menwa", "Asrama UI", "Parking"},
+		LapRule:  normalLapRule,
+	},
+	{
+		Name:     "blue-morning",
+		Color:    "blue",
+		Variant:  VARIANT_MORNING,
+		IsActive: true,
+		Stops:    []string{"Asrama UI", "Menwa", "Stasiun UI", "Fakultas Psikologi", "FISIP", "Fakultas Ilmu Pengetahuan Budaya", "Fakultas Ekonomi dan Bisnis", "Fakultas Teknik", "Vokasi", "SOR", "Balairung", "Stasiun Pondok Cina", "MUI/Perpus UI", "Fakultas Hukum", "Fakultas Psikologi", "FISIP", "Fakultas Ilmu Pengetahuan Budaya", "Fakultas Ekonomi dan Bisnis", "Fakultas Teknik", "Parking"},
+		LapRule:  morningLapRule,
+	},
+	{
+		Name:     "red-normal",
+		Color:    "red",
+		Variant:  VARIANT_NORMAL,
+		IsActive: true,
+		Stops:    []string{"Asrama UI", "Menwa", "Stasiun UI", "Fakultas Hukum", "Balairung", "RIK", "Fakultas Kesehatan Masyarakat", "RSUI", "Fakultas Ilmu Keperawatan", "FMIPA", "SOR", "Vokasi", "Fakultas Teknik", "Fakultas Ekonomi dan Bisnis", "Fakultas Ilmu Pengetahuan Budaya", "FISIP", "Fakultas Psikologi", "Stasiun UI", "Menwa", "Asrama UI", "Parking"},
+		LapRule:  normalLapRule,
+	},
+	{
+		Name:     "red-morning",
+		Color:    "red",
+		Variant:  VARIANT_MORNING,
+		IsActive: true,
+		Stops:    []string{"Asrama UI", "Menwa", "Stasiun UI", "Fakultas Hukum", "Balairung", "RIK", "Fakultas Kesehatan Masyarakat", "RSUI", "Fakultas Ilmu Keperawatan", "FMIPA", "SOR", "Vokasi", "Fakultas Teknik", "Parking"},
+		LapRule:  morningLapRule,
+	},
+}
@@ -0,0 +1,87 @@
+package route
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+type geoJSONObject struct {
+	Type        string          `json:"type"`
+	Coordinates json.RawMessage `json:"coordinates"`
+	Geometry    *geoJSONObject  `json:"geometry"`
+	Features    []geoJSONObject `json:"features"`
+}
+
+// ParseGeoJSONLine reads a route polyline from a LineString or MultiLineString geometry, a Feature holding one,
+// or a FeatureCollection whose line features are joined in order
+func ParseGeoJSONLine(raw json.RawMessage) ([][2]float64, error) {
+	var object geoJSONObject
+	if err := json.Unmarshal(raw, &object); err != nil {
+		return nil, fmt.Errorf("invalid GeoJSON: %w", err)
+	}
+	line, err := geoJSONLine(object)
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 2 {
+		return nil, errors.New("GeoJSON line needs at least 2 positions")
+	}
+	for _, position := range line {
+		if position[0] < -180 || position[0] > 180 || position[1] < -90 || position[1] > 90 {
+			return nil, fmt.Errorf("invalid GeoJSON position %v, expected [longitude, latitude]", position)
+		}
+	}
+	return line, nil
+}
+
+func geoJSONLine(object geoJSONObject) ([][2]float64, error) {
+	switch object.Type {
+	case "LineString":
+		var line [][2]float64
+		if err := json.Unmarshal(object.Coordinates, &line); err != nil {
+			return nil, fmt.Errorf("invalid LineString coordinates: %w", err)
+		}
+		return line, nil
+	case "MultiLineString":
+		var lines [][][2]float64
+		if err := json.Unmarshal(object.Coordinates, &lines); err != nil {
+			return nil, fmt.Errorf("invalid MultiLineString coordinates: %w", err)
+		}
+		return joinLines(lines), nil
+	case "Feature":
+		if object.Geometry == nil {
+			return nil, errors.New("GeoJSON feature has no geometry")
+		}
+		return geoJSONLine(*object.Geometry)
+	case "FeatureCollection":
+		lines := make([][][2]float64, 0, len(object.Features))
+		for _, feature := range object.Features {
+			line, err := geoJSONLine(feature)
+			if err != nil {
+				continue
+			}
+			lines = append(lines, line)
+		}
+		if len(lines) == 0 {
+			return nil, errors.New("GeoJSON feature collection has no line feature")
+		}
+		return joinLines(lines), nil
+	default:
+		return nil, fmt.Errorf("unsupported GeoJSON type %q, expected a LineString", object.Type)
+	}
+}
+
+// joinLines concatenates lines, dropping the first position of a line when it repeats the last one
+func joinLines(lines [][][2]float64) [][2]float64 {
+	res := make([][2]float64, 0)
+	for _, line := range lines {
+		for i, position := range line {
+			if i == 0 && len(res) > 0 && res[len(res)-1] == position {
+				continue
+			}
+			res = append(res, position)
+		}
+	}
+	return res
+}
@@ -0,0 +1,150 @@
+package route
+
+import (
+	"math"
+
+	"github.com/FreeJ1nG/bikuntracker-backend/app/models"
+	"github.com/FreeJ1nG/bikuntracker-backend/utils"
+)
+
+// A stop is placed on the first stretch of the polyline that passes within this distance after the previous stop
+const stopSnapToleranceMeters = 60
+
+// geometry is a route polyline projected to planar meters with the offset of every stop along it
+type geometry struct {
+	projection utils.LocalProjection
+	xs, ys     []float64
+	// cumulative[i] is the distance along the polyline from its first point to point i
+	cumulative []float64
+	// stopOffsets[i] is the distance along the polyline of the i-th stop of the route
+	stopOffsets []float64
+}
+
+type projection struct {
+	offset   float64 // distance along the polyline
+	distance float64 // distance between the point and the polyline
+}
+
+// newGeometry builds the geometry of a route, it returns nil when the route has no polyline
+// or one of its stops is unknown
+func newGeometry(route models.Route, locate func(name string) (models.Halte, bool)) *geometry {
+	if len(route.Polyline) < 2 {
+		return nil
+	}
+	g := &geometry{
+		projection: utils.NewLocalProjection(route.Polyline[0][1]),
+		xs:         make([]float64, len(route.Polyline)),
+		ys:         make([]float64, len(route.Polyline)),
+		cumulative: make([]float64, len(route.Polyline)),
+	}
+	for i, point := range route.Polyline {
+		// GeoJSON positions are [longitude, latitude]
+		g.xs[i], g.ys[i] = g.projection.Project(point[1], point[0])
+		if i > 0 {
+			g.cumulative[i] = g.cumulative[i-1] + math.Hypot(g.xs[i]-g.xs[i-1], g.ys[i]-g.ys[i-1])
+		}
+	}
+
+	g.stopOffsets = make([]float64, 0, len(route.Stops))
+	after := 0.0
+	for _, name := range route.Stops {
+		halte, ok := locate(name)
+		if !ok {
+			return nil
+		}
+		x, y := g.projection.Project(halte.Latitude, halte.Longitude)
+		p := g.placeStop(x, y, after)
+		g.stopOffsets = append(g.stopOffsets, p.offset)
+		after = p.offset
+	}
+	return g
+}
+
+func (g *geometry) length() float64 {
+	return g.cumulative[len(g.cumulative)-1]
+}
+
+// projectOnSegment projects (x, y) on segment i clamped to the [from, to] offset window
+func (g *geometry) projectOnSegment(i int, x, y, from, to float64) projection {
+	ax, ay := g.xs[i], g.ys[i]
+	dx, dy := g.xs[i+1]-ax, g.ys[i+1]-ay
+	segmentLength := g.cumulative[i+1] - g.cumulative[i]
+	t := 0.0
+	if segmentLength > 0 {
+		t = ((x-ax)*dx + (y-ay)*dy) / (segmentLength * segmentLength)
+	}
+	offset := g.cumulative[i] + math.Max(0, math.Min(1, t))*segmentLength
+	offset = math.Max(from, math.Min(to, offset))
+	if segmentLength > 0 {
+		t = (offset - g.cumulative[i]) / segmentLength
+	}
+	px, py := ax+t*dx, ay+t*dy
+	return projection{offset: offset, distance: math.Hypot(x-px, y-py)}
+}
+
+// project returns the closest point of the polyline between the from and to offsets
+func (g *geometry) project(x, y, from, to float64) projection {
+	best := projection{offset: from, distance: math.Inf(1)}
+	for i := 0; i < len(g.xs)-1; i++ {
+		if g.cumulative[i+1] < from || g.cumulative[i] > to {
+			continue
+		}
+		if p := g.projectOnSegment(i, x, y, from, to); p.distance < best.distance {
+			best = p
+		}
+	}
+	return best
+}
+
+// placeStop finds where a stop lies on the polyline after the given offset. Routes often use the same
+// road in both directions, so the first stretch passing close to the stop wins over the global closest point.
+func (g *geometry) placeStop(x, y, after float64) projection {
+	best := projection{offset: after, distance: math.Inf(1)}
+	found := false
+	for i := 0; i < len(g.xs)-1; i++ {
+		if g.cumulative[i+1] < after {
+			continue
+		}
+		p := g.projectOnSegment(i, x, y, after, g.length())
+		if p.distance <= stopSnapToleranceMeters {
+			found = true
+			if p.distance < best.distance {
+				best = p
+			}
+		} else if found {
+			break
+		}
+		if !found && p.distance < best.distance {
+			best = p
+		}
+	}
+	return best
+}
+
+// progress locates a point on the leg that starts at the stopIndex-th stop of the route
+func (g *geometry) progress(route models.Route, stopIndex int, lat, lng float64) (models.RouteProgress, bool) {
+	if stopIndex < 0 || stopIndex >= len(g.stopOffsets) {
+		return models.RouteProgress{}, false
+	}
+	x, y := g.projection.Project(lat, lng)
+	from := g.stopOffsets[stopIndex]
+	to := g.length()
+	nextIndex := (stopIndex + 1) % len(route.Stops)
+	if nextIndex > stopIndex {
+		to = g.stopOffsets[nextIndex]
+	}
+
+	p := g.project(x, y, from, to)
+	res := models.RouteProgress{
+		Route:              route.Name,
+		FromHalte:          route.Stops[stopIndex],
+		ToHalte:            route.Stops[nextIndex],
+		DistanceAlongRoute: p.offset,
+		DistanceFromRoute:  p.distance,
+	}
+	// The leg from the last stop back to the first one ends where the polyline ends
+	if legLength := to - from; legLength > 0 {
+		res.SegmentProgress = (p.offset - from) / legLength
+	}
+	return res, true
+}
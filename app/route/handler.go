@@ -0,0 +1,282 @@
+package route
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/FreeJ1nG/bikuntracker-backend/app/dto"
+	"github.com/FreeJ1nG/bikuntracker-backend/app/interfaces"
+	"github.com/FreeJ1nG/bikuntracker-backend/app/models"
+	"github.com/FreeJ1nG/bikuntracker-backend/utils"
+	"github.com/FreeJ1nG/bikuntracker-backend/utils/middleware"
+)
+
+type handler struct {
+	repo      interfaces.RouteRepository
+	halteRepo interfaces.HalteRepository
+	catalog   interfaces.RouteCatalog
+}
+
+func NewHandler(repo interfaces.RouteRepository, halteRepo interfaces.HalteRepository, catalog interfaces.RouteCatalog) *handler {
+	return &handler{
+		repo:      repo,
+		halteRepo: halteRepo,
+		catalog:   catalog,
+	}
+}
+
+// validateStops checks that a route has at least two stops, that every stop exists in bus_stop
+// and that no stop directly follows itself, including the wrap from the last stop to the first
+func (h *handler) validateStops(ctx context.Context, stops []string) (status int, err error) {
+	if len(stops) < 2 {
+		return http.StatusBadRequest, errors.New("a route needs at least 2 stops")
+	}
+	haltes, err := h.halteRepo.GetHaltes(ctx)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	known := make(map[string]bool, len(haltes))
+	for _, halte := range haltes {
+		known[halte.Name] = true
+	}
+	unknown := make([]string, 0)
+	for i, stop := range stops {
+		if !known[stop] {
+			unknown = append(unknown, stop)
+		}
+		if stop == stops[(i+1)%len(stops)] {
+			return http.StatusBadRequest, fmt.Errorf("stop %q directly follows itself at position %d", stop, i+1)
+		}
+	}
+	if len(unknown) > 0 {
+		return http.StatusBadRequest, fmt.Errorf("unknown stops: %s", strings.Join(unknown, ", "))
+	}
+	return http.StatusOK, nil
+}
+
+// validateLapRule checks that a lap rule has a start and at least one end transition between existing stops
+func (h *handler) validateLapRule(ctx context.Context, rule *models.LapRule) (status int, err error) {
+	if rule.Start.To == "" {
+		return http.StatusBadRequest, errors.New("lap_rule.start.to is required")
+	}
+	if len(rule.End) == 0 {
+		return http.StatusBadRequest, errors.New("lap_rule.end needs at least one transition")
+	}
+	if rule.MinStops < 0 {
+		return http.StatusBadRequest, errors.New("lap_rule.min_stops cannot be negative")
+	}
+	names := []string{rule.Start.From, rule.Start.To}
+	for i, transition := range rule.End {
+		if transition.To == "" {
+			return http.StatusBadRequest, fmt.Errorf("lap_rule.end[%d].to is required", i)
+		}
+		names = append(names, transition.From, transition.To)
+	}
+	names = append(names, rule.MandatoryStops...)
+
+	haltes, err := h.halteRepo.GetHaltes(ctx)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	known := make(map[string]bool, len(haltes))
+	for _, halte := range haltes {
+		known[halte.Name] = true
+	}
+	unknown := make([]string, 0)
+	for _, name := range names {
+		if name != "" && !known[name] {
+			unknown = append(unknown, name)
+		}
+	}
+	if len(unknown) > 0 {
+		return http.StatusBadRequest, fmt.Errorf("lap_rule references unknown stops: %s", strings.Join(unknown, ", "))
+	}
+	return http.StatusOK, nil
+}
+
+func validateColor(color string) error {
+	if color == "" {
+		return errors.New("color is required")
+	}
+	if color == "grey" {
+		return errors.New("grey is reserved for buses without a detected route")
+	}
+	return nil
+}
+
+func validateVariant(variant string) error {
+	if variant != VARIANT_NORMAL && variant != VARIANT_MORNING {
+		return fmt.Errorf("invalid variant (expected %s or %s)", VARIANT_NORMAL, VARIANT_MORNING)
+	}
+	return nil
+}
+
+// parsePolyline reads the optional geojson field of a request body. A JSON null clears the polyline,
+// which is returned as an empty non-nil slice.
+func parsePolyline(raw json.RawMessage) ([][2]float64, error) {
+	if len(raw) == 0 {
+		return nil, nil
+	}
+	if string(bytes.TrimSpace(raw)) == "null" {
+		return [][2]float64{}, nil
+	}
+	polyline, err := ParseGeoJSONLine(raw)
+	if err != nil {
+		return nil, fmt.Errorf("invalid geojson: %w", err)
+	}
+	return polyline, nil
+}
+
+// reloadCatalog applies a change right away on this instance, other instances pick it up through catalog_changed
+func (h *handler) reloadCatalog(ctx context.Context) {
+	if err := h.catalog.Reload(ctx); err != nil {
+		log.Printf("Failed to reload route catalog: %v", err)
+	}
+}
+
+func (h *handler) GetRoutes(w http.ResponseWriter, r *http.Request) {
+	ctx := context.Background()
+
+	res, err := h.repo.GetRoutes(ctx)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	utils.EncodeSuccessResponse[[]models.Route](w, res)
+}
+
+func (h *handler) CreateRoute(w http.ResponseWriter, r *http.Request) {
+	ctx := context.Background()
+
+	body, err := utils.ParseRequestBody[dto.CreateRouteRequestBody](r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if body.Name == "" || body.Variant == "" {
+		http.Error(w, "name and variant are required", http.StatusBadRequest)
+		return
+	}
+	if err := validateVariant(body.Variant); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := validateColor(body.Color); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if status, err := h.validateStops(ctx, body.Stops); err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+	body.Polyline, err = parsePolyline(body.GeoJSON)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if body.LapRule != nil {
+		if status, err := h.validateLapRule(ctx, body.LapRule); err != nil {
+			http.Error(w, err.Error(), status)
+			return
+		}
+	}
+
+	res, err := h.repo.CreateRoute(ctx, body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	h.reloadCatalog(ctx)
+
+	utils.EncodeSuccessResponse[models.Route](w, *res)
+}
+
+func (h *handler) UpdateRoute(w http.ResponseWriter, r *http.Request) {
+	ctx := context.Background()
+
+	body, err := utils.ParseRequestBody[dto.UpdateRouteRequestBody](r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if (body.Name != nil && *body.Name == "") || (body.Variant != nil && *body.Variant == "") {
+		http.Error(w, "name and variant cannot be empty", http.StatusBadRequest)
+		return
+	}
+	if body.Variant != nil {
+		if err := validateVariant(*body.Variant); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	if body.Color != nil {
+		if err := validateColor(*body.Color); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	if body.Stops != nil {
+		if status, err := h.validateStops(ctx, body.Stops); err != nil {
+			http.Error(w, err.Error(), status)
+			return
+		}
+	}
+	body.Polyline, err = parsePolyline(body.GeoJSON)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if body.LapRule != nil {
+		if status, err := h.validateLapRule(ctx, body.LapRule); err != nil {
+			http.Error(w, err.Error(), status)
+			return
+		}
+	}
+
+	id, status, err := middleware.GetRouteParam(r, "id")
+	if err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+
+	res, err := h.repo.UpdateRoute(ctx, id, body)
+	if err != nil {
+		if errors.Is(err, ErrRouteNotFound) {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	h.reloadCatalog(ctx)
+
+	utils.EncodeSuccessResponse[models.Route](w, *res)
+}
+
+func (h *handler) DeleteRoute(w http.ResponseWriter, r *http.Request) {
+	ctx := context.Background()
+
+	id, status, err := middleware.GetRouteParam(r, "id")
+	if err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+
+	err = h.repo.DeleteRoute(ctx, id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	h.reloadCatalog(ctx)
+
+	utils.EncodeEmptySuccessResponse(w)
+}
@@ -0,0 +1,270 @@
+package route
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/FreeJ1nG/bikuntracker-backend/app/dto"
+	"github.com/FreeJ1nG/bikuntracker-backend/app/models"
+	"github.com/FreeJ1nG/bikuntracker-backend/utils"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+const routeQuery = `SELECT r.id, r.name, r.color, r.variant, r.is_active, r.created_at, r.updated_at, r.polyline, r.lap_rule,
+		COALESCE(array_agg(bs.name ORDER BY rs.sequence) FILTER (WHERE bs.name IS NOT NULL), '{}')
+	FROM route r
+	LEFT JOIN route_stop rs ON rs.route_id = r.id
+	LEFT JOIN bus_stop bs ON bs.id = rs.bus_stop_id`
+
+var ErrRouteNotFound = errors.New("no route found with the given id")
+
+type repository struct {
+	db *pgxpool.Pool
+}
+
+func NewRepository(db *pgxpool.Pool) *repository {
+	return &repository{
+		db: db,
+	}
+}
+
+// routeFields holds the columns of the route table that can be partially updated
+type routeFields struct {
+	Name     *string `json:"name"`
+	Color    *string `json:"color"`
+	Variant  *string `json:"variant"`
+	IsActive *bool   `json:"is_active"`
+}
+
+func scanRoute(row pgx.Row) (res models.Route, err error) {
+	var polyline, lapRule []byte
+	err = row.Scan(
+		&res.Id,
+		&res.Name,
+		&res.Color,
+		&res.Variant,
+		&res.IsActive,
+		&res.CreatedAt,
+		&res.UpdatedAt,
+		&polyline,
+		&lapRule,
+		&res.Stops,
+	)
+	if err != nil {
+		return
+	}
+	if polyline != nil {
+		if err = json.Unmarshal(polyline, &res.Polyline); err != nil {
+			err = fmt.Errorf("invalid polyline of route %d: %w", res.Id, err)
+			return
+		}
+	}
+	if lapRule != nil {
+		if err = json.Unmarshal(lapRule, &res.LapRule); err != nil {
+			err = fmt.Errorf("invalid lap rule of route %d: %w", res.Id, err)
+		}
+	}
+	return
+}
+
+// polylineParam encodes a polyline for the JSONB polyline column, an empty polyline is stored as NULL
+func polylineParam(polyline [][2]float64) (any, error) {
+	if len(polyline) == 0 {
+		return nil, nil
+	}
+	encoded, err := json.Marshal(polyline)
+	if err != nil {
+		return nil, fmt.Errorf("unable to encode polyline: %w", err)
+	}
+	return string(encoded), nil
+}
+
+// lapRuleParam encodes a lap rule for the JSONB lap_rule column
+func lapRuleParam(rule *models.LapRule) (any, error) {
+	if rule == nil {
+		return nil, nil
+	}
+	encoded, err := json.Marshal(rule)
+	if err != nil {
+		return nil, fmt.Errorf("unable to encode lap rule: %w", err)
+	}
+	return string(encoded), nil
+}
+
+func (r *repository) GetRoutes(ctx context.Context) (res []models.Route, err error) {
+	rows, err := r.db.Query(ctx, routeQuery+` GROUP BY r.id ORDER BY r.id;`)
+	if err != nil {
+		err = fmt.Errorf("unable to execute SQL query to get routes: %w", err)
+		return
+	}
+	defer rows.Close()
+
+	res = make([]models.Route, 0)
+	for rows.Next() {
+		route, scanErr := scanRoute(rows)
+		if scanErr != nil {
+			err = fmt.Errorf("unable to scan route: %w", scanErr)
+			return
+		}
+		res = append(res, route)
+	}
+	return
+}
+
+func (r *repository) GetRouteById(ctx context.Context, id string) (res *models.Route, err error) {
+	route, err := scanRoute(r.db.QueryRow(ctx, routeQuery+` WHERE r.id = $1 GROUP BY r.id;`, id))
+	if err != nil {
+		if err == pgx.ErrNoRows {
+			err = ErrRouteNotFound
+			return
+		}
+		err = fmt.Errorf("unable to get route: %w", err)
+		return
+	}
+	res = &route
+	return
+}
+
+// insertRouteStops stores the stop sequence of a route, every name must match a bus_stop
+func insertRouteStops(ctx context.Context, tx pgx.Tx, routeId int, stops []string) error {
+	tag, err := tx.Exec(
+		ctx,
+		`INSERT INTO route_stop (route_id, sequence, bus_stop_id)
+		 SELECT $1, s.sequence, bs.id
+		 FROM unnest($2::text[]) WITH ORDINALITY AS s(name, sequence)
+		 JOIN bus_stop bs ON bs.name = s.name`,
+		routeId,
+		stops,
+	)
+	if err != nil {
+		return fmt.Errorf("unable to insert route stops: %w", err)
+	}
+	if int(tag.RowsAffected()) != len(stops) {
+		return fmt.Errorf("route references a stop that does not exist")
+	}
+	return nil
+}
+
+func (r *repository) CreateRoute(ctx context.Context, data dto.CreateRouteRequestBody) (res *models.Route, err error) {
+	tx, err := r.db.Begin(ctx)
+	if err != nil {
+		err = fmt.Errorf("unable to begin transaction: %w", err)
+		return
+	}
+	defer func() {
+		_ = tx.Rollback(ctx)
+	}()
+
+	isActive := true
+	if data.IsActive != nil {
+		isActive = *data.IsActive
+	}
+	polyline, err := polylineParam(data.Polyline)
+	if err != nil {
+		return
+	}
+	lapRule, err := lapRuleParam(data.LapRule)
+	if err != nil {
+		return
+	}
+	var id int
+	err = tx.QueryRow(
+		ctx,
+		`INSERT INTO route (name, color, variant, is_active, polyline, lap_rule) VALUES ($1, $2, $3, $4, $5, $6) RETURNING id;`,
+		data.Name,
+		data.Color,
+		data.Variant,
+		isActive,
+		polyline,
+		lapRule,
+	).Scan(&id)
+	if err != nil {
+		err = fmt.Errorf("unable to execute create route SQL: %w", err)
+		return
+	}
+	if err = insertRouteStops(ctx, tx, id, data.Stops); err != nil {
+		return
+	}
+	if err = tx.Commit(ctx); err != nil {
+		err = fmt.Errorf("unable to commit route: %w", err)
+		return
+	}
+	return r.GetRouteById(ctx, fmt.Sprint(id))
+}
+
+func (r *repository) UpdateRoute(ctx context.Context, id string, data dto.UpdateRouteRequestBody) (res *models.Route, err error) {
+	tx, err := r.db.Begin(ctx)
+	if err != nil {
+		err = fmt.Errorf("unable to begin transaction: %w", err)
+		return
+	}
+	defer func() {
+		_ = tx.Rollback(ctx)
+	}()
+
+	fields := routeFields{Name: data.Name, Color: data.Color, Variant: data.Variant, IsActive: data.IsActive}
+	var routeId int
+	if fields != (routeFields{}) {
+		sqlStr, params, sqlErr := utils.GetPartialUpdateSQL("route", fields, &models.WhereData{FieldName: "id", Value: id})
+		if sqlErr != nil {
+			err = sqlErr
+			return
+		}
+		err = tx.QueryRow(ctx, sqlStr+" RETURNING id", params...).Scan(&routeId)
+	} else {
+		err = tx.QueryRow(ctx, `SELECT id FROM route WHERE id = $1 FOR UPDATE`, id).Scan(&routeId)
+	}
+	if err != nil {
+		if err == pgx.ErrNoRows {
+			err = ErrRouteNotFound
+			return
+		}
+		err = fmt.Errorf("unable to execute update route SQL: %w", err)
+		return
+	}
+
+	if data.Stops != nil {
+		if _, err = tx.Exec(ctx, `DELETE FROM route_stop WHERE route_id = $1`, routeId); err != nil {
+			err = fmt.Errorf("unable to clear route stops: %w", err)
+			return
+		}
+		if err = insertRouteStops(ctx, tx, routeId, data.Stops); err != nil {
+			return
+		}
+	}
+	if data.Polyline != nil {
+		polyline, encodeErr := polylineParam(data.Polyline)
+		if encodeErr != nil {
+			err = encodeErr
+			return
+		}
+		if _, err = tx.Exec(ctx, `UPDATE route SET polyline = $2 WHERE id = $1`, routeId, polyline); err != nil {
+			err = fmt.Errorf("unable to update route polyline: %w", err)
+			return
+		}
+	}
+	if data.LapRule != nil {
+		lapRule, encodeErr := lapRuleParam(data.LapRule)
+		if encodeErr != nil {
+			err = encodeErr
+			return
+		}
+		if _, err = tx.Exec(ctx, `UPDATE route SET lap_rule = $2 WHERE id = $1`, routeId, lapRule); err != nil {
+			err = fmt.Errorf("unable to update route lap rule: %w", err)
+			return
+		}
+	}
+	if err = tx.Commit(ctx); err != nil {
+		err = fmt.Errorf("unable to commit route: %w", err)
+		return
+	}
+	return r.GetRouteById(ctx, id)
+}
+
+func (r *repository) DeleteRoute(ctx context.Context, id string) (err error) {
+	_, err = r.db.Exec(ctx, "DELETE FROM route WHERE id = $1", id)
+	return
+}
@@ -0,0 +1,56 @@
+package db
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+const maxListenBackoff = time.Minute
+
+// Listen calls onNotify with the payload of every notification on channel until ctx is cancelled.
+// The connection is re-established on errors, and onNotify is called with an empty payload after
+// every (re)subscription because notifications sent while disconnected are lost.
+func Listen(ctx context.Context, pool *pgxpool.Pool, channel string, onNotify func(payload string)) {
+	backoff := time.Second
+	for {
+		err := listenOnce(ctx, pool, channel, onNotify, func() { backoff = time.Second })
+		if ctx.Err() != nil {
+			return
+		}
+		log.Printf("Listening on %s failed, retrying in %s: %v", channel, backoff, err)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, maxListenBackoff)
+	}
+}
+
+func listenOnce(ctx context.Context, pool *pgxpool.Pool, channel string, onNotify func(payload string), onSubscribed func()) error {
+	pooled, err := pool.Acquire(ctx)
+	if err != nil {
+		return err
+	}
+	// The connection holds a LISTEN registration, never hand it back to the pool
+	conn := pooled.Hijack()
+	defer conn.Close(context.Background())
+
+	if _, err := conn.Exec(ctx, "LISTEN "+pgx.Identifier{channel}.Sanitize()); err != nil {
+		return err
+	}
+	onSubscribed()
+	onNotify("")
+
+	for {
+		notification, err := conn.WaitForNotification(ctx)
+		if err != nil {
+			return err
+		}
+		onNotify(notification.Payload)
+	}
+}
@@ -0,0 +1,16 @@
+-- Create table to store every accepted GPS fix
+CREATE TABLE bus_position (
+    id BIGSERIAL PRIMARY KEY,
+    imei VARCHAR(32) NOT NULL,
+    latitude DOUBLE PRECISION NOT NULL,
+    longitude DOUBLE PRECISION NOT NULL,
+    speed INTEGER NOT NULL DEFAULT 0,
+    direction DOUBLE PRECISION NOT NULL DEFAULT 0,
+    engine_on BOOLEAN NOT NULL DEFAULT FALSE,
+    device_time TIMESTAMP WITH TIME ZONE NOT NULL,
+    received_at TIMESTAMP WITH TIME ZONE NOT NULL
+);
+
+-- Time range queries are always scoped to a single bus
+CREATE INDEX idx_bus_position_imei_device_time ON bus_position(imei, device_time);
+CREATE INDEX idx_bus_position_device_time ON bus_position USING BRIN(device_time);
@@ -0,0 +1,11 @@
+DROP TRIGGER IF EXISTS bus_stop_catalog_changed ON bus_stop;
+DROP FUNCTION IF EXISTS notify_catalog_changed();
+
+-- Stops are kept, seeded rows cannot be told apart from stops created by an admin since
+
+ALTER TABLE bus_stop DROP CONSTRAINT bus_stop_name_key;
+ALTER TABLE bus_stop ALTER COLUMN image_url DROP DEFAULT;
+ALTER TABLE bus_stop ALTER COLUMN description DROP DEFAULT;
+ALTER TABLE bus_stop DROP COLUMN arrival_radius;
+ALTER TABLE bus_stop DROP COLUMN longitude;
+ALTER TABLE bus_stop DROP COLUMN latitude;
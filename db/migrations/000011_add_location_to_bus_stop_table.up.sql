@@ -0,0 +1,45 @@
+-- Store where every bus stop is so halte detection reads the stops from the database
+ALTER TABLE bus_stop ADD COLUMN latitude DOUBLE PRECISION;
+ALTER TABLE bus_stop ADD COLUMN longitude DOUBLE PRECISION;
+ALTER TABLE bus_stop ADD COLUMN arrival_radius DOUBLE PRECISION NOT NULL DEFAULT 45;
+ALTER TABLE bus_stop ALTER COLUMN image_url SET DEFAULT '';
+ALTER TABLE bus_stop ALTER COLUMN description SET DEFAULT '';
+ALTER TABLE bus_stop ADD CONSTRAINT bus_stop_name_key UNIQUE (name);
+
+-- Seed the stops that used to be hard-coded in halteList
+INSERT INTO bus_stop (name, latitude, longitude) VALUES
+  ('Asrama UI', -6.348351370044594, 106.82976588606834),
+  ('Menwa', -6.353471269466313, 106.83177955448627),
+  ('Stasiun UI', -6.361052900888018, 106.83170076459645),
+  ('Fakultas Psikologi', -6.36255935735158, 106.83111906051636),
+  ('FISIP', -6.361574, 106.830172),
+  ('Fakultas Ilmu Pengetahuan Budaya', -6.361254501381427, 106.82978868484497),
+  ('Fakultas Ekonomi dan Bisnis', -6.35946048561971, 106.82582974433899),
+  ('Fakultas Teknik', -6.361043911445512, 106.82325214147568),
+  ('Vokasi', -6.366036735678631, 106.8216535449028),
+  ('SOR', -6.366915739619239, 106.82448193430899),
+  ('FMIPA', -6.369828304090281, 106.8257811293006),
+  ('Fakultas Ilmu Keperawatan', -6.371008186217929, 106.8268945813179),
+  ('Fakultas Kesehatan Masyarakat', -6.371677262480034, 106.8293622136116),
+  ('RIK', -6.36987795182555, 106.8310546875),
+  ('Stasiun Pondok Cina', -6.368212251024606, 106.83178257197142),
+  ('MUI/Perpus UI', -6.3655942342627565, 106.83204710483551),
+  ('Fakultas Hukum', -6.364901492199248, 106.83221206068993),
+  ('Parking', -6.348922, 106.826476),
+  ('Balai Sidang', -6.369147, 106.828450),
+  ('Balairung', -6.36913, 106.82963),
+  ('Fakultas Farmasi', -6.36813, 106.82731),
+  ('RSUI', -6.37285, 106.82869)
+ON CONFLICT (name) DO UPDATE SET latitude = EXCLUDED.latitude, longitude = EXCLUDED.longitude;
+
+-- Running servers LISTEN on catalog_changed and reload their in-memory catalogs, the payload is the table name
+DROP FUNCTION IF EXISTS notify_catalog_changed();
+CREATE OR REPLACE FUNCTION notify_catalog_changed()
+RETURNS TRIGGER AS $$
+BEGIN
+   PERFORM pg_notify('catalog_changed', TG_TABLE_NAME);
+   RETURN NULL;
+END;
+$$ language 'plpgsql';
+
+CREATE TRIGGER bus_stop_catalog_changed AFTER INSERT OR UPDATE OR DELETE OR TRUNCATE ON bus_stop FOR EACH STATEMENT EXECUTE PROCEDURE notify_catalog_changed();
@@ -0,0 +1,5 @@
+DROP TRIGGER IF EXISTS route_stop_catalog_changed ON route_stop;
+DROP TRIGGER IF EXISTS route_catalog_changed ON route;
+DROP TRIGGER IF EXISTS update_route_updated_at ON route;
+DROP TABLE IF EXISTS route_stop;
+DROP TABLE IF EXISTS route;
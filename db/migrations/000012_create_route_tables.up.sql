@@ -0,0 +1,52 @@
+-- A route is one variant (normal, morning) of a colored bus line
+CREATE TABLE route (
+  id SERIAL PRIMARY KEY,
+  name VARCHAR(64) NOT NULL UNIQUE,
+  color VARCHAR(32) NOT NULL,
+  variant VARCHAR(32) NOT NULL,
+  is_active BOOLEAN NOT NULL DEFAULT TRUE,
+  created_at BIGINT DEFAULT EXTRACT(EPOCH FROM CURRENT_TIMESTAMP),
+  updated_at BIGINT DEFAULT EXTRACT(EPOCH FROM CURRENT_TIMESTAMP),
+  UNIQUE (color, variant)
+);
+
+-- Ordered stops of a route, a stop may appear more than once. Routes are circular, the last stop leads back to the first.
+CREATE TABLE route_stop (
+  route_id INTEGER NOT NULL REFERENCES route(id) ON DELETE CASCADE,
+  sequence INTEGER NOT NULL,
+  bus_stop_id INTEGER NOT NULL REFERENCES bus_stop(id) ON DELETE RESTRICT,
+  PRIMARY KEY (route_id, sequence)
+);
+
+CREATE INDEX idx_route_stop_bus_stop_id ON route_stop(bus_stop_id);
+
+CREATE TRIGGER update_route_updated_at BEFORE UPDATE ON route FOR EACH ROW EXECUTE PROCEDURE update_modified_column();
+CREATE TRIGGER route_catalog_changed AFTER INSERT OR UPDATE OR DELETE OR TRUNCATE ON route FOR EACH STATEMENT EXECUTE PROCEDURE notify_catalog_changed();
+CREATE TRIGGER route_stop_catalog_changed AFTER INSERT OR UPDATE OR DELETE OR TRUNCATE ON route_stop FOR EACH STATEMENT EXECUTE PROCEDURE notify_catalog_changed();
+
+-- Seed the routes that used to be hard-coded in app/bus/route.go
+INSERT INTO route (name, color, variant) VALUES
+  ('blue-normal', 'blue', 'normal'),
+  ('blue-morning', 'blue', 'morning'),
+  ('red-normal', 'red', 'normal'),
+  ('red-morning', 'red', 'morning');
+
+INSERT INTO route_stop (route_id, sequence, bus_stop_id)
+SELECT r.id, s.sequence, bs.id
+FROM route r
+JOIN (
+  SELECT 'blue-normal' AS route_name, stop.name, stop.sequence
+  FROM unnest(ARRAY['Asrama UI', 'Menwa', 'Stasiun UI', 'Fakultas Psikologi', 'FISIP', 'Fakultas Ilmu Pengetahuan Budaya', 'Fakultas Ekonomi dan Bisnis', 'Fakultas Teknik', 'Vokasi', 'SOR', 'Fakultas Farmasi', 'Balai Sidang', 'Balairung', 'Stasiun Pondok Cina', 'MUI/Perpus UI', 'Fakultas Hukum', 'Stasiun UI', 'Menwa', 'Asrama UI', 'Parking']) WITH ORDINALITY AS stop(name, sequence)
+  UNION ALL
+  -- The hard-coded list went SOR -> FIA -> Balairung, but FIA was never a known stop so that transition could not match.
+  -- FIA is dropped here, add it as a bus_stop and insert it back into this route once its coordinates are known.
+  SELECT 'blue-morning', stop.name, stop.sequence
+  FROM unnest(ARRAY['Asrama UI', 'Menwa', 'Stasiun UI', 'Fakultas Psikologi', 'FISIP', 'Fakultas Ilmu Pengetahuan Budaya', 'Fakultas Ekonomi dan Bisnis', 'Fakultas Teknik', 'Vokasi', 'SOR', 'Balairung', 'Stasiun Pondok Cina', 'MUI/Perpus UI', 'Fakultas Hukum', 'Fakultas Psikologi', 'FISIP', 'Fakultas Ilmu Pengetahuan Budaya', 'Fakultas Ekonomi dan Bisnis', 'Fakultas Teknik', 'Parking']) WITH ORDINALITY AS stop(name, sequence)
+  UNION ALL
+  SELECT 'red-normal', stop.name, stop.sequence
+  FROM unnest(ARRAY['Asrama UI', 'Menwa', 'Stasiun UI', 'Fakultas Hukum', 'Balairung', 'RIK', 'Fakultas Kesehatan Masyarakat', 'RSUI', 'Fakultas Ilmu Keperawatan', 'FMIPA', 'SOR', 'Vokasi', 'Fakultas Teknik', 'Fakultas Ekonomi dan Bisnis', 'Fakultas Ilmu Pengetahuan Budaya', 'FISIP', 'Fakultas Psikologi', 'Stasiun UI', 'Menwa', 'Asrama UI', 'Parking']) WITH ORDINALITY AS stop(name, sequence)
+  UNION ALL
+  SELECT 'red-morning', stop.name, stop.sequence
+  FROM unnest(ARRAY['Asrama UI', 'Menwa', 'Stasiun UI', 'Fakultas Hukum', 'Balairung', 'RIK', 'Fakultas Kesehatan Masyarakat', 'RSUI', 'Fakultas Ilmu Keperawatan', 'FMIPA', 'SOR', 'Vokasi', 'Fakultas Teknik', 'Parking']) WITH ORDINALITY AS stop(name, sequence)
+) s ON s.route_name = r.name
+JOIN bus_stop bs ON bs.name = s.name;
@@ -0,0 +1,2 @@
+-- GeoJSON [longitude, latitude] positions of the path driven from the first stop around the route
+ALTER TABLE route ADD COLUMN polyline JSONB;
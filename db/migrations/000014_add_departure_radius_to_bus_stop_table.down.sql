@@ -0,0 +1,4 @@
+ALTER TABLE bus_stop DROP CONSTRAINT IF EXISTS bus_stop_departure_radius_check;
+UPDATE bus_stop SET arrival_radius = 45
+  WHERE name IN ('FISIP', 'Fakultas Ilmu Pengetahuan Budaya', 'MUI/Perpus UI', 'Fakultas Hukum');
+ALTER TABLE bus_stop DROP COLUMN IF EXISTS departure_radius;
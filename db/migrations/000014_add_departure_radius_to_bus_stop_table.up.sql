@@ -0,0 +1,13 @@
+-- A bus arrives at a stop inside arrival_radius and only departs once it leaves departure_radius,
+-- the gap between both keeps GPS jitter at the edge of a stop from producing repeated arrivals
+ALTER TABLE bus_stop ADD COLUMN departure_radius DOUBLE PRECISION NOT NULL DEFAULT 70;
+UPDATE bus_stop SET departure_radius = arrival_radius + 25 WHERE departure_radius < arrival_radius;
+
+-- FISIP and FIB are about 55m apart, MUI/Perpus UI and Fakultas Hukum about 80m,
+-- the default radii would make their arrival zones overlap
+UPDATE bus_stop SET arrival_radius = 25, departure_radius = 40
+  WHERE name IN ('FISIP', 'Fakultas Ilmu Pengetahuan Budaya');
+UPDATE bus_stop SET arrival_radius = 35, departure_radius = 50
+  WHERE name IN ('MUI/Perpus UI', 'Fakultas Hukum');
+
+ALTER TABLE bus_stop ADD CONSTRAINT bus_stop_departure_radius_check CHECK (departure_radius >= arrival_radius);
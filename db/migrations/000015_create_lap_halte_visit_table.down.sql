@@ -0,0 +1 @@
+DROP TABLE IF EXISTS lap_halte_visit;
@@ -0,0 +1,29 @@
+-- Store every stop of a lap as a row instead of the concatenated halte_visit_history string
+CREATE TABLE lap_halte_visit (
+    id SERIAL PRIMARY KEY,
+    lap_id INTEGER NOT NULL REFERENCES bus_lap_history(id) ON DELETE CASCADE,
+    sequence INTEGER NOT NULL,
+    halte VARCHAR(64) NOT NULL,
+    arrived_at TIMESTAMP WITH TIME ZONE NOT NULL,
+    departed_at TIMESTAMP WITH TIME ZONE,
+    UNIQUE (lap_id, sequence)
+);
+
+CREATE INDEX idx_lap_halte_visit_halte_arrived_at ON lap_halte_visit(halte, arrived_at);
+
+-- Back-fill from "Halte [2006-01-02 15:04:05] -> Halte [...]" entries written in Jakarta time,
+-- entries without a readable timestamp are skipped. Departure times were never recorded.
+INSERT INTO lap_halte_visit (lap_id, sequence, halte, arrived_at)
+SELECT lap_id,
+       ROW_NUMBER() OVER (PARTITION BY lap_id ORDER BY position),
+       parts[1],
+       parts[2]::TIMESTAMP AT TIME ZONE 'Asia/Jakarta'
+FROM (
+    SELECT blh.id AS lap_id,
+           entry.position,
+           regexp_match(entry.value, '^(.*) \[(\d{4}-\d{2}-\d{2} \d{2}:\d{2}:\d{2})\]$') AS parts
+    FROM bus_lap_history blh
+    CROSS JOIN LATERAL unnest(string_to_array(blh.halte_visit_history, ' -> ')) WITH ORDINALITY AS entry(value, position)
+    WHERE blh.halte_visit_history IS NOT NULL AND blh.halte_visit_history <> ''
+) entries
+WHERE parts IS NOT NULL;
@@ -0,0 +1 @@
+ALTER TABLE route DROP COLUMN IF EXISTS lap_rule;
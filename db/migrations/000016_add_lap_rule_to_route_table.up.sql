@@ -0,0 +1,8 @@
+-- Where laps of a route start and end, routes without a rule use the built-in rule of the tracker
+ALTER TABLE route ADD COLUMN lap_rule JSONB;
+
+-- Normal routes come back through Menwa to Asrama UI before parking, morning routes park right after Fakultas Teknik
+UPDATE route SET lap_rule = '{"start": {"from": "Asrama UI", "to": "Menwa"}, "end": [{"from": "Menwa", "to": "Asrama UI"}, {"to": "Parking"}], "min_stops": 8}'
+  WHERE variant = 'normal';
+UPDATE route SET lap_rule = '{"start": {"from": "Asrama UI", "to": "Menwa"}, "end": [{"to": "Parking"}], "min_stops": 6}'
+  WHERE variant = 'morning';
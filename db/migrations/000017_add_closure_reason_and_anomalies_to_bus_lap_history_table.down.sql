@@ -0,0 +1,4 @@
+UPDATE route SET lap_rule = lap_rule - 'mandatory_stops' WHERE lap_rule IS NOT NULL;
+DROP INDEX IF EXISTS idx_bus_lap_history_open;
+ALTER TABLE bus_lap_history DROP COLUMN IF EXISTS anomalies;
+ALTER TABLE bus_lap_history DROP COLUMN IF EXISTS closure_reason;
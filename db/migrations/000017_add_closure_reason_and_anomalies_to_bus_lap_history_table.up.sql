@@ -0,0 +1,22 @@
+-- Why a lap was closed and what looked wrong about it, see LAP_CLOSURE_* and LAP_ANOMALY_* in models
+ALTER TABLE bus_lap_history ADD COLUMN closure_reason VARCHAR(32);
+ALTER TABLE bus_lap_history ADD COLUMN anomalies TEXT[] NOT NULL DEFAULT '{}';
+
+UPDATE bus_lap_history SET closure_reason = 'completed' WHERE end_time IS NOT NULL;
+
+-- The lap janitor and active lap lookups only look at open laps
+CREATE INDEX idx_bus_lap_history_open ON bus_lap_history(imei, start_time) WHERE end_time IS NULL;
+
+-- Stops every lap of a route is expected to pass, a lap missing one of them is flagged.
+-- Each variant only gets the landmark stops its own route_stop rows drive through, in route order.
+UPDATE route r SET lap_rule = jsonb_set(r.lap_rule, '{mandatory_stops}', COALESCE((
+    SELECT jsonb_agg(stops.name ORDER BY stops.sequence)
+    FROM (
+      SELECT bs.name, MIN(rs.sequence) AS sequence
+      FROM route_stop rs
+      JOIN bus_stop bs ON bs.id = rs.bus_stop_id
+      WHERE rs.route_id = r.id AND bs.name IN ('Stasiun UI', 'Balairung', 'Fakultas Teknik')
+      GROUP BY bs.name
+    ) stops
+  ), '[]'::jsonb))
+  WHERE r.lap_rule IS NOT NULL;
@@ -0,0 +1,4 @@
+ALTER TABLE bus_lap_history DROP CONSTRAINT IF EXISTS bus_lap_history_daily_lap_number_key;
+ALTER TABLE bus_lap_history DROP CONSTRAINT IF EXISTS bus_lap_history_lap_number_key;
+ALTER TABLE bus_lap_history DROP COLUMN IF EXISTS daily_lap_number;
+ALTER TABLE bus_lap_history DROP COLUMN IF EXISTS service_date;
@@ -0,0 +1,29 @@
+-- Laps are numbered per bus over its lifetime and per Jakarta operating day,
+-- both are assigned when a lap is created while holding an advisory lock on the bus
+ALTER TABLE bus_lap_history ADD COLUMN service_date DATE;
+ALTER TABLE bus_lap_history ADD COLUMN daily_lap_number INTEGER;
+
+-- Laps used to be numbered by counting the rows of a bus, concurrent starts produced duplicates
+UPDATE bus_lap_history blh
+SET lap_number = numbered.lap_number,
+    service_date = numbered.service_date,
+    daily_lap_number = numbered.daily_lap_number
+FROM (
+    SELECT id,
+           (start_time AT TIME ZONE 'Asia/Jakarta')::DATE AS service_date,
+           ROW_NUMBER() OVER (PARTITION BY bus_id ORDER BY start_time, id) AS lap_number,
+           ROW_NUMBER() OVER (
+               PARTITION BY bus_id, (start_time AT TIME ZONE 'Asia/Jakarta')::DATE
+               ORDER BY start_time, id
+           ) AS daily_lap_number
+    FROM bus_lap_history
+) numbered
+WHERE blh.id = numbered.id;
+
+ALTER TABLE bus_lap_history ALTER COLUMN service_date SET NOT NULL;
+ALTER TABLE bus_lap_history ALTER COLUMN daily_lap_number SET NOT NULL;
+
+ALTER TABLE bus_lap_history ADD CONSTRAINT bus_lap_history_lap_number_key
+  UNIQUE (bus_id, lap_number) DEFERRABLE INITIALLY IMMEDIATE;
+ALTER TABLE bus_lap_history ADD CONSTRAINT bus_lap_history_daily_lap_number_key
+  UNIQUE (bus_id, service_date, daily_lap_number) DEFERRABLE INITIALLY IMMEDIATE;
@@ -0,0 +1,3 @@
+DROP TABLE IF EXISTS lap_correction;
+ALTER TABLE bus_lap_history DROP COLUMN IF EXISTS corrected_at;
+ALTER TABLE bus_lap_history DROP COLUMN IF EXISTS voided_at;
@@ -0,0 +1,20 @@
+-- Voided laps are kept for the audit trail but hidden from lap history by default
+ALTER TABLE bus_lap_history ADD COLUMN voided_at TIMESTAMP WITH TIME ZONE;
+ALTER TABLE bus_lap_history ADD COLUMN corrected_at TIMESTAMP WITH TIME ZONE;
+
+-- Every admin correction of a lap with snapshots of the laps involved before and after it.
+-- related_lap_id is the lap merged into lap_id or split off from it.
+CREATE TABLE lap_correction (
+    id SERIAL PRIMARY KEY,
+    lap_id INTEGER NOT NULL REFERENCES bus_lap_history(id) ON DELETE CASCADE,
+    related_lap_id INTEGER REFERENCES bus_lap_history(id) ON DELETE SET NULL,
+    action VARCHAR(16) NOT NULL,
+    corrected_by VARCHAR(255) NOT NULL,
+    reason TEXT NOT NULL,
+    before JSONB NOT NULL,
+    after JSONB NOT NULL,
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX idx_lap_correction_lap_id ON lap_correction(lap_id);
+CREATE INDEX idx_lap_correction_related_lap_id ON lap_correction(related_lap_id);
@@ -0,0 +1,4 @@
+DROP TABLE IF EXISTS bus_driver_change;
+DROP INDEX IF EXISTS idx_bus_lap_history_driver_start_time;
+ALTER TABLE bus_lap_history DROP COLUMN IF EXISTS driver;
+ALTER TABLE bus_position DROP COLUMN IF EXISTS driver;
@@ -0,0 +1,18 @@
+-- Driver reported by the vendor with every fix, NULL when it was not reported
+ALTER TABLE bus_position ADD COLUMN driver VARCHAR(128);
+-- Driver of the bus when the lap started
+ALTER TABLE bus_lap_history ADD COLUMN driver VARCHAR(128);
+
+CREATE INDEX idx_bus_lap_history_driver_start_time ON bus_lap_history(driver, start_time) WHERE driver IS NOT NULL;
+
+-- Every time a bus reports another driver than before, the latest row of a bus is its current driver
+CREATE TABLE bus_driver_change (
+    id SERIAL PRIMARY KEY,
+    imei VARCHAR(32) NOT NULL,
+    previous_driver VARCHAR(128),
+    driver VARCHAR(128) NOT NULL,
+    changed_at TIMESTAMP WITH TIME ZONE NOT NULL,
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX idx_bus_driver_change_imei_changed_at ON bus_driver_change(imei, changed_at);
@@ -6,14 +6,20 @@ import (
 	"fmt"
 	"log"
 	"net/http"
+	"os"
+	"os/signal"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/FreeJ1nG/bikuntracker-backend/app/auth"
 	"github.com/FreeJ1nG/bikuntracker-backend/app/bus"
 	"github.com/FreeJ1nG/bikuntracker-backend/app/damri"
 	"github.com/FreeJ1nG/bikuntracker-backend/app/dto"
+	"github.com/FreeJ1nG/bikuntracker-backend/app/eta"
+	"github.com/FreeJ1nG/bikuntracker-backend/app/halte"
 	"github.com/FreeJ1nG/bikuntracker-backend/app/rm"
+	"github.com/FreeJ1nG/bikuntracker-backend/app/route"
 	"github.com/FreeJ1nG/bikuntracker-backend/db"
 	"github.com/FreeJ1nG/bikuntracker-backend/utils"
 	"github.com/FreeJ1nG/bikuntracker-backend/utils/middleware"
@@ -37,13 +43,70 @@ func main() {
 
 	damriUtil := damri.NewUtil()
 	damriService := damri.NewService(config, damriUtil)
-	busContainer := bus.NewContainer(config, rmService, damriService, busService)
 
-	busHandler := bus.NewHandler(busRepo, busService, busContainer)
+	halteRepo := halte.NewRepository(pool)
+	halteCatalog := halte.NewCatalog(halteRepo)
+	if err := halteCatalog.Reload(context.Background()); err != nil {
+		log.Printf("Failed to load halte catalog, using the built-in halte list: %v", err)
+	}
+
+	routeRepo := route.NewRepository(pool)
+	routeCatalog := route.NewCatalog(routeRepo, halteCatalog)
+	if err := routeCatalog.Reload(context.Background()); err != nil {
+		log.Printf("Failed to load route catalog, using the built-in routes: %v", err)
+	}
+	routeHandler := route.NewHandler(routeRepo, halteRepo, routeCatalog)
+
+	telemetryWriter := bus.NewTelemetryWriter(busRepo, config)
+	busContainer := bus.NewContainer(config, rmService, damriService, busService, halteCatalog, routeCatalog, telemetryWriter)
+
+	busHandler := bus.NewHandler(busRepo, busService, busContainer, halteCatalog)
+
+	etaService := eta.NewService(config, busService, halteCatalog, routeCatalog)
+	halteHandler := halte.NewHandler(halteRepo, halteCatalog, busContainer, etaService)
 
-	// Initialize runtime caches; location updates now come via webhook instead of WS
+	// Initialize runtime caches before any location source starts feeding fixes
 	busContainer.InitRuntimeState()
 
+	// Background workers stop once the process receives SIGINT or SIGTERM
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	locationSources, err := bus.NewLocationSources(config)
+	if err != nil {
+		log.Fatalf("Failed to set up location sources: %s", err.Error())
+	}
+	busContainer.StartLocationSources(ctx, locationSources)
+	go busContainer.RunStatusMonitor(ctx)
+	go busContainer.RunLapJanitor(ctx)
+	go etaService.RunRefresher(ctx)
+
+	// Catalog tables notify catalog_changed with the table name, an empty payload means changes may have been missed
+	go db.Listen(ctx, pool, "catalog_changed", func(table string) {
+		if table == "" || table == "bus_stop" {
+			if err := halteCatalog.Reload(ctx); err != nil {
+				log.Printf("Failed to reload halte catalog: %v", err)
+			}
+		}
+		// Renaming or moving a stop changes the stop names and geometry of the routes using it
+		if table == "" || table == "bus_stop" || table == "route" || table == "route_stop" {
+			if err := routeCatalog.Reload(ctx); err != nil {
+				log.Printf("Failed to reload route catalog: %v", err)
+			}
+		}
+	})
+
+	telemetryDone := make(chan struct{})
+	go func() {
+		telemetryWriter.Run(ctx)
+		close(telemetryDone)
+	}()
+	persisterDone := make(chan struct{})
+	go func() {
+		busContainer.RunPersister(ctx)
+		close(persisterDone)
+	}()
+
 	authUtil := auth.NewUtil(config)
 	authRepo := auth.NewRepository(pool)
 	authService := auth.NewService(authUtil, authRepo)
@@ -52,6 +115,10 @@ func main() {
 	roleProtectMiddlewareFactory := middleware.NewRoleProtectMiddlewareFactory(config, authRepo)
 	adminApiKeyProtectorMiddleware := roleProtectMiddlewareFactory.MakeAdminApiKeyProtector()
 	jwtMiddleware := middleware.NewJwtMiddlewareFactory(authUtil).Make()
+	webhookSignatureMiddleware := middleware.NewWebhookSignatureMiddlewareFactory(config).Make()
+	if bus.IsLocationSourceEnabled(config, bus.SOURCE_WEBHOOK) && config.WebhookSecret == "" {
+		log.Println("WEBHOOK_SECRET is not set, all location webhook requests will be rejected")
+	}
 
 	utils.HandleRoute("/bus", utils.MethodHandler{http.MethodGet: busHandler.GetBuses, http.MethodPost: busHandler.CreateBus}, &utils.Options{
 		MethodSpecificMiddlewares: utils.MethodSpecificMiddlewares{
@@ -66,14 +133,69 @@ func main() {
 		},
 	})
 
+	utils.HandleRoute("/halte", utils.MethodHandler{http.MethodGet: halteHandler.GetHaltes, http.MethodPost: halteHandler.CreateHalte}, &utils.Options{
+		MethodSpecificMiddlewares: utils.MethodSpecificMiddlewares{
+			http.MethodPost: []middleware.Middleware{
+				adminApiKeyProtectorMiddleware,
+			},
+		},
+	})
+	utils.HandleRoute("/halte/:id", utils.MethodHandler{http.MethodPut: halteHandler.UpdateHalte, http.MethodDelete: halteHandler.DeleteHalte}, &utils.Options{
+		Middlewares: []middleware.Middleware{
+			adminApiKeyProtectorMiddleware,
+		},
+	})
+	utils.HandleRoute("/halte/:name/arrivals", utils.MethodHandler{http.MethodGet: halteHandler.GetHalteArrivals}, nil)
+
+	utils.HandleRoute("/route", utils.MethodHandler{http.MethodGet: routeHandler.GetRoutes, http.MethodPost: routeHandler.CreateRoute}, &utils.Options{
+		MethodSpecificMiddlewares: utils.MethodSpecificMiddlewares{
+			http.MethodPost: []middleware.Middleware{
+				adminApiKeyProtectorMiddleware,
+			},
+		},
+	})
+	utils.HandleRoute("/route/:id", utils.MethodHandler{http.MethodPut: routeHandler.UpdateRoute, http.MethodDelete: routeHandler.DeleteRoute}, &utils.Options{
+		Middlewares: []middleware.Middleware{
+			adminApiKeyProtectorMiddleware,
+		},
+	})
+
 	// Lap history routes
 	utils.HandleRoute("/bus/lap-history", utils.MethodHandler{http.MethodGet: busHandler.GetFilteredLapHistory}, &utils.Options{
 		Middlewares: []middleware.Middleware{
 			adminApiKeyProtectorMiddleware,
 		},
 	})
-	utils.HandleRoute("/bus/:imei/lap-history", utils.MethodHandler{http.MethodGet: busHandler.GetLapHistory}, nil)
-	utils.HandleRoute("/bus/:imei/active-lap", utils.MethodHandler{http.MethodGet: busHandler.GetActiveLap}, nil)
+	utils.HandleRoute("/bus/lap-history/export", utils.MethodHandler{http.MethodGet: busHandler.ExportLapHistory}, &utils.Options{
+		Middlewares: []middleware.Middleware{
+			adminApiKeyProtectorMiddleware,
+		},
+	})
+	utils.HandleRoute("/bus/lap-history/:id/corrections", utils.MethodHandler{http.MethodGet: busHandler.GetLapCorrections, http.MethodPost: busHandler.CorrectLap}, &utils.Options{
+		Middlewares: []middleware.Middleware{
+			adminApiKeyProtectorMiddleware,
+		},
+	})
+	utils.HandleRoute("/bus/driver-summary", utils.MethodHandler{http.MethodGet: busHandler.GetDriverSummary}, &utils.Options{
+		Middlewares: []middleware.Middleware{
+			adminApiKeyProtectorMiddleware,
+		},
+	})
+	utils.HandleRoute("/bus/lap-stats", utils.MethodHandler{http.MethodGet: busHandler.GetLapStats}, &utils.Options{
+		Middlewares: []middleware.Middleware{
+			adminApiKeyProtectorMiddleware,
+		},
+	})
+	utils.HandleRoute("/bus/:imei/lap-history", utils.MethodHandler{http.MethodGet: busHandler.GetLapHistory}, &utils.Options{
+		Middlewares: []middleware.Middleware{
+			adminApiKeyProtectorMiddleware,
+		},
+	})
+	utils.HandleRoute("/bus/:imei/active-lap", utils.MethodHandler{http.MethodGet: busHandler.GetActiveLap}, &utils.Options{
+		Middlewares: []middleware.Middleware{
+			adminApiKeyProtectorMiddleware,
+		},
+	})
 	// Debug route - remove in production
 	utils.HandleRoute("/bus/test-lap-data", utils.MethodHandler{http.MethodPost: busHandler.CreateTestLapData}, nil)
 	utils.HandleRoute("/bus/check-table", utils.MethodHandler{http.MethodGet: busHandler.CheckLapHistoryTable}, nil)
@@ -85,6 +207,26 @@ func main() {
 		&utils.Options{Middlewares: []middleware.Middleware{jwtMiddleware}},
 	)
 
+	// Every connection sends the same message, it is built once per tick and shared between connections
+	coordinateBroadcast := bus.NewBroadcastCache(time.Second, func(now time.Time) ([]byte, error) {
+		coordinates := busContainer.GetBusCoordinates()
+		etaService.Annotate(coordinates, now)
+		coordinatesMap := busContainer.GetBusCoordinatesMap()
+
+		// Get operational status with timeout
+		operationalStatus, err := damriService.GetOperationalStatus(coordinatesMap)
+		if err != nil {
+			// Log error but don't break connection - send data without operational status
+			log.Printf("Warning: Failed to get operational status: %v", err)
+			operationalStatus = 0 // Empty status
+		}
+
+		return json.Marshal(dto.CoordinateBroadcastMessage{
+			Coordinates:       coordinates,
+			OperationalStatus: operationalStatus,
+		})
+	})
+
 	utils.HandleRoute("/ws",
 		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			c, err := websocket.Accept(w, r, &websocket.AcceptOptions{
@@ -101,9 +243,6 @@ func main() {
 			ctx, cancel := context.WithCancel(r.Context())
 			defer cancel()
 
-			// Cache for message to avoid repeated marshaling
-			var lastMessage []byte
-			var lastUpdate time.Time
 			ticker := time.NewTicker(time.Second)
 			defer ticker.Stop()
 
@@ -135,47 +274,12 @@ func main() {
 				case <-ctx.Done():
 					return
 				case <-ticker.C:
-					// Only fetch data if we haven't updated recently or if data might be stale
-					now := time.Now()
-					if now.Sub(lastUpdate) < 500*time.Millisecond {
-						// Send cached message if recent
-						if lastMessage != nil {
-							writeCtx, writeCancel := context.WithTimeout(ctx, 5*time.Second)
-							if err := c.Write(writeCtx, websocket.MessageText, lastMessage); err != nil {
-								writeCancel()
-								return // Client disconnected or write timeout
-							}
-							writeCancel()
-						}
-						continue
-					}
-
-					// Fetch fresh data
-					coordinates := busContainer.GetBusCoordinates()
-					coordinatesMap := busContainer.GetBusCoordinatesMap()
-
-					// Get operational status with timeout
-					operationalStatus, err := damriService.GetOperationalStatus(coordinatesMap)
-					if err != nil {
-						// Log error but don't break connection - send data without operational status
-						log.Printf("Warning: Failed to get operational status: %v", err)
-						operationalStatus = 0 // Empty status
-					}
-
-					// Marshal message
-					message, err := json.Marshal(dto.CoordinateBroadcastMessage{
-						Coordinates:       coordinates,
-						OperationalStatus: operationalStatus,
-					})
+					message, err := coordinateBroadcast.Message(time.Now())
 					if err != nil {
 						log.Printf("JSON marshal error: %v", err)
 						continue
 					}
 
-					// Cache the message and timestamp
-					lastMessage = message
-					lastUpdate = now
-
 					// Send message with write timeout
 					writeCtx, writeCancel := context.WithTimeout(ctx, 5*time.Second)
 					if err := c.Write(writeCtx, websocket.MessageText, message); err != nil {
@@ -190,8 +294,41 @@ func main() {
 	)
 
 	// Webhook to receive location updates
-	utils.HandleRoute("/wh", utils.MethodHandler{http.MethodPost: busHandler.WebhookUpdate}, nil)
+	if bus.IsLocationSourceEnabled(config, bus.SOURCE_WEBHOOK) {
+		utils.HandleRoute("/wh", utils.MethodHandler{http.MethodPost: busHandler.WebhookUpdate}, &utils.Options{
+			Middlewares: []middleware.Middleware{
+				webhookSignatureMiddleware,
+			},
+		})
+		utils.HandleRoute("/wh/batch", utils.MethodHandler{http.MethodPost: busHandler.WebhookBatchUpdate}, &utils.Options{
+			Middlewares: []middleware.Middleware{
+				webhookSignatureMiddleware,
+			},
+		})
+	}
+
+	utils.HandleRoute("/ingest/status", utils.MethodHandler{http.MethodGet: busHandler.GetIngestStatus}, &utils.Options{
+		Middlewares: []middleware.Middleware{
+			adminApiKeyProtectorMiddleware,
+		},
+	})
+
+	server := &http.Server{Addr: ":" + config.Port}
+	go func() {
+		<-ctx.Done()
+		log.Println("Shutting down server ...")
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		if err := server.Shutdown(shutdownCtx); err != nil {
+			log.Printf("Server shutdown error: %v", err)
+		}
+	}()
 
 	fmt.Printf("Listening on port %s ...\n", config.Port)
-	log.Fatal(http.ListenAndServe(":"+config.Port, nil))
+	if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		log.Fatal(err)
+	}
+	// Wait for queued telemetry and pipeline writes to be written before exiting
+	<-telemetryDone
+	<-persisterDone
 }
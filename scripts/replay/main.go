@@ -0,0 +1,263 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/FreeJ1nG/bikuntracker-backend/app/bus"
+	"github.com/FreeJ1nG/bikuntracker-backend/app/damri"
+	"github.com/FreeJ1nG/bikuntracker-backend/app/dto"
+	"github.com/FreeJ1nG/bikuntracker-backend/app/halte"
+	"github.com/FreeJ1nG/bikuntracker-backend/app/interfaces"
+	"github.com/FreeJ1nG/bikuntracker-backend/app/models"
+	"github.com/FreeJ1nG/bikuntracker-backend/app/route"
+	"github.com/FreeJ1nG/bikuntracker-backend/db"
+	"github.com/FreeJ1nG/bikuntracker-backend/utils"
+)
+
+const (
+	USAGE_STRING = "Usage: go run scripts/replay/main.go (-file <fixes.jsonl> | -db -from <time> [-to <time>] [-imei <imei>]) [-speed <factor>] [-json] [-verbose]."
+)
+
+// virtualClock follows the device time of the fix being replayed
+type virtualClock struct {
+	mu  sync.RWMutex
+	now time.Time
+}
+
+func (c *virtualClock) Now() time.Time {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.now
+}
+
+func (c *virtualClock) Set(t time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = t
+}
+
+// replaySink registers unknown buses and advances the virtual clock before handing fixes to the container
+type replaySink struct {
+	container interface {
+		interfaces.LocationSink
+		RefreshBusMetadata(ctx context.Context)
+		CheckBusStatuses()
+		CloseOrphanedLaps()
+		FlushPersister()
+	}
+	busService *memoryBusService
+	clock      *virtualClock
+	known      map[string]bool
+	fed        int
+	rejected   int
+}
+
+func (s *replaySink) ApplyExternalCoordinates(fixes []*models.BusCoordinate) []error {
+	registered := false
+	for _, fix := range fixes {
+		if !s.known[fix.Imei] {
+			s.known[fix.Imei] = true
+			s.busService.Register(models.Bus{Imei: fix.Imei, PlateNumber: fix.PlateNumber, BusNumber: fix.BusNumber})
+			registered = true
+		}
+		if !fix.GpsTime.IsZero() {
+			s.clock.Set(fix.GpsTime)
+		}
+	}
+	if registered {
+		s.container.RefreshBusMetadata(context.Background())
+	}
+
+	// Silence between two recorded fixes is evaluated on the virtual clock before the next fix arrives.
+	// Writes are flushed before the clock moves on, so laps are stored and reported in fix order.
+	s.container.CheckBusStatuses()
+	s.container.FlushPersister()
+	s.container.CloseOrphanedLaps()
+	errs := s.container.ApplyExternalCoordinates(fixes)
+	s.container.FlushPersister()
+	for i, err := range errs {
+		s.fed++
+		if err != nil {
+			s.rejected++
+			log.Printf("Rejected fix %d of %s: %v", s.fed, fixes[i].Imei, err)
+		}
+	}
+	return errs
+}
+
+func parseFlagTime(value string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	for _, layout := range []string{"2006-01-02 15:04:05", "2006-01-02 15:04", "2006-01-02"} {
+		if t, err := time.ParseInLocation(layout, value, bus.Jakarta); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid time %q, expected RFC3339 or YYYY-MM-DD [HH:MM[:SS]] in Jakarta time", value)
+}
+
+func printEvent(event dto.BusEvent, asJSON bool) {
+	if asJSON {
+		line, err := json.Marshal(event)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "unable to marshal event: %v\n", err)
+			return
+		}
+		fmt.Println(string(line))
+		return
+	}
+
+	at := event.At.Format(time.RFC3339)
+	switch event.Type {
+	case "arrived":
+		fmt.Printf("%s %s arrived at %q\n", at, event.IMEI, event.Halte)
+	case "departed":
+		fmt.Printf("%s %s departed from %q after %.0fs\n", at, event.IMEI, event.Halte, event.DwellSeconds)
+	case "halte_switch":
+		fmt.Printf("%s %s halte_switch %q -> %q\n", at, event.IMEI, event.PreviousHalte, event.Halte)
+	case "color_change":
+		fmt.Printf("%s %s color_change %s -> %s at %q\n", at, event.IMEI, event.PreviousColor, event.Color, event.Halte)
+	case "status_change":
+		fmt.Printf("%s %s status_change %s -> %s\n", at, event.IMEI, event.PreviousStatus, event.Status)
+	default:
+		fmt.Printf("%s %s %s lap=%d color=%s\n", at, event.IMEI, event.Type, event.LapNumber, event.Color)
+	}
+}
+
+func main() {
+	filePath := flag.String("file", "", "JSONL file with one BusCoordinate per line")
+	fromDB := flag.Bool("db", false, "read fixes from the bus_position table")
+	imei := flag.String("imei", "", "only replay this bus when reading from the database")
+	fromValue := flag.String("from", "", "start of the replayed range when reading from the database")
+	toValue := flag.String("to", "", "end of the replayed range, defaults to one day after -from")
+	speed := flag.Float64("speed", 0, "replay speed factor, 0 replays as fast as possible")
+	asJSON := flag.Bool("json", false, "print events as JSON lines")
+	verbose := flag.Bool("verbose", false, "keep the pipeline logs")
+	flag.Parse()
+
+	if (*filePath == "") == !*fromDB {
+		fmt.Println(USAGE_STRING)
+		os.Exit(2)
+	}
+	if !*verbose {
+		log.SetOutput(io.Discard)
+	}
+
+	config, err := utils.SetupConfig()
+	if err != nil {
+		panic(err)
+	}
+	// Replays must never push logs or lap events to external collectors
+	config.PrintCsvLogs = false
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	clock := &virtualClock{}
+	busService := newMemoryBusService(clock.Now)
+
+	// Without a database the replay runs on the built-in stops and routes
+	halteCatalog := halte.NewCatalog(nil)
+	routeCatalog := route.NewCatalog(nil, halteCatalog)
+	var source interfaces.LocationSource
+	if *fromDB {
+		from, err := parseFlagTime(*fromValue)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(2)
+		}
+		to := from.Add(24 * time.Hour)
+		if *toValue != "" {
+			if to, err = parseFlagTime(*toValue); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(2)
+			}
+		}
+
+		pool := db.CreatePool(config.DBDsn)
+		db.TestConnection(pool)
+		busRepo := bus.NewRepository(pool)
+
+		buses, err := busRepo.GetBuses(ctx)
+		if err != nil {
+			panic(err)
+		}
+		for _, b := range buses {
+			busService.Register(b)
+		}
+
+		halteCatalog = halte.NewCatalog(halte.NewRepository(pool))
+		if err := halteCatalog.Reload(ctx); err != nil {
+			panic(err)
+		}
+		routeCatalog = route.NewCatalog(route.NewRepository(pool), halteCatalog)
+		if err := routeCatalog.Reload(ctx); err != nil {
+			panic(err)
+		}
+
+		positions, err := busRepo.GetBusPositions(ctx, *imei, from, to)
+		if err != nil {
+			panic(err)
+		}
+		pool.Close()
+		source = bus.NewPositionReplaySource(fmt.Sprintf("bus_position %s..%s", from.Format(time.RFC3339), to.Format(time.RFC3339)), positions, *speed)
+	} else {
+		source = bus.NewReplaySource(*filePath, *speed)
+	}
+
+	damriService := damri.NewService(config, damri.NewUtil())
+	busContainer := bus.NewContainer(config, noopRMService{}, damriService, busService, halteCatalog, routeCatalog, nil)
+	busContainer.SetClock(clock.Now)
+	busContainer.InitRuntimeState()
+	// The persister outlives ctx so an interrupted replay never waits on a flush nobody serves
+	go busContainer.RunPersister(context.Background())
+	busContainer.OnEvent(func(event dto.BusEvent) {
+		printEvent(event, *asJSON)
+	})
+
+	sink := &replaySink{
+		container:  busContainer,
+		busService: busService,
+		clock:      clock,
+		known:      make(map[string]bool),
+	}
+	buses, _ := busService.GetAllBuses(ctx)
+	for _, b := range buses {
+		sink.known[b.Imei] = true
+	}
+
+	if err := source.Run(ctx, sink); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	laps := busService.Laps()
+	if *asJSON {
+		return
+	}
+	fmt.Printf("\nReplayed %d fixes (%d rejected), %d laps\n", sink.fed, sink.rejected, len(laps))
+	for _, lap := range laps {
+		end := "open"
+		if lap.EndTime != nil {
+			end = lap.EndTime.Format(time.RFC3339) + " (" + lap.ClosureReason + ")"
+		}
+		if len(lap.Anomalies) > 0 {
+			end += fmt.Sprintf(" %v", lap.Anomalies)
+		}
+		if lap.Driver != "" {
+			end += " driver " + lap.Driver
+		}
+		fmt.Printf("  %s lap %d (%s #%d) %s %s -> %s: %s\n", lap.IMEI, lap.LapNumber, lap.ServiceDate, lap.DailyLapNumber, lap.RouteColor, lap.StartTime.Format(time.RFC3339), end, lap.HalteVisitHistory)
+	}
+}
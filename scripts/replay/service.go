@@ -0,0 +1,345 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/FreeJ1nG/bikuntracker-backend/app/bus"
+	"github.com/FreeJ1nG/bikuntracker-backend/app/dto"
+	"github.com/FreeJ1nG/bikuntracker-backend/app/models"
+)
+
+// memoryBusService is an in-memory interfaces.BusService so replays never write to the database.
+// Every timestamp comes from the virtual clock instead of the wall clock.
+type memoryBusService struct {
+	mu      sync.Mutex
+	now     func() time.Time
+	buses   map[string]*models.Bus
+	laps    []*models.BusLapHistory
+	drivers map[string]string
+}
+
+func newMemoryBusService(now func() time.Time) *memoryBusService {
+	return &memoryBusService{
+		now:     now,
+		buses:   make(map[string]*models.Bus),
+		drivers: make(map[string]string),
+	}
+}
+
+// Register adds a bus if it is not known yet, buses start grey like they do on server startup
+func (s *memoryBusService) Register(bus models.Bus) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.buses[bus.Imei]; ok {
+		return
+	}
+	if bus.Id == 0 {
+		bus.Id = len(s.buses) + 1
+	}
+	bus.Color = "grey"
+	s.buses[bus.Imei] = &bus
+}
+
+func (s *memoryBusService) updateBus(imei string, update func(bus *models.Bus)) (*models.Bus, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	bus, ok := s.buses[imei]
+	if !ok {
+		return nil, errors.New("no bus found with the given IMEI")
+	}
+	update(bus)
+	bus.UpdatedAt = s.now().Unix()
+	copied := *bus
+	return &copied, nil
+}
+
+func (s *memoryBusService) UpdateBusColorByImei(ctx context.Context, imei string, newColor string) (*models.Bus, error) {
+	return s.updateBus(imei, func(bus *models.Bus) { bus.Color = newColor })
+}
+
+func (s *memoryBusService) UpdateBusPlateNumberByImei(ctx context.Context, imei string, plateNumber string) (*models.Bus, error) {
+	return s.updateBus(imei, func(bus *models.Bus) { bus.PlateNumber = plateNumber })
+}
+
+func (s *memoryBusService) UpdateCurrentHalteByImei(ctx context.Context, imei string, newHalte string) (*models.Bus, error) {
+	return s.updateBus(imei, func(bus *models.Bus) { bus.CurrentHalte = newHalte })
+}
+
+func (s *memoryBusService) GetAllBuses(ctx context.Context) ([]models.Bus, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	res := make([]models.Bus, 0, len(s.buses))
+	for _, bus := range s.buses {
+		res = append(res, *bus)
+	}
+	return res, nil
+}
+
+func (s *memoryBusService) activeLap(imei string) *models.BusLapHistory {
+	for i := len(s.laps) - 1; i >= 0; i-- {
+		if s.laps[i].IMEI == imei && s.laps[i].EndTime == nil {
+			return s.laps[i]
+		}
+	}
+	return nil
+}
+
+func (s *memoryBusService) RecordDriverChange(ctx context.Context, imei string, previousDriver string, driver string, changedAt time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.drivers[imei] = driver
+	return nil
+}
+
+func (s *memoryBusService) GetCurrentDrivers(ctx context.Context) (map[string]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	res := make(map[string]string, len(s.drivers))
+	for imei, driver := range s.drivers {
+		res[imei] = driver
+	}
+	return res, nil
+}
+
+func (s *memoryBusService) StartLap(ctx context.Context, imei string, routeColor string, driver string, firstVisit models.LapHalteVisit) (*models.BusLapHistory, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	registered, ok := s.buses[imei]
+	if !ok {
+		return nil, errors.New("no bus found with the given IMEI")
+	}
+
+	now := s.now()
+	firstVisit.Sequence = 1
+	startTime := firstVisit.ArrivedAt
+	if firstVisit.DepartedAt != nil {
+		startTime = *firstVisit.DepartedAt
+	}
+
+	serviceDate := startTime.In(bus.Jakarta).Format("2006-01-02")
+	lapNumber, dailyLapNumber := 1, 1
+	for _, lap := range s.laps {
+		if lap.IMEI == imei {
+			lapNumber++
+			if lap.ServiceDate == serviceDate {
+				dailyLapNumber++
+			}
+		}
+	}
+	lap := &models.BusLapHistory{
+		ID:                len(s.laps) + 1,
+		BusID:             registered.Id,
+		IMEI:              imei,
+		LapNumber:         lapNumber,
+		DailyLapNumber:    dailyLapNumber,
+		ServiceDate:       serviceDate,
+		StartTime:         startTime,
+		RouteColor:        routeColor,
+		Driver:            driver,
+		HalteVisitHistory: bus.FormatHalteVisit(firstVisit),
+		HalteVisits:       []models.LapHalteVisit{firstVisit},
+		Anomalies:         make([]string, 0),
+		CreatedAt:         now,
+		UpdatedAt:         now,
+	}
+	s.laps = append(s.laps, lap)
+	copied := copyLap(lap)
+	return &copied, nil
+}
+
+func (s *memoryBusService) EndLap(ctx context.Context, imei string) (*models.BusLapHistory, error) {
+	return s.EndLapAt(ctx, imei, s.now(), "", models.LAP_CLOSURE_COMPLETED)
+}
+
+func closeLap(lap *models.BusLapHistory, endTime time.Time, closureReason string) {
+	if endTime.Before(lap.StartTime) {
+		endTime = lap.StartTime
+	}
+	lap.EndTime = &endTime
+	lap.UpdatedAt = endTime
+	lap.ClosureReason = closureReason
+}
+
+func (s *memoryBusService) EndLapAt(ctx context.Context, imei string, endTime time.Time, routeColor string, closureReason string) (*models.BusLapHistory, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	lap := s.activeLap(imei)
+	if lap == nil {
+		return nil, nil
+	}
+	if lap.RouteColor == "grey" && routeColor != "" {
+		lap.RouteColor = routeColor
+	}
+	closeLap(lap, endTime, closureReason)
+	copied := copyLap(lap)
+	return &copied, nil
+}
+
+func (s *memoryBusService) lap(id int) *models.BusLapHistory {
+	for _, lap := range s.laps {
+		if lap.ID == id {
+			return lap
+		}
+	}
+	return nil
+}
+
+func (s *memoryBusService) CloseLap(ctx context.Context, lap models.BusLapHistory, endTime time.Time, closureReason string) (*models.BusLapHistory, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stored := s.lap(lap.ID)
+	if stored == nil {
+		return nil, errors.New("no lap found with the given id")
+	}
+	closeLap(stored, endTime, closureReason)
+	copied := copyLap(stored)
+	return &copied, nil
+}
+
+func (s *memoryBusService) SetLapAnomalies(ctx context.Context, lapId int, anomalies []string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if lap := s.lap(lapId); lap != nil {
+		lap.Anomalies = anomalies
+	}
+	return nil
+}
+
+func (s *memoryBusService) GetOpenLaps(ctx context.Context) ([]models.BusLapHistory, error) {
+	res := make([]models.BusLapHistory, 0)
+	for _, lap := range s.Laps() {
+		if lap.EndTime == nil {
+			res = append(res, lap)
+		}
+	}
+	return res, nil
+}
+
+func (s *memoryBusService) GetActiveLap(ctx context.Context, imei string) (*models.BusLapHistory, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	lap := s.activeLap(imei)
+	if lap == nil {
+		return nil, nil
+	}
+	copied := copyLap(lap)
+	return &copied, nil
+}
+
+// copyLap copies a lap together with its visits so callers never share the stored slice
+func copyLap(lap *models.BusLapHistory) models.BusLapHistory {
+	copied := *lap
+	copied.HalteVisits = append([]models.LapHalteVisit(nil), lap.HalteVisits...)
+	return copied
+}
+
+func (s *memoryBusService) AddHalteVisitToActiveLap(ctx context.Context, imei string, halteName string, arrivedAt time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	lap := s.activeLap(imei)
+	if lap == nil {
+		return nil
+	}
+	visit := models.LapHalteVisit{Sequence: 1, Halte: halteName, ArrivedAt: arrivedAt}
+	if n := len(lap.HalteVisits); n > 0 {
+		if lap.HalteVisits[n-1].Halte == halteName {
+			return nil
+		}
+		visit.Sequence = lap.HalteVisits[n-1].Sequence + 1
+	}
+	lap.HalteVisits = append(lap.HalteVisits, visit)
+	if lap.HalteVisitHistory == "" {
+		lap.HalteVisitHistory = bus.FormatHalteVisit(visit)
+	} else {
+		lap.HalteVisitHistory += " -> " + bus.FormatHalteVisit(visit)
+	}
+	return nil
+}
+
+func (s *memoryBusService) SetHalteDepartureOnActiveLap(ctx context.Context, imei string, halteName string, departedAt time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	lap := s.activeLap(imei)
+	if lap == nil || len(lap.HalteVisits) == 0 {
+		return nil
+	}
+	if last := &lap.HalteVisits[len(lap.HalteVisits)-1]; last.Halte == halteName {
+		last.DepartedAt = &departedAt
+	}
+	return nil
+}
+
+// Laps returns every lap recorded during the replay
+func (s *memoryBusService) Laps() []models.BusLapHistory {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	res := make([]models.BusLapHistory, 0, len(s.laps))
+	for _, lap := range s.laps {
+		res = append(res, copyLap(lap))
+	}
+	return res
+}
+
+func (s *memoryBusService) GetFilteredLapHistory(ctx context.Context, filter dto.LapHistoryFilter) ([]models.BusLapHistory, error) {
+	res := make([]models.BusLapHistory, 0)
+	for _, lap := range s.Laps() {
+		if filter.IMEI != nil && lap.IMEI != *filter.IMEI {
+			continue
+		}
+		if filter.RouteColor != nil && lap.RouteColor != *filter.RouteColor {
+			continue
+		}
+		if filter.Driver != nil && lap.Driver != *filter.Driver {
+			continue
+		}
+		res = append(res, lap)
+	}
+	return res, nil
+}
+
+func (s *memoryBusService) GetFilteredLapHistoryCount(ctx context.Context, filter dto.LapHistoryFilter) (int, error) {
+	laps, err := s.GetFilteredLapHistory(ctx, filter)
+	return len(laps), err
+}
+
+func (s *memoryBusService) StreamFilteredLapHistory(ctx context.Context, filter dto.LapHistoryFilter, fn func(lap models.BusLapHistory) error) error {
+	laps, err := s.GetFilteredLapHistory(ctx, filter)
+	if err != nil {
+		return err
+	}
+	for _, lap := range laps {
+		if err := fn(lap); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// CorrectLap is not supported, replays only record laps
+func (s *memoryBusService) CorrectLap(ctx context.Context, lapId int, req dto.LapCorrectionRequest, anomalies func(lap models.BusLapHistory) []string) (*models.LapCorrection, error) {
+	return nil, errors.New("replays do not correct laps")
+}
+
+func (s *memoryBusService) GetLapCorrections(ctx context.Context, lapId int) ([]models.LapCorrection, error) {
+	return make([]models.LapCorrection, 0), nil
+}
+
+// GetLapStats aggregates nothing, replays print their laps instead
+func (s *memoryBusService) GetLapStats(ctx context.Context, filter dto.LapHistoryFilter, groupBy []string) ([]dto.LapStats, error) {
+	return make([]dto.LapStats, 0), nil
+}
+
+// GetSegmentTimes learns nothing, replays do not predict arrivals
+func (s *memoryBusService) GetSegmentTimes(ctx context.Context, from time.Time, maxSeconds float64, minHourSamples int) ([]dto.SegmentTime, error) {
+	return make([]dto.SegmentTime, 0), nil
+}
+
+// noopRMService never suggests a lane change, replays must not call the external detector
+type noopRMService struct{}
+
+func (noopRMService) DetectLane(imei string, data []*models.BusCoordinate) (res dto.DetectRouteResponse, err error) {
+	return dto.DetectRouteResponse{}, nil
+}
@@ -0,0 +1,31 @@
+package utils
+
+import "math"
+
+const earthRadius = 6371000 // meters
+
+// DistanceMeters returns the haversine distance between two points
+func DistanceMeters(lat1, lng1, lat2, lng2 float64) float64 {
+	dLat := (lat2 - lat1) * (math.Pi / 180)
+	dLng := (lng2 - lng1) * (math.Pi / 180)
+	alat := lat1 * (math.Pi / 180)
+	blat := lat2 * (math.Pi / 180)
+	a := (dLat/2)*(dLat/2) + (dLng/2)*(dLng/2)*math.Cos(alat)*math.Cos(blat)
+	c := 2 * math.Atan2(math.Sqrt(a), math.Sqrt(1-a))
+	return earthRadius * c
+}
+
+// LocalProjection maps lat/lng to planar meters around a reference latitude.
+// It is accurate enough for geometry at the scale of a campus.
+type LocalProjection struct {
+	lngScale float64
+}
+
+func NewLocalProjection(refLat float64) LocalProjection {
+	return LocalProjection{lngScale: math.Cos(refLat * math.Pi / 180)}
+}
+
+// Project returns the x (east) and y (north) coordinates in meters
+func (p LocalProjection) Project(lat, lng float64) (x float64, y float64) {
+	return lng * math.Pi / 180 * earthRadius * p.lngScale, lat * math.Pi / 180 * earthRadius
+}
@@ -83,16 +83,14 @@ func HandleRoute[H Handler](path string, handler H, options *Options) {
 		currentHandler = allMiddlewares[i](currentHandler)
 	}
 
-	var resolvedPath string
+	// Dynamic segments such as /bus/:imei/lap-history are registered as http.ServeMux wildcards (/bus/{imei}/lap-history),
+	// a segment only matches a single escaped path segment so values may contain an encoded slash
 	pathSplit := strings.Split(path, "/")
-	if len(pathSplit) > 0 && strings.Contains(pathSplit[len(pathSplit)-1], ":") {
-		// If the path contains a dynamic segment *at the end* (this is important)
-		// Then delete the dynamic segment and allow http.HandleFunc to match the path with a trailling slash
-		// For example /bus/:id will be transformed to /bus/, meaning any calls to /bus/5, /bus/10, etc will be matched
-		resolvedPath = strings.Join(pathSplit[:len(pathSplit)-1], "/") + "/"
-	} else {
-		resolvedPath = path
+	for i, p := range pathSplit {
+		if strings.HasPrefix(p, ":") {
+			pathSplit[i] = "{" + p[1:] + "}"
+		}
 	}
 
-	http.HandleFunc(resolvedPath, currentHandler.ServeHTTP)
+	http.HandleFunc(strings.Join(pathSplit, "/"), currentHandler.ServeHTTP)
 }
@@ -34,21 +34,12 @@ func GetRouteParam(r *http.Request, key string) (res string, status int, err err
 func ParseRouteParamsMiddlewareFactory(path string) Middleware {
 	return func(next http.HandlerFunc) http.HandlerFunc {
 		return func(w http.ResponseWriter, r *http.Request) {
-			requestUrl := r.URL.Path
-			requestUrlSplit := strings.Split(requestUrl, "/")
-			pathSplit := strings.Split(path, "/")
-
-			if len(requestUrlSplit) != len(pathSplit) {
-				http.Error(w, "Invalid URL format, not able to supply route params", http.StatusBadRequest)
-				return
-			}
-
 			routeParams := make(map[string]string)
-			for i, p := range pathSplit {
+			for _, p := range strings.Split(path, "/") {
 				if strings.HasPrefix(p, ":") {
-					// This means that this path must have a variable associated with it
+					// The mux matched this segment as a wildcard, PathValue returns it unescaped
 					variableName := p[1:]
-					routeParams[variableName] = requestUrlSplit[i]
+					routeParams[variableName] = r.PathValue(variableName)
 				}
 			}
 
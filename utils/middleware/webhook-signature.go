@@ -0,0 +1,171 @@
+package middleware
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/FreeJ1nG/bikuntracker-backend/app/models"
+)
+
+const (
+	WebhookSignatureHeader = "X-Webhook-Signature"
+
+	defaultWebhookMaxAge       = 5 * time.Minute
+	defaultWebhookReplayWindow = 10 * time.Minute
+	maxWebhookBodyBytes        = 5 << 20
+)
+
+type webhookSignatureMiddlewareFactory struct {
+	config       *models.Config
+	maxAge       time.Duration
+	replayWindow time.Duration
+	now          func() time.Time
+
+	mu        sync.Mutex
+	seenIDs   map[int]time.Time // event id -> time it was first accepted
+	lastPurge time.Time
+}
+
+func NewWebhookSignatureMiddlewareFactory(config *models.Config) *webhookSignatureMiddlewareFactory {
+	maxAge := defaultWebhookMaxAge
+	if config.WebhookMaxAgeSeconds > 0 {
+		maxAge = time.Duration(config.WebhookMaxAgeSeconds) * time.Second
+	}
+	replayWindow := defaultWebhookReplayWindow
+	if config.WebhookReplayWindowSeconds > 0 {
+		replayWindow = time.Duration(config.WebhookReplayWindowSeconds) * time.Second
+	}
+	// An event older than maxAge is already rejected as stale, so ids only need to be remembered that long
+	if replayWindow < maxAge {
+		replayWindow = maxAge
+	}
+	return &webhookSignatureMiddlewareFactory{
+		config:       config,
+		maxAge:       maxAge,
+		replayWindow: replayWindow,
+		now:          time.Now,
+		seenIDs:      make(map[int]time.Time),
+	}
+}
+
+// Make verifies the HMAC-SHA256 signature of the raw request body, rejects stale events
+// and drops events whose id has already been processed within the replay window.
+// An event only counts as processed when the handler answers below 400, so a sender can retry a failed event.
+func (wsmf *webhookSignatureMiddlewareFactory) Make() Middleware {
+	return func(next http.HandlerFunc) http.HandlerFunc {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if wsmf.config.WebhookSecret == "" {
+				http.Error(w, "webhook secret is not configured", http.StatusUnauthorized)
+				return
+			}
+
+			body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxWebhookBodyBytes))
+			if err != nil {
+				http.Error(w, "unable to read request body", http.StatusBadRequest)
+				return
+			}
+
+			if !wsmf.validSignature(body, r.Header.Get(WebhookSignatureHeader)) {
+				http.Error(w, "invalid webhook signature", http.StatusUnauthorized)
+				return
+			}
+
+			var envelope struct {
+				EventTime int64 `json:"event_time"`
+				EventID   int   `json:"event_id"`
+			}
+			if err := json.Unmarshal(body, &envelope); err != nil {
+				http.Error(w, "unable to parse request body", http.StatusBadRequest)
+				return
+			}
+			if envelope.EventID == 0 {
+				http.Error(w, "event_id is required", http.StatusBadRequest)
+				return
+			}
+
+			now := wsmf.now()
+			eventTime := parseEventTime(envelope.EventTime)
+			if eventTime.IsZero() || now.Sub(eventTime) > wsmf.maxAge || eventTime.Sub(now) > wsmf.maxAge {
+				http.Error(w, "webhook event is stale or has an invalid event_time", http.StatusUnauthorized)
+				return
+			}
+
+			if !wsmf.markSeen(envelope.EventID, now) {
+				http.Error(w, "webhook event has already been processed", http.StatusConflict)
+				return
+			}
+
+			// The id stays reserved while the handler runs so a concurrent retry is rejected, it is released if the handler fails
+			writer := &responseWriter{w, http.StatusOK}
+			processed := false
+			defer func() {
+				if !processed {
+					wsmf.release(envelope.EventID, now)
+				}
+			}()
+
+			r.Body = io.NopCloser(bytes.NewReader(body))
+			next.ServeHTTP(writer, r)
+			processed = writer.status < http.StatusBadRequest
+		})
+	}
+}
+
+func (wsmf *webhookSignatureMiddlewareFactory) validSignature(body []byte, header string) bool {
+	signature, err := hex.DecodeString(strings.TrimPrefix(strings.TrimSpace(header), "sha256="))
+	if err != nil || len(signature) == 0 {
+		return false
+	}
+	mac := hmac.New(sha256.New, []byte(wsmf.config.WebhookSecret))
+	mac.Write(body)
+	return hmac.Equal(signature, mac.Sum(nil))
+}
+
+// markSeen records an event id, returns false if it was already seen within the replay window
+func (wsmf *webhookSignatureMiddlewareFactory) markSeen(eventID int, now time.Time) bool {
+	wsmf.mu.Lock()
+	defer wsmf.mu.Unlock()
+
+	if now.Sub(wsmf.lastPurge) > time.Minute {
+		for id, seenAt := range wsmf.seenIDs {
+			if now.Sub(seenAt) > wsmf.replayWindow {
+				delete(wsmf.seenIDs, id)
+			}
+		}
+		wsmf.lastPurge = now
+	}
+
+	if seenAt, ok := wsmf.seenIDs[eventID]; ok && now.Sub(seenAt) <= wsmf.replayWindow {
+		return false
+	}
+	wsmf.seenIDs[eventID] = now
+	return true
+}
+
+// release forgets an event id reserved by markSeen at seenAt
+func (wsmf *webhookSignatureMiddlewareFactory) release(eventID int, seenAt time.Time) {
+	wsmf.mu.Lock()
+	defer wsmf.mu.Unlock()
+	if reservedAt, ok := wsmf.seenIDs[eventID]; ok && reservedAt.Equal(seenAt) {
+		delete(wsmf.seenIDs, eventID)
+	}
+}
+
+// parseEventTime accepts unix timestamps in either seconds or milliseconds
+func parseEventTime(eventTime int64) time.Time {
+	if eventTime <= 0 {
+		return time.Time{}
+	}
+	if eventTime > 1e12 {
+		return time.UnixMilli(eventTime)
+	}
+	return time.Unix(eventTime, 0)
+}
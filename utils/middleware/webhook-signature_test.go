@@ -0,0 +1,124 @@
+package middleware
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/FreeJ1nG/bikuntracker-backend/app/models"
+)
+
+const testWebhookSecret = "test-secret"
+
+var testWebhookNow = time.Unix(1704096000, 0)
+
+func newTestWebhookFactory(secret string) *webhookSignatureMiddlewareFactory {
+	wsmf := NewWebhookSignatureMiddlewareFactory(&models.Config{WebhookSecret: secret})
+	wsmf.now = func() time.Time { return testWebhookNow }
+	return wsmf
+}
+
+func webhookBody(eventID int, eventTime time.Time) string {
+	return fmt.Sprintf(`{"event_time":%d,"event_id":%d,"event":{"data":{"imei":"123"}}}`, eventTime.Unix(), eventID)
+}
+
+func sign(secret string, body string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(body))
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func serveWebhook(handler http.HandlerFunc, body string, signature string) int {
+	r := httptest.NewRequest(http.MethodPost, "/wh", strings.NewReader(body))
+	if signature != "" {
+		r.Header.Set(WebhookSignatureHeader, signature)
+	}
+	w := httptest.NewRecorder()
+	handler(w, r)
+	return w.Code
+}
+
+func TestWebhookSignatureMiddleware(t *testing.T) {
+	okHandler := func(w http.ResponseWriter, r *http.Request) {}
+	fresh := webhookBody(1, testWebhookNow)
+
+	tests := []struct {
+		name      string
+		secret    string
+		body      string
+		signature string
+		want      int
+	}{
+		{"valid event", testWebhookSecret, fresh, sign(testWebhookSecret, fresh), http.StatusOK},
+		{"missing signature", testWebhookSecret, fresh, "", http.StatusUnauthorized},
+		{"signature of another secret", testWebhookSecret, fresh, sign("other-secret", fresh), http.StatusUnauthorized},
+		{"malformed signature", testWebhookSecret, fresh, "sha256=not-hex", http.StatusUnauthorized},
+		{"signature of another body", testWebhookSecret, fresh, sign(testWebhookSecret, webhookBody(2, testWebhookNow)), http.StatusUnauthorized},
+		{
+			"stale event",
+			testWebhookSecret,
+			webhookBody(1, testWebhookNow.Add(-10*time.Minute)),
+			sign(testWebhookSecret, webhookBody(1, testWebhookNow.Add(-10*time.Minute))),
+			http.StatusUnauthorized,
+		},
+		{
+			"event from the future",
+			testWebhookSecret,
+			webhookBody(1, testWebhookNow.Add(10*time.Minute)),
+			sign(testWebhookSecret, webhookBody(1, testWebhookNow.Add(10*time.Minute))),
+			http.StatusUnauthorized,
+		},
+		{"empty secret", "", fresh, sign("", fresh), http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handler := newTestWebhookFactory(tt.secret).Make()(okHandler)
+			if got := serveWebhook(handler, tt.body, tt.signature); got != tt.want {
+				t.Errorf("got status %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWebhookSignatureMiddlewareReplay(t *testing.T) {
+	handler := newTestWebhookFactory(testWebhookSecret).Make()(func(w http.ResponseWriter, r *http.Request) {})
+	body := webhookBody(7, testWebhookNow)
+
+	if got := serveWebhook(handler, body, sign(testWebhookSecret, body)); got != http.StatusOK {
+		t.Fatalf("first delivery got status %d, want %d", got, http.StatusOK)
+	}
+	if got := serveWebhook(handler, body, sign(testWebhookSecret, body)); got != http.StatusConflict {
+		t.Errorf("replayed delivery got status %d, want %d", got, http.StatusConflict)
+	}
+
+	other := webhookBody(8, testWebhookNow)
+	if got := serveWebhook(handler, other, sign(testWebhookSecret, other)); got != http.StatusOK {
+		t.Errorf("another event got status %d, want %d", got, http.StatusOK)
+	}
+}
+
+func TestWebhookSignatureMiddlewareRetryAfterFailure(t *testing.T) {
+	status := http.StatusInternalServerError
+	handler := newTestWebhookFactory(testWebhookSecret).Make()(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+	})
+	body := webhookBody(9, testWebhookNow)
+
+	if got := serveWebhook(handler, body, sign(testWebhookSecret, body)); got != http.StatusInternalServerError {
+		t.Fatalf("failed delivery got status %d, want %d", got, http.StatusInternalServerError)
+	}
+	// The failed event was never processed, so its retry must reach the handler
+	status = http.StatusOK
+	if got := serveWebhook(handler, body, sign(testWebhookSecret, body)); got != http.StatusOK {
+		t.Fatalf("retry got status %d, want %d", got, http.StatusOK)
+	}
+	if got := serveWebhook(handler, body, sign(testWebhookSecret, body)); got != http.StatusConflict {
+		t.Errorf("replay of the processed retry got status %d, want %d", got, http.StatusConflict)
+	}
+}